@@ -0,0 +1,362 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// DefaultPrefix default visible prefix of keys
+const DefaultPrefix = "key"
+
+// ErrInvalid key is malformed, unknown, revoked or expired
+var ErrInvalid = errors.New("apikey: invalid key")
+
+// Backend manager to keep keys, implemented by every backend. It should be
+// dedicated to keys, the ttl of manager does not matter since the lifetime
+// of every key is set by Expire, which Verify does not extend.
+type Backend interface {
+	token.SessionManager
+	Lookup(tk string) (token.Entry, error)
+	// Rewrite replace payload of token in place, ttl and metadata are kept
+	Rewrite(tk string, data []byte) error
+	// Expire set remaining ttl of token, zero ttl means it never expires
+	Expire(tk string, ttl time.Duration) error
+}
+
+// Config store config
+type Config struct {
+	// Prefix visible prefix of keys such as "sk", it must not contain "_",
+	// default is DefaultPrefix
+	Prefix string
+	// Clock time source, default is token.SystemClock
+	Clock token.Clock
+}
+
+// Key api key, the secret is never stored, only its sha256 hash
+type Key struct {
+	// ID public id of key, it is the token of key in manager
+	ID      string    `json:"id"`
+	Prefix  string    `json:"prefix"`
+	UID     string    `json:"uid"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	// Expires zero means the key never expires
+	Expires time.Time `json:"expires"`
+	// LastUsed time of last successful Verify, it equals to Created when the
+	// key is never used and it is kept in memory only by logfile backend
+	LastUsed time.Time `json:"-"`
+
+	secret string
+	clock  token.Clock
+}
+
+// Public returns visible part of key like "key_<id>", it identifies the key
+// without the secret
+func (k *Key) Public() string {
+	return k.Prefix + "_" + k.ID
+}
+
+// Expired returns whether the key is expired at now
+func (k *Key) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// GetTK get token
+func (k *Key) GetTK() string {
+	return k.ID
+}
+
+// GetUID get uid
+func (k *Key) GetUID() string {
+	return k.UID
+}
+
+// GetName get name
+func (k *Key) GetName() string {
+	return k.Name
+}
+
+// Serialize serialize key without secret
+func (k *Key) Serialize() ([]byte, error) {
+	return json.Marshal(k)
+}
+
+// UnSerialize unserialize key
+func (k *Key) UnSerialize(tk string, data []byte) error {
+	return json.Unmarshal(data, k)
+}
+
+// Verify compare hash of secret in constant time and check expiry
+func (k *Key) Verify(data []byte) (bool, error) {
+	var dst Key
+	err := json.Unmarshal(data, &dst)
+	if err != nil {
+		return false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash(k.secret)), []byte(dst.Hash)) != 1 {
+		return false, nil
+	}
+	if dst.Expired(k.clock.Now()) {
+		return false, nil
+	}
+	dst.secret, dst.clock = k.secret, k.clock
+	*k = dst
+	return true, nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+var encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func random(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(buf), nil
+}
+
+// Store named api keys of users, keys look like "<prefix>_<id>_<secret>"
+type Store struct {
+	mgr Backend
+	cfg Config
+}
+
+// New new store
+func New(mgr Backend, cfg Config) *Store {
+	if len(cfg.Prefix) == 0 {
+		cfg.Prefix = DefaultPrefix
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = token.SystemClock
+	}
+	return &Store{mgr: mgr, cfg: cfg}
+}
+
+// Create create key named name for uid, zero ttl means the key never
+// expires. The returned raw key is not kept and can not be shown again.
+func (s *Store) Create(uid, name string, ttl time.Duration) (string, *Key, error) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = s.cfg.Clock.Now().Add(ttl)
+	}
+	return s.create(uid, name, expires)
+}
+
+func (s *Store) create(uid, name string, expires time.Time) (string, *Key, error) {
+	id, err := random(10)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := random(32)
+	if err != nil {
+		return "", nil, err
+	}
+	k := &Key{
+		ID:      id,
+		Prefix:  s.cfg.Prefix,
+		UID:     uid,
+		Name:    name,
+		Hash:    hash(secret),
+		Created: s.cfg.Clock.Now(),
+		Expires: expires,
+	}
+	err = s.mgr.Save(k)
+	if err != nil {
+		return "", nil, err
+	}
+	err = s.expire(k)
+	if err != nil {
+		s.mgr.Revoke(uid, id)
+		return "", nil, err
+	}
+	k.LastUsed = k.Created
+	return k.Public() + "_" + secret, k, nil
+}
+
+// expire set lifetime of k in manager, keys without expiry are kept until
+// revoked
+func (s *Store) expire(k *Key) error {
+	var ttl time.Duration
+	if !k.Expires.IsZero() {
+		ttl = k.Expires.Sub(s.cfg.Clock.Now())
+	}
+	return s.mgr.Expire(k.ID, ttl)
+}
+
+// parse split raw key into id and secret
+func (s *Store) parse(raw string) (string, string, bool) {
+	if !strings.HasPrefix(raw, s.cfg.Prefix+"_") {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(raw, s.cfg.Prefix+"_"), "_")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Verify verify raw key, returns ErrInvalid when the key is not accepted.
+// The last used time is recorded by the manager as the last seen time of
+// the session, so no key data is rewritten.
+func (s *Store) Verify(raw string) (*Key, error) {
+	id, secret, ok := s.parse(raw)
+	if !ok {
+		return nil, ErrInvalid
+	}
+	sess, err := s.mgr.Session(id)
+	if err == token.ErrNotfound {
+		return nil, ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	k := &Key{ID: id, UID: sess.UID, secret: secret, clock: s.cfg.Clock}
+	ok, err = s.mgr.Verify(k)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalid
+	}
+	k.LastUsed = s.cfg.Clock.Now()
+	return k, nil
+}
+
+// Get get key of uid by id
+func (s *Store) Get(uid, id string) (*Key, error) {
+	sess, err := s.mgr.Session(id)
+	if err != nil {
+		return nil, err
+	}
+	if sess.UID != uid {
+		return nil, token.ErrNotfound
+	}
+	return s.key(sess)
+}
+
+func (s *Store) key(sess token.Session) (*Key, error) {
+	e, err := s.mgr.Lookup(sess.Token)
+	if err != nil {
+		return nil, err
+	}
+	var k Key
+	err = k.UnSerialize(e.Token, e.Data)
+	if err != nil {
+		return nil, err
+	}
+	if k.Expired(s.cfg.Clock.Now()) {
+		return nil, token.ErrNotfound
+	}
+	k.LastUsed = sess.LastSeen
+	return &k, nil
+}
+
+// List list keys of uid which are not expired ordered by creation
+func (s *Store) List(uid string) ([]*Key, error) {
+	list, err := s.mgr.Sessions(uid)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Key, 0, len(list))
+	for _, sess := range list {
+		k, err := s.key(sess)
+		if err == token.ErrNotfound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return ret, nil
+}
+
+// Find list keys of uid named name, there are more than one key while the
+// key is rotating
+func (s *Store) Find(uid, name string) ([]*Key, error) {
+	list, err := s.List(uid)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Key
+	for _, k := range list {
+		if k.Name == name {
+			ret = append(ret, k)
+		}
+	}
+	return ret, nil
+}
+
+// Revoke revoke key of uid by id, token.ErrNotfound is returned when the key
+// does not exist or it belongs to another user
+func (s *Store) Revoke(uid, id string) error {
+	sess, err := s.mgr.Session(id)
+	if err != nil {
+		return err
+	}
+	if sess.UID != uid {
+		return token.ErrNotfound
+	}
+	s.mgr.Revoke(uid, id)
+	return nil
+}
+
+// Rotate create new key with the same name and lifetime as key id of uid,
+// the old key keeps working for overlap and it is revoked at once when
+// overlap is not positive
+func (s *Store) Rotate(uid, id string, overlap time.Duration) (string, *Key, error) {
+	old, err := s.Get(uid, id)
+	if err != nil {
+		return "", nil, err
+	}
+	now := s.cfg.Clock.Now()
+	var expires time.Time
+	if !old.Expires.IsZero() {
+		expires = now.Add(old.Expires.Sub(old.Created))
+	}
+	raw, k, err := s.create(uid, old.Name, expires)
+	if err != nil {
+		return "", nil, err
+	}
+	if overlap <= 0 {
+		s.mgr.Revoke(uid, id)
+		return raw, k, nil
+	}
+	if old.Expired(now.Add(overlap)) {
+		return raw, k, nil
+	}
+	// only the payload and lifetime are rewritten, so creation and metadata
+	// of the old key are kept in manager
+	old.Expires = now.Add(overlap)
+	data, err := old.Serialize()
+	if err == nil {
+		err = s.mgr.Rewrite(id, data)
+	}
+	if err == nil {
+		err = s.expire(old)
+	}
+	if err != nil {
+		s.mgr.Revoke(uid, k.ID)
+		return "", nil, err
+	}
+	return raw, k, nil
+}
@@ -0,0 +1,174 @@
+package apikey
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/logfile"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+func testStore(t *testing.T, mgr Backend, clk *tokentest.Clock) {
+	s := New(mgr, Config{Prefix: "sk", Clock: clk})
+	raw, k, err := s.Create("1", "ci", 0)
+	if err != nil {
+		t.Fatalf("unexpected create key: %v", err)
+	}
+	if !strings.HasPrefix(raw, k.Public()+"_") || !strings.HasPrefix(k.Public(), "sk_") {
+		t.Fatalf("unexpected key: %s %s", raw, k.Public())
+	}
+	if strings.Contains(string(mustSerialize(t, k)), strings.TrimPrefix(raw, k.Public()+"_")) {
+		t.Fatal("secret is serialized")
+	}
+
+	// unused keys outlive ttl of manager
+	clk.Add(2 * time.Hour)
+	got, err := s.Verify(raw)
+	if err != nil || got.UID != "1" || got.Name != "ci" || got.ID != k.ID {
+		t.Fatalf("unexpected verify: %+v %v", got, err)
+	}
+	for _, bad := range []string{raw + "x", k.Public() + "_secret", "sk_" + k.ID, "other"} {
+		_, err = s.Verify(bad)
+		if err != ErrInvalid {
+			t.Fatalf("unexpected verify of %s: %v", bad, err)
+		}
+	}
+	list, err := s.List("1")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("unexpected list: %d %v", len(list), err)
+	}
+	// redis keeps milliseconds
+	if d := clk.Now().Sub(list[0].LastUsed); d < 0 || d >= time.Millisecond {
+		t.Fatalf("unexpected last used: %s", list[0].LastUsed)
+	}
+
+	// keys without expiry outlive years
+	clk.Add(3 * 365 * 24 * time.Hour)
+	_, err = s.Verify(raw)
+	if err != nil {
+		t.Fatalf("verify of old key failed: %v", err)
+	}
+
+	raw2, k2, err := s.Create("1", "deploy", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected create key: %v", err)
+	}
+	clk.Add(time.Minute)
+	_, err = s.Verify(raw2)
+	if err != nil {
+		t.Fatalf("unexpected verify: %v", err)
+	}
+	before, err := mgr.Session(k2.ID)
+	if err != nil {
+		t.Fatalf("unexpected session: %v", err)
+	}
+	clk.Add(time.Minute)
+	raw3, k3, err := s.Rotate("1", k2.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected rotate key: %v", err)
+	}
+	// session of old key is kept while its payload and lifetime are
+	// rewritten
+	after, err := mgr.Session(k2.ID)
+	if err != nil {
+		t.Fatalf("unexpected session after rotate: %v", err)
+	}
+	if !after.Created.Equal(before.Created) || !after.LastSeen.Equal(before.LastSeen) ||
+		after.TTL != time.Hour || after.Meta != before.Meta {
+		t.Fatalf("unexpected session after rotate: %+v, before %+v", after, before)
+	}
+	if k3.Name != "deploy" || !k3.Expires.Equal(clk.Now().Add(24*time.Hour)) {
+		t.Fatalf("unexpected rotated key: %+v", k3)
+	}
+	found, err := s.Find("1", "deploy")
+	if err != nil || len(found) != 2 {
+		t.Fatalf("unexpected find while rotating: %d %v", len(found), err)
+	}
+	for _, r := range []string{raw2, raw3} {
+		_, err = s.Verify(r)
+		if err != nil {
+			t.Fatalf("verify while rotating failed: %v", err)
+		}
+	}
+	clk.Add(time.Hour + time.Second)
+	_, err = s.Verify(raw2)
+	if err != ErrInvalid {
+		t.Fatalf("unexpected verify after overlap: %v", err)
+	}
+	found, err = s.Find("1", "deploy")
+	if err != nil || len(found) != 1 || found[0].ID != k3.ID {
+		t.Fatalf("unexpected find after overlap: %d %v", len(found), err)
+	}
+	clk.Add(24 * time.Hour)
+	_, err = s.Verify(raw3)
+	if err != ErrInvalid {
+		t.Fatalf("unexpected verify of expired key: %v", err)
+	}
+
+	err = s.Revoke("2", k.ID)
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected revoke key of other uid: %v", err)
+	}
+	_, err = s.Verify(raw)
+	if err != nil {
+		t.Fatalf("key is revoked by other uid: %v", err)
+	}
+	err = s.Revoke("1", k.ID)
+	if err != nil {
+		t.Fatalf("unexpected revoke key: %v", err)
+	}
+	_, err = s.Verify(raw)
+	if err != ErrInvalid {
+		t.Fatalf("unexpected verify of revoked key: %v", err)
+	}
+	err = s.Revoke("1", k.ID)
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected revoke of revoked key: %v", err)
+	}
+	_, err = s.Get("2", k3.ID)
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected get key of other uid: %v", err)
+	}
+}
+
+func mustSerialize(t *testing.T, k *Key) []byte {
+	data, err := k.Serialize()
+	if err != nil {
+		t.Fatalf("unexpected serialize: %v", err)
+	}
+	return data
+}
+
+func TestStoreFile(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	testStore(t, file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk)), clk)
+}
+
+func TestStoreRedis(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	srv.SetClock(clk)
+	testStore(t, redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, time.Hour, token.WithClock(clk)), clk)
+}
+
+func TestStoreLogfile(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	mgr, err := logfile.NewManager(filepath.Join(t.TempDir(), "keys.log"), time.Hour, token.WithClock(clk))
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	defer mgr.Close()
+	testStore(t, mgr, clk)
+}
@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// Result of audited operation
+const (
+	ResultOK    = "ok"
+	ResultFail  = "fail"
+	ResultError = "error"
+)
+
+// Record audit record, the raw token is never recorded
+type Record struct {
+	Time        time.Time `json:"time"`
+	Op          token.Op  `json:"op"`
+	Actor       string    `json:"actor,omitempty"`
+	UID         string    `json:"uid,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Fingerprint returns stable non-reversible identifier of token, the first
+// 16 hex chars of its sha256
+func Fingerprint(tk string) string {
+	if len(tk) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(tk))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewRecord build record from event
+func NewRecord(e token.Event) Record {
+	r := Record{
+		Time:        e.Time,
+		Op:          e.Op,
+		Actor:       e.Actor,
+		UID:         e.UID,
+		Fingerprint: Fingerprint(e.Token),
+		Result:      ResultOK,
+	}
+	switch {
+	case e.Err != nil:
+		r.Result = ResultError
+		r.Error = e.Err.Error()
+	case !e.OK:
+		r.Result = ResultFail
+	}
+	if len(r.Actor) == 0 && (e.Op == token.OpSave || e.Op == token.OpVerify) {
+		r.Actor = e.UID
+	}
+	return r
+}
+
+// Sink audit record storage
+type Sink interface {
+	Write(Record) error
+}
+
+// Recorder token.Observer which writes events to sink, add it to managers
+// by token.WithObserver
+type Recorder struct {
+	sink Sink
+	ops  map[token.Op]bool
+	// OnError called when sink failed to write record, records are dropped
+	// silently when it is nil
+	OnError func(Record, error)
+}
+
+// NewRecorder new recorder, only the given ops are recorded when ops is not
+// empty
+func NewRecorder(sink Sink, ops ...token.Op) *Recorder {
+	r := &Recorder{sink: sink}
+	if len(ops) > 0 {
+		r.ops = make(map[token.Op]bool, len(ops))
+		for _, op := range ops {
+			r.ops[op] = true
+		}
+	}
+	return r
+}
+
+// Observe write event to sink
+func (r *Recorder) Observe(e token.Event) {
+	if r.ops != nil && !r.ops[e.Op] {
+		return
+	}
+	rec := NewRecord(e)
+	err := r.sink.Write(rec)
+	if err != nil && r.OnError != nil {
+		r.OnError(rec, err)
+	}
+}
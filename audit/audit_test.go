@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+type manager interface {
+	token.Manager
+	RevokeBy(actor, uid, tk string)
+	Purge() (int, error)
+}
+
+func testAudit(t *testing.T, mgr manager, clk *tokentest.Clock, records func() []Record) {
+	// wait for janitor
+	clk.BlockUntil(1)
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("2", "world")
+	for _, tk := range []*tokentest.Token{tk1, tk2} {
+		err := mgr.Save(tk)
+		if err != nil {
+			t.Fatalf("unexpected save token: %v", err)
+		}
+	}
+	ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || !ok {
+		t.Fatalf("verify token failed: %v", err)
+	}
+	ok, err = mgr.Verify(tokentest.NewToken("1", "guess"))
+	if err != nil || ok {
+		t.Fatalf("unexpected verify of unknown token: %v", err)
+	}
+	mgr.RevokeBy("admin", tk1.Uid, tk1.Token)
+	clk.Add(20 * time.Second)
+	n, err := mgr.Purge()
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected purge: %d %v", n, err)
+	}
+
+	want := []Record{
+		{Op: token.OpSave, Actor: "1", UID: "1", Fingerprint: Fingerprint(tk1.Token), Result: ResultOK},
+		{Op: token.OpSave, Actor: "2", UID: "2", Fingerprint: Fingerprint(tk2.Token), Result: ResultOK},
+		{Op: token.OpVerify, Actor: "1", UID: "1", Fingerprint: Fingerprint(tk1.Token), Result: ResultOK},
+		{Op: token.OpVerify, Actor: "1", UID: "1", Result: ResultFail},
+		{Op: token.OpRevoke, Actor: "admin", UID: "1", Fingerprint: Fingerprint(tk1.Token), Result: ResultOK},
+		{Op: token.OpExpire, UID: "2", Fingerprint: Fingerprint(tk2.Token), Result: ResultOK},
+	}
+	got := records()
+	if len(got) != len(want) {
+		t.Fatalf("unexpected records count: %d", len(got))
+	}
+	for i, r := range got {
+		if r.Time.IsZero() {
+			t.Fatalf("missing time of record %d", i)
+		}
+		r.Time = time.Time{}
+		if r.Op == token.OpVerify && r.Result == ResultFail {
+			r.Fingerprint = ""
+		}
+		if r != want[i] {
+			t.Fatalf("unexpected record %d: %+v", i, r)
+		}
+	}
+}
+
+func TestAuditFile(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileSink(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("unexpected open sink: %v", err)
+	}
+	defer sink.Close()
+	clk := tokentest.NewClock(time.Now())
+	mgr := file.NewManager(filepath.Join(dir, "tokens"), 10*time.Second,
+		token.WithClock(clk), token.WithObserver(NewRecorder(sink)))
+	testAudit(t, mgr, clk, func() []Record {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+		if err != nil {
+			t.Fatalf("unexpected read audit log: %v", err)
+		}
+		var ret []Record
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var r Record
+			err = json.Unmarshal([]byte(line), &r)
+			if err != nil {
+				t.Fatalf("unexpected audit line %q: %v", line, err)
+			}
+			ret = append(ret, r)
+		}
+		return ret
+	})
+}
+
+func TestAuditRedis(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	srv.SetClock(clk)
+	cli := goredis.NewClient(&goredis.Options{Addr: srv.Addr()})
+	defer cli.Close()
+	mgr := redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, 10*time.Second, token.WithClock(clk),
+		token.WithObserver(NewRecorder(NewStreamSink(cli, "audit", 1000))))
+	testAudit(t, mgr, clk, func() []Record {
+		msgs, err := cli.XRange(context.Background(), "audit", "-", "+").Result()
+		if err != nil {
+			t.Fatalf("unexpected xrange: %v", err)
+		}
+		var ret []Record
+		for _, msg := range msgs {
+			tm, err := time.Parse(time.RFC3339Nano, msg.Values["time"].(string))
+			if err != nil {
+				t.Fatalf("unexpected time of record: %v", err)
+			}
+			ret = append(ret, Record{
+				Time:        tm,
+				Op:          token.Op(msg.Values["op"].(string)),
+				Actor:       msg.Values["actor"].(string),
+				UID:         msg.Values["uid"].(string),
+				Fingerprint: msg.Values["fingerprint"].(string),
+				Result:      msg.Values["result"].(string),
+				Error:       msg.Values["error"].(string),
+			})
+		}
+		return ret
+	})
+}
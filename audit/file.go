@@ -0,0 +1,41 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileSink write records to file as json lines
+type FileSink struct {
+	sync.Mutex
+	f *os.File
+}
+
+// NewFileSink open file for appending, it is created when not exists
+func NewFileSink(name string) (*FileSink, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+// Write append record as one line
+func (s *FileSink) Write(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.f.Write(append(data, '\n'))
+	return err
+}
+
+// Close close file
+func (s *FileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,38 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StreamSink write records to redis stream by XADD
+type StreamSink struct {
+	cli    redis.UniversalClient
+	stream string
+	maxLen int64
+}
+
+// NewStreamSink new redis stream sink, the stream is trimmed approximately
+// to maxLen entries when maxLen > 0
+func NewStreamSink(cli redis.UniversalClient, stream string, maxLen int64) *StreamSink {
+	return &StreamSink{cli: cli, stream: stream, maxLen: maxLen}
+}
+
+// Write add record to stream, one field per record field
+func (s *StreamSink) Write(r Record) error {
+	return s.cli.XAdd(context.Background(), &redis.XAddArgs{
+		Stream:       s.stream,
+		MaxLenApprox: s.maxLen,
+		Values: map[string]interface{}{
+			"time":        r.Time.Format(time.RFC3339Nano),
+			"op":          string(r.Op),
+			"actor":       r.Actor,
+			"uid":         r.UID,
+			"fingerprint": r.Fingerprint,
+			"result":      r.Result,
+			"error":       r.Error,
+		},
+	}).Err()
+}
@@ -0,0 +1,184 @@
+package binding
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lwch/token"
+)
+
+// ErrMismatch token is presented from context other than the bound one
+var ErrMismatch = errors.New("binding: token is bound to another client")
+
+// ErrNoContext context has no value required by binder
+var ErrNoContext = errors.New("binding: missing client context")
+
+// Context client context presented with token
+type Context struct {
+	IP   net.IP
+	Cert *x509.Certificate
+	// Value custom value such as device id
+	Value string
+}
+
+// FromRequest returns context of request, the ip is taken from RemoteAddr
+// so requests through proxies should be rewritten before
+func FromRequest(r *http.Request) Context {
+	var ctx Context
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ctx.IP = net.ParseIP(host)
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		ctx.Cert = r.TLS.PeerCertificates[0]
+	}
+	return ctx
+}
+
+// Binder returns fingerprint of context
+type Binder interface {
+	Fingerprint(Context) (string, error)
+}
+
+// BinderFunc adapter to use function as binder
+type BinderFunc func(Context) (string, error)
+
+// Fingerprint call fn
+func (fn BinderFunc) Fingerprint(ctx Context) (string, error) {
+	return fn(ctx)
+}
+
+// IP bind to subnet of client ip, v4 and v6 are the prefix lengths such as
+// 24 and 64, full addresses are used when they are not positive
+func IP(v4, v6 int) Binder {
+	return BinderFunc(func(ctx Context) (string, error) {
+		if ctx.IP == nil {
+			return "", ErrNoContext
+		}
+		ip, bits, size := ctx.IP.To4(), v4, 32
+		if ip == nil {
+			ip, bits, size = ctx.IP.To16(), v6, 128
+		}
+		if bits <= 0 || bits > size {
+			bits = size
+		}
+		subnet := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+		return "ip:" + subnet.String(), nil
+	})
+}
+
+// Cert bind to sha256 thumbprint of tls client certificate like x5t#S256
+func Cert() Binder {
+	return BinderFunc(func(ctx Context) (string, error) {
+		if ctx.Cert == nil {
+			return "", ErrNoContext
+		}
+		sum := sha256.Sum256(ctx.Cert.Raw)
+		return "x5t:" + base64.RawURLEncoding.EncodeToString(sum[:]), nil
+	})
+}
+
+// Value bind to custom value of context, the value is stored hashed
+func Value() Binder {
+	return BinderFunc(func(ctx Context) (string, error) {
+		if len(ctx.Value) == 0 {
+			return "", ErrNoContext
+		}
+		sum := sha256.Sum256([]byte(ctx.Value))
+		return "v:" + base64.RawURLEncoding.EncodeToString(sum[:]), nil
+	})
+}
+
+// All bind to every binder
+func All(binders ...Binder) Binder {
+	return BinderFunc(func(ctx Context) (string, error) {
+		fps := make([]string, 0, len(binders))
+		for _, b := range binders {
+			fp, err := b.Fingerprint(ctx)
+			if err != nil {
+				return "", err
+			}
+			fps = append(fps, fp)
+		}
+		return strings.Join(fps, ","), nil
+	})
+}
+
+// Manager bind tokens saved through it to client context, tokens saved
+// without binding are accepted from any context
+type Manager struct {
+	mgr    token.SessionManager
+	binder Binder
+}
+
+// New new manager
+func New(mgr token.SessionManager, binder Binder) *Manager {
+	return &Manager{mgr: mgr, binder: binder}
+}
+
+// Save save token bound to ctx
+func (m *Manager) Save(tk token.Token, ctx Context, meta token.Meta) error {
+	fp, err := m.binder.Fingerprint(ctx)
+	if err != nil {
+		return err
+	}
+	meta.Binding = fp
+	return m.mgr.SaveSession(tk, meta)
+}
+
+// Verify verify token presented from ctx, returns ErrMismatch without
+// verifying the token when ctx does not match the binding
+func (m *Manager) Verify(tk token.Token, ctx Context) (bool, error) {
+	s, err := m.mgr.Session(tk.GetTK())
+	if err == token.ErrNotfound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(s.Meta.Binding) > 0 {
+		fp, err := m.binder.Fingerprint(ctx)
+		if err == ErrNoContext {
+			return false, ErrMismatch
+		}
+		if err != nil {
+			return false, err
+		}
+		if fp != s.Meta.Binding {
+			return false, ErrMismatch
+		}
+	}
+	return m.mgr.Verify(tk)
+}
+
+// Manager returns manager which verifies tokens presented from ctx
+func (m *Manager) Manager(ctx Context) token.Manager {
+	return client{m: m, ctx: ctx}
+}
+
+type client struct {
+	m   *Manager
+	ctx Context
+}
+
+func (c client) Save(tk token.Token) error {
+	return c.m.Save(tk, c.ctx, token.Meta{})
+}
+
+func (c client) Verify(tk token.Token) (bool, error) {
+	return c.m.Verify(tk, c.ctx)
+}
+
+func (c client) Revoke(uid, tk string) {
+	c.m.mgr.Revoke(uid, tk)
+}
+
+func (c client) Get(uid string, tk token.Token) error {
+	return c.m.mgr.Get(uid, tk)
+}
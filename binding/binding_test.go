@@ -0,0 +1,112 @@
+package binding
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+func testBinding(t *testing.T, mgr token.SessionManager) {
+	m := New(mgr, IP(24, 64))
+	tk1 := tokentest.NewToken("1", "hello")
+	err := m.Save(tk1, Context{IP: net.ParseIP("10.0.0.1")}, token.Meta{Device: "phone"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	s, err := mgr.Session(tk1.Token)
+	if err != nil {
+		t.Fatalf("unexpected session: %v", err)
+	}
+	if s.Meta.Binding != "ip:10.0.0.0/24" || s.Meta.Device != "phone" {
+		t.Fatalf("unexpected session meta: %+v", s.Meta)
+	}
+	ok, err := m.Verify(&tokentest.Token{Token: tk1.Token}, Context{IP: net.ParseIP("10.0.0.200")})
+	if err != nil || !ok {
+		t.Fatalf("verify from same subnet failed: %v", err)
+	}
+	ok, err = m.Verify(&tokentest.Token{Token: tk1.Token}, Context{IP: net.ParseIP("10.0.1.1")})
+	if err != ErrMismatch || ok {
+		t.Fatalf("unexpected verify from other subnet: %v", err)
+	}
+	ok, err = m.Manager(Context{}).Verify(&tokentest.Token{Token: tk1.Token})
+	if err != ErrMismatch || ok {
+		t.Fatalf("unexpected verify without context: %v", err)
+	}
+	ok, err = m.Verify(tokentest.NewToken("1", "guess"), Context{IP: net.ParseIP("10.0.0.1")})
+	if err != nil || ok {
+		t.Fatalf("unexpected verify of unknown token: %v", err)
+	}
+
+	// tokens saved without binding
+	tk2 := tokentest.NewToken("2", "world")
+	err = mgr.Save(tk2)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	ok, err = m.Verify(&tokentest.Token{Token: tk2.Token}, Context{IP: net.ParseIP("192.168.1.1")})
+	if err != nil || !ok {
+		t.Fatalf("verify of unbound token failed: %v", err)
+	}
+
+	v := New(mgr, All(Cert(), Value()))
+	cert := &x509.Certificate{Raw: []byte("client")}
+	tk3 := tokentest.NewToken("3", "cert")
+	err = v.Manager(Context{Cert: cert, Value: "device-1"}).Save(tk3)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	ok, err = v.Verify(&tokentest.Token{Token: tk3.Token}, Context{Cert: cert, Value: "device-1"})
+	if err != nil || !ok {
+		t.Fatalf("verify of bound certificate failed: %v", err)
+	}
+	ok, err = v.Verify(&tokentest.Token{Token: tk3.Token}, Context{
+		Cert:  &x509.Certificate{Raw: []byte("other")},
+		Value: "device-1",
+	})
+	if err != ErrMismatch || ok {
+		t.Fatalf("unexpected verify of other certificate: %v", err)
+	}
+	err = v.Save(tokentest.NewToken("3", "nocert"), Context{Value: "device-1"}, token.Meta{})
+	if err != ErrNoContext {
+		t.Fatalf("unexpected save without certificate: %v", err)
+	}
+}
+
+func TestBindingFile(t *testing.T) {
+	testBinding(t, file.NewManager(t.TempDir(), time.Hour))
+}
+
+func TestBindingRedis(t *testing.T) {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	testBinding(t, redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, time.Hour))
+}
+
+func TestFromRequest(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("client")}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:4321"
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	ctx := FromRequest(r)
+	if !ctx.IP.Equal(net.ParseIP("2001:db8::1")) || ctx.Cert != cert {
+		t.Fatalf("unexpected context: %+v", ctx)
+	}
+	fp, err := IP(24, 64).Fingerprint(ctx)
+	if err != nil || fp != "ip:2001:db8::/64" {
+		t.Fatalf("unexpected fingerprint: %s %v", fp, err)
+	}
+}
@@ -0,0 +1,22 @@
+package token
+
+import "time"
+
+// Clock time source of managers and their janitors
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock clock of time package
+var SystemClock Clock = systemClock{}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/audit"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/snapshot"
+)
+
+// store operations required by tokenctl, implemented by file.Mgr and redis.Mgr
+type store interface {
+	Walk(func(token.Entry) error) error
+	Lookup(tk string) (token.Entry, error)
+	RevokeBy(actor, uid, tk string)
+	RevokeUIDBy(actor, uid string) error
+	Purge() (int, error)
+	Restore(token.Entry) error
+	Close() error
+}
+
+const usage = `Usage: tokenctl [options] <command> [args]
+
+Commands:
+  list               list all tokens
+  users              list users and their token count
+  show <token>       show decoded payload of token
+  ttl <token>        show remaining ttl of token
+  revoke <token>     revoke token
+  revoke -uid <uid>  revoke all tokens of user
+  purge              purge expired entries
+  export [file]      write snapshot to file or stdout
+  import [file]      restore snapshot from file or stdin
+
+Options:
+`
+
+var (
+	dir      = flag.String("dir", "", "token directory of file backend")
+	addrs    = flag.String("redis", "", "comma separated redis addresses")
+	user     = flag.String("user", "", "redis user")
+	password = flag.String("password", "", "redis password")
+	db       = flag.Int("db", 0, "redis database")
+	prefix   = flag.String("prefix", "", "redis key prefix")
+	ttl      = flag.Duration("ttl", 0, "token ttl of file backend, must match the service")
+	jsonOut  = flag.Bool("json", false, "output json")
+	auditLog = flag.String("audit", "", "append audit records of revoke and purge to file")
+)
+
+// cli commands of tokenctl on store
+type cli struct {
+	st     store
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	json   bool
+	actor  string
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	st, err := open()
+	if err != nil {
+		fatal(err)
+	}
+	c := &cli{
+		st:     st,
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		json:   *jsonOut,
+		actor:  actor(),
+	}
+	err = c.run(flag.Args())
+	st.Close()
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// errUsage unknown command
+var errUsage = errors.New("unknown command")
+
+func (c *cli) run(args []string) error {
+	switch args[0] {
+	case "list":
+		return c.list()
+	case "users":
+		return c.users()
+	case "show":
+		return c.show(args[1:])
+	case "ttl":
+		return c.showTTL(args[1:])
+	case "revoke":
+		return c.revoke(args[1:])
+	case "purge":
+		return c.purge()
+	case "export":
+		return c.export(args[1:])
+	case "import":
+		return c.restore(args[1:])
+	}
+	return errUsage
+}
+
+// open open store by flags, the janitor is not started so that read-only
+// commands never change the store
+func open() (store, error) {
+	opts := []token.Option{token.WithoutJanitor()}
+	if len(*auditLog) > 0 {
+		sink, err := audit.NewFileSink(*auditLog)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, token.WithObserver(
+			audit.NewRecorder(sink, token.OpRevoke, token.OpExpire)))
+	}
+	switch {
+	case len(*dir) > 0 && len(*addrs) > 0:
+		return nil, errors.New("-dir and -redis are mutually exclusive")
+	case len(*dir) > 0:
+		if *ttl <= 0 {
+			return nil, errors.New("-ttl is required for file backend")
+		}
+		if _, err := os.Stat(*dir); err != nil {
+			return nil, err
+		}
+		return file.NewManager(*dir, *ttl, opts...), nil
+	case len(*addrs) > 0:
+		return redis.NewManager(redis.RedisConf{
+			Addrs:    strings.Split(*addrs, ","),
+			User:     *user,
+			Password: *password,
+			DB:       *db,
+			Prefix:   *prefix,
+		}, redis.DefaultTTL, opts...), nil
+	}
+	return nil, errors.New("missing -dir or -redis")
+}
+
+// actor returns the actor reported to audit log
+func actor() string {
+	return "tokenctl:" + os.Getenv("USER")
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "tokenctl:", err)
+	os.Exit(1)
+}
+
+type entry struct {
+	UID     string      `json:"uid"`
+	Token   string      `json:"token"`
+	TTL     string      `json:"ttl"`
+	Expires *time.Time  `json:"expires,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+func newEntry(e token.Entry, payload bool) entry {
+	ret := entry{
+		UID:   e.UID,
+		Token: e.Token,
+		TTL:   "none",
+	}
+	if e.TTL > 0 {
+		ret.TTL = e.TTL.Truncate(time.Second).String()
+		exp := time.Now().Add(e.TTL).Truncate(time.Second)
+		ret.Expires = &exp
+	}
+	if payload {
+		ret.Payload = decode(e.Data)
+	}
+	return ret
+}
+
+// decode returns json payload as is, text as string and binary as base64
+func decode(data []byte) interface{} {
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func (c *cli) output(v interface{}, text func(w *tabwriter.Writer)) error {
+	if c.json {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
+
+func (c *cli) list() error {
+	var entries []entry
+	err := c.st.Walk(func(e token.Entry) error {
+		entries = append(entries, newEntry(e, false))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].UID == entries[j].UID {
+			return entries[i].Token < entries[j].Token
+		}
+		return entries[i].UID < entries[j].UID
+	})
+	return c.output(entries, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "UID\tTOKEN\tTTL")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.UID, e.Token, e.TTL)
+		}
+	})
+}
+
+func (c *cli) users() error {
+	type user struct {
+		UID    string `json:"uid"`
+		Tokens int    `json:"tokens"`
+	}
+	cnt := make(map[string]int)
+	err := c.st.Walk(func(e token.Entry) error {
+		cnt[e.UID]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	list := make([]user, 0, len(cnt))
+	for uid, n := range cnt {
+		list = append(list, user{UID: uid, Tokens: n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UID < list[j].UID
+	})
+	return c.output(list, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "UID\tTOKENS")
+		for _, u := range list {
+			fmt.Fprintf(w, "%s\t%d\n", u.UID, u.Tokens)
+		}
+	})
+}
+
+func (c *cli) lookup(args []string) (token.Entry, error) {
+	if len(args) != 1 {
+		return token.Entry{}, errors.New("missing token")
+	}
+	return c.st.Lookup(args[0])
+}
+
+func (c *cli) show(args []string) error {
+	e, err := c.lookup(args)
+	if err != nil {
+		return err
+	}
+	ent := newEntry(e, true)
+	return c.output(ent, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "uid:\t%s\n", ent.UID)
+		fmt.Fprintf(w, "token:\t%s\n", ent.Token)
+		fmt.Fprintf(w, "ttl:\t%s\n", ent.TTL)
+		w.Flush()
+		switch payload := ent.Payload.(type) {
+		case json.RawMessage:
+			enc := json.NewEncoder(c.stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(payload)
+		default:
+			fmt.Fprintln(c.stdout, payload)
+		}
+	})
+}
+
+func (c *cli) showTTL(args []string) error {
+	e, err := c.lookup(args)
+	if err != nil {
+		return err
+	}
+	ent := newEntry(e, false)
+	return c.output(ent, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, ent.TTL)
+	})
+}
+
+func (c *cli) revoke(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	uid := fs.String("uid", "", "revoke all tokens of user")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	type result struct {
+		UID   string `json:"uid,omitempty"`
+		Token string `json:"token,omitempty"`
+	}
+	var ret result
+	switch {
+	case len(*uid) > 0:
+		err := c.st.RevokeUIDBy(c.actor, *uid)
+		if err != nil {
+			return err
+		}
+		ret.UID = *uid
+	case fs.NArg() == 1:
+		e, err := c.st.Lookup(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		c.st.RevokeBy(c.actor, e.UID, e.Token)
+		ret.UID = e.UID
+		ret.Token = e.Token
+	default:
+		return errors.New("missing token or -uid")
+	}
+	return c.output(ret, func(w *tabwriter.Writer) {
+		if len(ret.Token) > 0 {
+			fmt.Fprintf(w, "revoked token %s of user %s\n", ret.Token, ret.UID)
+		} else {
+			fmt.Fprintf(w, "revoked all tokens of user %s\n", ret.UID)
+		}
+	})
+}
+
+func (c *cli) purge() error {
+	n, err := c.st.Purge()
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]int{"purged": n}, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "purged %d entries\n", n)
+	})
+}
+
+func (c *cli) export(args []string) error {
+	w := c.stdout
+	if len(args) > 0 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := snapshot.Export(w, c.st)
+	if err != nil {
+		return err
+	}
+	if w != c.stdout {
+		fmt.Fprintf(c.stderr, "exported %d tokens\n", n)
+	}
+	return nil
+}
+
+func (c *cli) restore(args []string) error {
+	r := c.stdin
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := snapshot.Import(r, c.st)
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]int{"imported": n}, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "imported %d tokens\n", n)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+type manager interface {
+	store
+	token.Manager
+}
+
+func testCLI(t *testing.T, mgr manager, restored manager) {
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("1", "world")
+	tk3 := tokentest.NewToken("2", "other")
+	for _, tk := range []*tokentest.Token{tk1, tk2, tk3} {
+		err := mgr.Save(tk)
+		if err != nil {
+			t.Fatalf("unexpected save token: %v", err)
+		}
+	}
+	run := func(st store, jsonOut bool, args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		c := &cli{
+			st:     st,
+			stdout: &stdout,
+			stderr: &stderr,
+			json:   jsonOut,
+			actor:  "tokenctl:test",
+		}
+		err := c.run(args)
+		if err != nil {
+			t.Fatalf("unexpected %s: %v", args[0], err)
+		}
+		return stdout.String()
+	}
+
+	out := run(mgr, false, "list")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "UID") {
+		t.Fatalf("unexpected list: %s", out)
+	}
+	var entries []entry
+	json.Unmarshal([]byte(run(mgr, true, "list")), &entries)
+	if len(entries) != 3 || entries[2].Token != tk3.Token || entries[0].TTL == "none" {
+		t.Fatalf("unexpected list of json: %+v", entries)
+	}
+	var users []struct {
+		UID    string
+		Tokens int
+	}
+	json.Unmarshal([]byte(run(mgr, true, "users")), &users)
+	if len(users) != 2 || users[0].Tokens != 2 || users[1].Tokens != 1 {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+	var shown struct {
+		UID     string
+		Payload tokentest.Token
+	}
+	json.Unmarshal([]byte(run(mgr, true, "show", tk1.Token)), &shown)
+	if shown.UID != "1" || shown.Payload != *tk1 {
+		t.Fatalf("unexpected show: %+v", shown)
+	}
+	if out := run(mgr, false, "show", tk1.Token); !strings.Contains(out, `"Name": "hello"`) {
+		t.Fatalf("unexpected show of text: %s", out)
+	}
+	ttl, err := time.ParseDuration(strings.TrimSpace(run(mgr, false, "ttl", tk1.Token)))
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("unexpected ttl: %s, %v", ttl, err)
+	}
+
+	// snapshot is taken before revoke
+	name := filepath.Join(t.TempDir(), "tokens.json")
+	run(mgr, false, "export", name)
+	out = run(restored, false, "import", name)
+	if out != "imported 3 tokens\n" {
+		t.Fatalf("unexpected import: %s", out)
+	}
+	json.Unmarshal([]byte(run(restored, true, "list")), &entries)
+	if len(entries) != 3 {
+		t.Fatalf("unexpected list after import: %+v", entries)
+	}
+
+	out = run(mgr, false, "revoke", tk1.Token)
+	if out != "revoked token "+tk1.Token+" of user 1\n" {
+		t.Fatalf("unexpected revoke: %s", out)
+	}
+	out = run(mgr, false, "revoke", "-uid", "2")
+	if out != "revoked all tokens of user 2\n" {
+		t.Fatalf("unexpected revoke of uid: %s", out)
+	}
+	json.Unmarshal([]byte(run(mgr, true, "list")), &entries)
+	if len(entries) != 1 || entries[0].Token != tk2.Token {
+		t.Fatalf("unexpected list after revoke: %+v", entries)
+	}
+	out = run(mgr, false, "purge")
+	if !strings.HasPrefix(out, "purged ") {
+		t.Fatalf("unexpected purge: %s", out)
+	}
+
+	c := &cli{st: mgr, stdout: &bytes.Buffer{}, stderr: &bytes.Buffer{}}
+	if err := c.run([]string{"unknown"}); err != errUsage {
+		t.Fatalf("unexpected unknown command: %v", err)
+	}
+	if err := c.run([]string{"revoke"}); err == nil {
+		t.Fatal("revoke without token is accepted")
+	}
+	if err := c.run([]string{"show", tk1.Token}); err != token.ErrNotfound {
+		t.Fatalf("unexpected show of revoked token: %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	mgr := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer mgr.Close()
+	restored := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer restored.Close()
+	testCLI(t, mgr, restored)
+}
+
+func TestRedis(t *testing.T) {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	mgr := redis.NewManager(redis.RedisConf{
+		Addrs:  []string{srv.Addr()},
+		Prefix: "app",
+	}, time.Hour, token.WithoutJanitor())
+	defer mgr.Close()
+	restored := redis.NewManager(redis.RedisConf{
+		Addrs:  []string{srv.Addr()},
+		Prefix: "restored",
+	}, time.Hour, token.WithoutJanitor())
+	defer restored.Close()
+	testCLI(t, mgr, restored)
+}
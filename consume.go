@@ -0,0 +1,17 @@
+package token
+
+import "errors"
+
+// ErrPurpose token is saved for another purpose
+var ErrPurpose = errors.New("token purpose mismatch")
+
+// OneTimeManager manager of one-time-use tokens such as password reset
+// links, implemented by every backend. The purpose is saved by SaveSession
+// in Meta.Purpose.
+type OneTimeManager interface {
+	SessionManager
+	// VerifyAndConsume verify token and delete it atomically, so only one of
+	// concurrent callers succeeds. ErrPurpose is returned and the token is
+	// kept when purpose does not match the saved one.
+	VerifyAndConsume(tk Token, purpose string) (bool, error)
+}
@@ -0,0 +1,329 @@
+package dpop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/binding"
+)
+
+const (
+	// DefaultMaxAge default age of proof accepted by iat claim
+	DefaultMaxAge = time.Minute
+	// DefaultLeeway default clock skew allowed between client and server
+	DefaultLeeway = 5 * time.Second
+)
+
+// DefaultAlgs default accepted signing algorithms
+var DefaultAlgs = []string{"ES256", "ES384", "ES512", "RS256", "PS256", "EdDSA"}
+
+// ProofError proof is malformed, expired, replayed or does not match the
+// request
+type ProofError struct {
+	Reason string
+}
+
+func (e *ProofError) Error() string {
+	return "dpop: invalid proof: " + e.Reason
+}
+
+func invalid(reason string) error {
+	return &ProofError{Reason: reason}
+}
+
+// Config verifier config
+type Config struct {
+	// Algs accepted signing algorithms, default is DefaultAlgs
+	Algs []string
+	// MaxAge proofs issued before MaxAge are rejected
+	MaxAge time.Duration
+	// Leeway clock skew allowed between client and server
+	Leeway time.Duration
+	// Prefix prefix of keys in kv, default is "dpop"
+	Prefix string
+	// Clock time source, default is token.SystemClock
+	Clock token.Clock
+}
+
+// Proof verified DPoP proof, see RFC 9449
+type Proof struct {
+	JWK JWK
+	// JKT thumbprint of JWK
+	JKT      string
+	ID       string
+	Method   string
+	URL      string
+	IssuedAt time.Time
+	// ATH hash of access token, empty for token requests
+	ATH string
+}
+
+// Context returns binding context of proof for binding.Manager created
+// with Binder
+func (p *Proof) Context() binding.Context {
+	return binding.Context{Value: p.JKT}
+}
+
+// Verifier DPoP proof verifier, used jti are kept in kv to detect replay
+// across instances sharing the backend
+type Verifier struct {
+	kv  token.KV
+	cfg Config
+}
+
+// New new verifier, kv is usually the KV of the token backend
+func New(kv token.KV, cfg Config) *Verifier {
+	if len(cfg.Algs) == 0 {
+		cfg.Algs = DefaultAlgs
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+	if cfg.Leeway <= 0 {
+		cfg.Leeway = DefaultLeeway
+	}
+	if len(cfg.Prefix) == 0 {
+		cfg.Prefix = "dpop"
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = token.SystemClock
+	}
+	return &Verifier{kv: kv, cfg: cfg}
+}
+
+type header struct {
+	Typ string `json:"typ"`
+	Alg string `json:"alg"`
+	JWK *JWK   `json:"jwk"`
+}
+
+type claims struct {
+	JTI string      `json:"jti"`
+	HTM string      `json:"htm"`
+	HTU string      `json:"htu"`
+	IAT json.Number `json:"iat"`
+	ATH string      `json:"ath"`
+}
+
+func decodePart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Verify verify proof presented with request of method and uri, the
+// accessToken is checked against ath claim and it is empty for requests to
+// token endpoint, returns *ProofError when the proof is not acceptable
+func (v *Verifier) Verify(proof, method, uri, accessToken string) (*Proof, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, invalid("malformed jwt")
+	}
+	var hdr header
+	if err := decodePart(parts[0], &hdr); err != nil {
+		return nil, invalid("malformed header")
+	}
+	if hdr.Typ != "dpop+jwt" {
+		return nil, invalid("unexpected typ")
+	}
+	if !v.accept(hdr.Alg) {
+		return nil, invalid("unsupported alg")
+	}
+	if hdr.JWK == nil {
+		return nil, invalid("missing jwk")
+	}
+	key, err := hdr.JWK.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+	if !verifySignature(hdr.Alg, key, parts[0]+"."+parts[1], sig) {
+		return nil, invalid("signature mismatch")
+	}
+
+	var c claims
+	if err := decodePart(parts[1], &c); err != nil {
+		return nil, invalid("malformed claims")
+	}
+	if len(c.JTI) == 0 {
+		return nil, invalid("missing jti")
+	}
+	if c.HTM != method {
+		return nil, invalid("htm mismatch")
+	}
+	if !sameURL(c.HTU, uri) {
+		return nil, invalid("htu mismatch")
+	}
+	iat, err := c.IAT.Int64()
+	if err != nil {
+		return nil, invalid("malformed iat")
+	}
+	issued := time.Unix(iat, 0)
+	now := v.cfg.Clock.Now()
+	if issued.After(now.Add(v.cfg.Leeway)) {
+		return nil, invalid("iat is in the future")
+	}
+	if now.Sub(issued) > v.cfg.MaxAge+v.cfg.Leeway {
+		return nil, invalid("proof is expired")
+	}
+	if len(accessToken) > 0 {
+		sum := sha256.Sum256([]byte(accessToken))
+		if c.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return nil, invalid("ath mismatch")
+		}
+	}
+
+	ret := &Proof{
+		JWK:      *hdr.JWK,
+		JKT:      hdr.JWK.Thumbprint(),
+		ID:       c.JTI,
+		Method:   c.HTM,
+		URL:      c.HTU,
+		IssuedAt: issued,
+		ATH:      c.ATH,
+	}
+	// proofs are acceptable until iat + MaxAge + Leeway and iat may be
+	// Leeway ahead of now
+	ok, err := v.kv.SetNX(v.jtiKey(ret), nil, v.cfg.MaxAge+2*v.cfg.Leeway)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, invalid("jti has been used")
+	}
+	return ret, nil
+}
+
+func (v *Verifier) accept(alg string) bool {
+	for _, a := range v.cfg.Algs {
+		if a == alg && alg != "none" {
+			return true
+		}
+	}
+	return false
+}
+
+// jtiKey jti is scoped by key and hashed to bound the key length
+func (v *Verifier) jtiKey(p *Proof) string {
+	sum := sha256.Sum256([]byte(p.JKT + ":" + p.ID))
+	return v.cfg.Prefix + ":jti:" + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// hashes hash and ecdsa curve of algorithms
+var hashes = map[string]struct {
+	hash  crypto.Hash
+	curve string
+}{
+	"ES256": {crypto.SHA256, "P-256"},
+	"ES384": {crypto.SHA384, "P-384"},
+	"ES512": {crypto.SHA512, "P-521"},
+	"RS256": {crypto.SHA256, ""},
+	"RS384": {crypto.SHA384, ""},
+	"RS512": {crypto.SHA512, ""},
+	"PS256": {crypto.SHA256, ""},
+	"PS384": {crypto.SHA384, ""},
+	"PS512": {crypto.SHA512, ""},
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) bool {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, []byte(signed), sig)
+	}
+	h, ok := hashes[alg]
+	if !ok {
+		return false
+	}
+	hash := h.hash.New()
+	hash.Write([]byte(signed))
+	digest := hash.Sum(nil)
+	switch alg[:2] {
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().Name != h.curve {
+			return false
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, h.hash, digest, sig) == nil
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(pub, h.hash, digest, sig, &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+		}) == nil
+	}
+	return false
+}
+
+// sameURL compare htu with request uri without query and fragment, scheme
+// and host are case insensitive and default ports are ignored
+func sameURL(htu, uri string) bool {
+	a, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	b, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return normalize(a) == normalize(b)
+}
+
+func normalize(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if (scheme == "https" && strings.HasSuffix(host, ":443")) ||
+		(scheme == "http" && strings.HasSuffix(host, ":80")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	path := u.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	return scheme + "://" + host + path
+}
+
+// bindingPrefix prefix of binding of tokens bound to key thumbprint
+const bindingPrefix = "jkt:"
+
+// Binder binding.Binder which binds tokens to the key thumbprint passed as
+// value of context, see Proof.Context
+func Binder() binding.Binder {
+	return binding.BinderFunc(func(ctx binding.Context) (string, error) {
+		if len(ctx.Value) == 0 {
+			return "", binding.ErrNoContext
+		}
+		return bindingPrefix + ctx.Value, nil
+	})
+}
+
+// JKT returns key thumbprint the session is bound to, it is the cnf.jkt
+// confirmation of the token and empty when the token is not bound to a key
+func JKT(meta token.Meta) string {
+	if !strings.HasPrefix(meta.Binding, bindingPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(meta.Binding, bindingPrefix)
+}
@@ -0,0 +1,244 @@
+package dpop
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/binding"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/httpauth"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+type signer struct {
+	key *ecdsa.PrivateKey
+	jwk JWK
+}
+
+func newSigner(t *testing.T) *signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected generate key: %v", err)
+	}
+	return &signer{key: key, jwk: JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}
+}
+
+func encodePart(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (s *signer) proof(t *testing.T, typ, method, uri string, iat time.Time, accessToken string) string {
+	claims := map[string]interface{}{
+		"jti": fmt.Sprintf("%d", rand.Int()),
+		"htm": method,
+		"htu": uri,
+		"iat": iat.Unix(),
+	}
+	if len(accessToken) > 0 {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	signed := encodePart(map[string]interface{}{
+		"typ": typ,
+		"alg": "ES256",
+		"jwk": s.jwk,
+	}) + "." + encodePart(claims)
+	sum := sha256.Sum256([]byte(signed))
+	r, ss, err := ecdsa.Sign(crand.Reader, s.key, sum[:])
+	if err != nil {
+		t.Fatalf("unexpected sign: %v", err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestThumbprint(t *testing.T) {
+	// RFC 7638 section 3.1
+	k := JWK{
+		Kty: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECP" +
+			"ebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY" +
+			"368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0f" +
+			"M4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E: "AQAB",
+	}
+	if tp := k.Thumbprint(); tp != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Fatalf("unexpected thumbprint: %s", tp)
+	}
+	if _, err := k.PublicKey(); err != nil {
+		t.Fatalf("unexpected public key: %v", err)
+	}
+}
+
+func testVerify(t *testing.T, kv token.KV, clk *tokentest.Clock) {
+	v := New(kv, Config{Clock: clk})
+	s := newSigner(t)
+	uri := "https://api.example.com/resource"
+
+	p, err := v.Verify(s.proof(t, "dpop+jwt", "GET", uri+"?q=1", clk.Now(), "at"),
+		"GET", "https://API.example.com:443/resource", "at")
+	if err != nil {
+		t.Fatalf("unexpected verify: %v", err)
+	}
+	if p.JKT != s.jwk.Thumbprint() || p.Method != "GET" {
+		t.Fatalf("unexpected proof: %+v", p)
+	}
+
+	proof := s.proof(t, "dpop+jwt", "POST", uri, clk.Now(), "")
+	_, err = v.Verify(proof, "POST", uri, "")
+	if err != nil {
+		t.Fatalf("unexpected verify: %v", err)
+	}
+	_, err = v.Verify(proof, "POST", uri, "")
+	if e, ok := err.(*ProofError); !ok || e.Reason != "jti has been used" {
+		t.Fatalf("unexpected verify of replayed proof: %v", err)
+	}
+
+	cases := []struct {
+		proof  string
+		method string
+		uri    string
+		at     string
+		reason string
+	}{
+		{s.proof(t, "jwt", "GET", uri, clk.Now(), ""), "GET", uri, "", "unexpected typ"},
+		{s.proof(t, "dpop+jwt", "GET", uri, clk.Now(), ""), "POST", uri, "", "htm mismatch"},
+		{s.proof(t, "dpop+jwt", "GET", uri, clk.Now(), ""), "GET", uri + "/other", "", "htu mismatch"},
+		{s.proof(t, "dpop+jwt", "GET", uri, clk.Now().Add(-2*time.Minute), ""), "GET", uri, "", "proof is expired"},
+		{s.proof(t, "dpop+jwt", "GET", uri, clk.Now().Add(time.Minute), ""), "GET", uri, "", "iat is in the future"},
+		{s.proof(t, "dpop+jwt", "GET", uri, clk.Now(), "at"), "GET", uri, "other", "ath mismatch"},
+		{s.proof(t, "dpop+jwt", "GET", uri, clk.Now(), "")[:10], "GET", uri, "", "malformed jwt"},
+		{s.proof(t, "dpop+jwt", "GET", uri, clk.Now(), "") + "A", "GET", uri, "", "signature mismatch"},
+	}
+	for _, c := range cases {
+		_, err := v.Verify(c.proof, c.method, c.uri, c.at)
+		if e, ok := err.(*ProofError); !ok || e.Reason != c.reason {
+			t.Fatalf("unexpected verify, want %s: %v", c.reason, err)
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	mgr := file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk))
+	testVerify(t, mgr.KV(), clk)
+}
+
+func TestVerifyRedis(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	srv.SetClock(clk)
+	mgr := redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, time.Hour, token.WithClock(clk))
+	testVerify(t, mgr.KV(), clk)
+}
+
+func TestMiddleware(t *testing.T) {
+	mgr := file.NewManager(t.TempDir(), time.Hour)
+	v := New(mgr.KV(), Config{})
+	s := newSigner(t)
+
+	bound := tokentest.NewToken("1", "bound")
+	err := binding.New(mgr, Binder()).Save(bound, binding.Context{Value: s.jwk.Thumbprint()}, token.Meta{})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	sess, err := mgr.Session(bound.Token)
+	if err != nil || JKT(sess.Meta) != s.jwk.Thumbprint() {
+		t.Fatalf("unexpected session: %+v %v", sess, err)
+	}
+	unbound := tokentest.NewToken("2", "unbound")
+	err = mgr.Save(unbound)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	ipBound := tokentest.NewToken("3", "ip")
+	err = binding.New(mgr, binding.IP(24, 64)).Save(ipBound,
+		binding.Context{IP: net.ParseIP("192.0.2.1")}, token.Meta{})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+
+	h := Middleware(AuthConfig{
+		Verifier: v,
+		Mgr:      mgr,
+		New: func(raw string) token.Token {
+			return &tokentest.Token{Token: raw}
+		},
+		Bearer: true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tk, _ := httpauth.FromContext(r.Context())
+		fmt.Fprint(w, tk.GetUID())
+	}))
+	do := func(scheme, at, proof string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "https://api.example.com/resource", nil)
+		r.Header.Set("Authorization", scheme+" "+at)
+		if len(proof) > 0 {
+			r.Header.Set("DPoP", proof)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	uri := "https://api.example.com/resource"
+
+	w := do("DPoP", bound.Token, s.proof(t, "dpop+jwt", "GET", uri, time.Now(), bound.Token))
+	if w.Code != http.StatusOK || w.Body.String() != "1" {
+		t.Fatalf("unexpected response of bound token: %d %s", w.Code, w.Body.String())
+	}
+	w = do("Bearer", bound.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected response of bound token as bearer: %d", w.Code)
+	}
+	other := newSigner(t)
+	w = do("DPoP", bound.Token, other.proof(t, "dpop+jwt", "GET", uri, time.Now(), bound.Token))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected response of other key: %d", w.Code)
+	}
+	w = do("DPoP", bound.Token, "")
+	want := `DPoP error="invalid_dpop_proof", error_description="exactly one proof is required"`
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != want {
+		t.Fatalf("unexpected response without proof: %d %v", w.Code, w.Header())
+	}
+	w = do("Bearer", unbound.Token, "")
+	if w.Code != http.StatusOK || w.Body.String() != "2" {
+		t.Fatalf("unexpected response of unbound token: %d %s", w.Code, w.Body.String())
+	}
+	w = do("Bearer", ipBound.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected response of token bound to ip as bearer: %d", w.Code)
+	}
+	w = do("DPoP", unbound.Token, s.proof(t, "dpop+jwt", "GET", uri, time.Now(), unbound.Token))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected response of unbound token with proof: %d", w.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package dpop
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/httpauth"
+)
+
+// ErrMismatch token is not bound to the key of proof, or it is bound to any
+// client context while presented by Bearer scheme
+var ErrMismatch = &httpauth.Error{
+	Status:      http.StatusUnauthorized,
+	Code:        "invalid_token",
+	Description: "the access token is not bound to the proof key",
+}
+
+// AuthConfig middleware config
+type AuthConfig struct {
+	// Verifier verifier of proofs
+	Verifier *Verifier
+	// Mgr manager to verify the token, tokens are bound by binding.Manager
+	// with Binder
+	Mgr token.SessionManager
+	// New create an empty token by the raw string for verify
+	New func(tk string) token.Token
+	// URL returns url of request to match htu claim, default is built from
+	// Host and TLS of request so requests through proxies should set it
+	URL func(r *http.Request) string
+	// Bearer accept tokens not bound at all by Bearer scheme, tokens bound by
+	// other binders such as binding.IP are rejected because the binding can
+	// not be checked here
+	Bearer bool
+	// Realm realm in WWW-Authenticate challenge
+	Realm string
+}
+
+// Auth DPoP token authenticator
+type Auth struct {
+	cfg AuthConfig
+}
+
+// NewAuth new authenticator
+func NewAuth(cfg AuthConfig) *Auth {
+	if cfg.URL == nil {
+		cfg.URL = requestURL
+	}
+	return &Auth{cfg: cfg}
+}
+
+// Middleware net/http middleware, verified token is stored in request context
+// and can be taken by httpauth.FromContext
+func Middleware(cfg AuthConfig) func(http.Handler) http.Handler {
+	return NewAuth(cfg).Wrap
+}
+
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.EscapedPath()
+}
+
+// Wrap wrap handler, requests without valid token and proof are rejected
+func (a *Auth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tk, err := a.Authenticate(r)
+		if err != nil {
+			if e, ok := err.(*httpauth.Error); ok {
+				a.writeError(w, e)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(httpauth.NewContext(r.Context(), tk)))
+	})
+}
+
+func (a *Auth) writeError(w http.ResponseWriter, err *httpauth.Error) {
+	w.Header().Set("WWW-Authenticate", httpauth.Challenge("DPoP", a.cfg.Realm, err))
+	if a.cfg.Bearer {
+		w.Header().Add("WWW-Authenticate", httpauth.Challenge("Bearer", a.cfg.Realm, err))
+	}
+	w.WriteHeader(err.Status)
+}
+
+// Authenticate extract and verify token and its proof from request, returns
+// *httpauth.Error on authentication failure or error of backend otherwise
+func (a *Auth) Authenticate(r *http.Request) (token.Token, error) {
+	scheme, raw := httpauth.ParseAuthorization(r.Header.Get("Authorization"))
+	switch {
+	case strings.EqualFold(scheme, "DPoP"):
+	case strings.EqualFold(scheme, "Bearer") && a.cfg.Bearer:
+		if len(r.Header.Values("DPoP")) > 0 {
+			return nil, httpauth.ErrInvalidRequest
+		}
+		return a.verify(raw, "")
+	default:
+		return nil, httpauth.ErrMissing
+	}
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return nil, &httpauth.Error{
+			Status:      http.StatusUnauthorized,
+			Code:        "invalid_dpop_proof",
+			Description: "exactly one proof is required",
+		}
+	}
+	p, err := a.cfg.Verifier.Verify(proofs[0], r.Method, a.cfg.URL(r), raw)
+	if e, ok := err.(*ProofError); ok {
+		return nil, &httpauth.Error{
+			Status:      http.StatusUnauthorized,
+			Code:        "invalid_dpop_proof",
+			Description: e.Reason,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.verify(raw, p.JKT)
+}
+
+// verify verify token bound to jkt, empty jkt requires token without any
+// binding
+func (a *Auth) verify(raw, jkt string) (token.Token, error) {
+	if len(raw) == 0 || strings.ContainsAny(raw, " \t") {
+		return nil, httpauth.ErrInvalidRequest
+	}
+	s, err := a.cfg.Mgr.Session(raw)
+	if err == token.ErrNotfound {
+		return nil, httpauth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(jkt) == 0 && len(s.Meta.Binding) > 0 || JKT(s.Meta) != jkt {
+		return nil, ErrMismatch
+	}
+	tk := a.cfg.New(raw)
+	ok, err := a.cfg.Mgr.Verify(tk)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, httpauth.ErrInvalidToken
+	}
+	return tk, nil
+}
@@ -0,0 +1,116 @@
+package dpop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+)
+
+// JWK public json web key of proof header, see RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	// D private key must not be present in proof
+	D string `json:"d,omitempty"`
+}
+
+func decodeInt(str string) (*big.Int, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	return new(big.Int).SetBytes(data), true
+}
+
+func curve(crv string) elliptic.Curve {
+	switch crv {
+	case "P-256":
+		return elliptic.P256()
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// PublicKey returns *ecdsa.PublicKey, *rsa.PublicKey or ed25519.PublicKey
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	if len(k.D) > 0 {
+		return nil, invalid("jwk contains private key")
+	}
+	switch k.Kty {
+	case "EC":
+		c := curve(k.Crv)
+		if c == nil {
+			return nil, invalid("unsupported curve " + k.Crv)
+		}
+		x, ok1 := decodeInt(k.X)
+		y, ok2 := decodeInt(k.Y)
+		if !ok1 || !ok2 || !c.IsOnCurve(x, y) {
+			return nil, invalid("malformed ec key")
+		}
+		return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, nil
+	case "RSA":
+		n, ok1 := decodeInt(k.N)
+		e, ok2 := decodeInt(k.E)
+		if !ok1 || !ok2 || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, invalid("malformed rsa key")
+		}
+		if n.BitLen() < 2048 {
+			return nil, invalid("rsa key is too small")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, invalid("unsupported curve " + k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, invalid("malformed ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, invalid("unsupported key type " + k.Kty)
+}
+
+// Thumbprint returns base64url encoded sha256 thumbprint of key, it is the
+// jkt confirmation of bound tokens, see RFC 7638
+func (k JWK) Thumbprint() string {
+	// required members only in lexicographic order
+	var members interface{}
+	switch k.Kty {
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
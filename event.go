@@ -0,0 +1,56 @@
+package token
+
+import "time"
+
+// Op token operation
+type Op string
+
+const (
+	// OpSave token saved
+	OpSave Op = "save"
+	// OpVerify token verified, Event.OK reports the result
+	OpVerify Op = "verify"
+	// OpRevoke token revoked
+	OpRevoke Op = "revoke"
+	// OpExpire expired token removed by janitor or purge
+	OpExpire Op = "expire"
+	// OpEvict token revoked by session limit on Save of another token
+	OpEvict Op = "evict"
+	// OpConsume token verified and deleted by VerifyAndConsume, Event.OK
+	// reports the result
+	OpConsume Op = "consume"
+)
+
+// Event token lifecycle event
+type Event struct {
+	Op   Op
+	Time time.Time
+	// Actor who triggered the event, empty when unknown
+	Actor string
+	UID   string
+	// Token raw token, observers must never persist it
+	Token string
+	OK    bool
+	Err   error
+}
+
+// Observer receive token lifecycle events, it is called synchronously by
+// the manager
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc adapter to use function as observer
+type ObserverFunc func(Event)
+
+// Observe call fn
+func (fn ObserverFunc) Observe(e Event) {
+	fn(e)
+}
+
+// Notify deliver event to every observer
+func Notify(observers []Observer, e Event) {
+	for _, o := range observers {
+		o.Observe(e)
+	}
+}
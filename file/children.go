@@ -0,0 +1,121 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// childrenName returns index file of children of tk, one token per line
+func (m *Mgr) childrenName(tk string) string {
+	return path.Join(m.cacheDir, tk+".children")
+}
+
+// alive returns whether token file of tk exists and is not expired
+func (m *Mgr) alive(tk string) bool {
+	files, _ := filepath.Glob(path.Join(m.cacheDir, fmt.Sprintf("*_%s.token", tk)))
+	if len(files) == 0 {
+		return false
+	}
+	_, err := m.stat(files[0])
+	return err == nil
+}
+
+// link append child to index of parent, ErrNotfound is returned when the
+// parent does not exist. The parent is checked with the lock of index, so a
+// concurrent revoke of parent either sees the child or rejects it.
+func (m *Mgr) link(parent, child string) error {
+	name := m.childrenName(parent)
+	unlock, err := lock(name + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !m.alive(parent) {
+		return ErrNotfound
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(child + "\n")
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// unlink remove index of tk, returns children recorded in it
+func (m *Mgr) unlink(tk string) ([]string, error) {
+	name := m.childrenName(tk)
+	unlock, err := lock(name + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	children, err := readChildren(name)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return children, err
+}
+
+func readChildren(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// revokeChildren revoke every descendant of tk, the token file of tk must
+// be removed before
+func (m *Mgr) revokeChildren(actor, tk string) {
+	children, _ := m.unlink(tk)
+	for _, child := range children {
+		m.RevokeBy(actor, "", child)
+	}
+}
+
+// Children returns tokens saved with tk as parent which are not revoked or
+// expired, ordered by token
+func (m *Mgr) Children(tk string) ([]string, error) {
+	children, err := readChildren(m.childrenName(tk))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+	ret := []string{}
+	for i, child := range children {
+		if i > 0 && child == children[i-1] {
+			continue
+		}
+		if m.alive(child) {
+			ret = append(ret, child)
+		}
+	}
+	return ret, nil
+}
+
+// purgeChildren revoke children of tokens which are expired or removed, so
+// children never outlive their parent
+func (m *Mgr) purgeChildren() {
+	files, _ := filepath.Glob(path.Join(m.cacheDir, "*.children"))
+	for _, file := range files {
+		tk := strings.TrimSuffix(filepath.Base(file), ".children")
+		if !m.alive(tk) {
+			m.revokeChildren("", tk)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/internal/telemetry"
+)
+
+// VerifyAndConsume verify token and delete it with its children, the token
+// is deleted even when Token.Verify rejects its payload
+func (m *Mgr) VerifyAndConsume(tk token.Token, purpose string) (bool, error) {
+	op := m.tel.Start(telemetry.OpConsume)
+	ok, gone, err := m.consume(tk, purpose)
+	op.End(ok, err)
+	m.emit(token.Event{
+		Op:    token.OpConsume,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    ok,
+		Err:   err,
+	})
+	if gone {
+		m.revokeChildren(tk.GetUID(), tk.GetTK())
+	}
+	return ok, err
+}
+
+// consume rename the token file before reading it, rename is atomic so only
+// one of concurrent consumers gets the file, gone reports whether the file
+// is taken by this call
+func (m *Mgr) consume(tk token.Token, purpose string) (bool, bool, error) {
+	files, _ := filepath.Glob(path.Join(m.cacheDir, fmt.Sprintf("*_%s.token", tk.GetTK())))
+	if len(files) == 0 {
+		return false, false, nil
+	}
+	if _, err := m.stat(files[0]); err == ErrNotfound {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	meta, err := readMeta(files[0])
+	if err != nil {
+		return false, false, err
+	}
+	if meta.Purpose != purpose {
+		return false, false, token.ErrPurpose
+	}
+	consumed := strings.TrimSuffix(files[0], ".token") + ".consumed"
+	err = os.Rename(files[0], consumed)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	defer func() {
+		os.Remove(consumed)
+		os.Remove(seenName(files[0]))
+		os.Remove(metaName(files[0]))
+		os.Remove(keepName(files[0]))
+		os.Remove(expireName(files[0]))
+	}()
+	fi, err := os.Stat(consumed)
+	if err != nil {
+		return false, true, err
+	}
+	if m.expired(files[0], fi) {
+		return false, true, nil
+	}
+	data, err := ioutil.ReadFile(consumed)
+	if err != nil {
+		return false, true, err
+	}
+	ok, err := tk.Verify(data)
+	return ok, true, err
+}
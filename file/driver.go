@@ -0,0 +1,51 @@
+package file
+
+import (
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+func init() {
+	token.Register("file", token.DriverFunc(open))
+}
+
+// open open manager of dsn like "file:///var/lib/tokens?ttl=30m", the
+// directory is created when missing and ttl defaults to DefaultTTL
+func open(dsn *url.URL, opts ...token.Option) (token.Handle, error) {
+	dir, ttl, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return NewManager(dir, ttl, opts...), nil
+}
+
+func parseDSN(dsn *url.URL) (string, time.Duration, error) {
+	if len(dsn.Opaque) > 0 {
+		return "", 0, token.InvalidDSN(dsn, "path must be absolute")
+	}
+	if dsn.User != nil {
+		return "", 0, token.InvalidDSN(dsn, "unexpected user")
+	}
+	if len(dsn.Host) > 0 && dsn.Host != "localhost" {
+		return "", 0, token.InvalidDSN(dsn, "unexpected host %s", dsn.Host)
+	}
+	if len(dsn.Path) == 0 {
+		return "", 0, token.InvalidDSN(dsn, "missing path")
+	}
+	q, err := token.DSNQuery(dsn, "ttl")
+	if err != nil {
+		return "", 0, err
+	}
+	ttl, err := token.DSNDuration(dsn, q, "ttl", DefaultTTL)
+	if err != nil {
+		return "", 0, err
+	}
+	return dsn.Path, ttl, nil
+}
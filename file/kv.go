@@ -0,0 +1,186 @@
+package file
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+type kv struct {
+	m   *Mgr
+	dir string
+}
+
+// KV returns key value storage in the kv sub directory, every key is stored
+// in its own file
+func (m *Mgr) KV() token.KV {
+	dir := path.Join(m.cacheDir, "kv")
+	os.MkdirAll(dir, 0755)
+	return kv{m: m, dir: dir}
+}
+
+func (s kv) file(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return path.Join(s.dir, hex.EncodeToString(sum[:])+".kv")
+}
+
+// lock lock file of key, the lock file is named after the kv file so that
+// purgeKV never takes it for a value
+func (s kv) lock(file string) (func(), error) {
+	return lock(file + ".lock")
+}
+
+// read returns value and expire time, expired keys are treated as missing
+func (s kv) read(file string) ([]byte, int64, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotfound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("invalid kv file: %s", file)
+	}
+	expire := int64(binary.BigEndian.Uint64(data))
+	if expire != 0 && s.m.clock.Now().UnixNano() >= expire {
+		return nil, 0, ErrNotfound
+	}
+	return data[8:], expire, nil
+}
+
+func (s kv) write(file string, value []byte, ttl time.Duration) error {
+	var expire int64
+	if ttl > 0 {
+		expire = s.m.clock.Now().Add(ttl).UnixNano()
+	}
+	return s.writeAt(file, value, expire)
+}
+
+// writeAt write by renaming temporary file, so readers never see partial data
+func (s kv) writeAt(file string, value []byte, expire int64) error {
+	data := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(expire))
+	data = append(data, value...)
+	tmp := file + "." + strconv.FormatUint(rand.Uint64(), 16) + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, file)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (s kv) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	file := s.file(key)
+	unlock, err := s.lock(file)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	_, _, err = s.read(file)
+	if err == nil {
+		return false, nil
+	}
+	if err != ErrNotfound {
+		return false, err
+	}
+	err = s.write(file, value, ttl)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s kv) Set(key string, value []byte, ttl time.Duration) error {
+	file := s.file(key)
+	unlock, err := s.lock(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.write(file, value, ttl)
+}
+
+func (s kv) Load(key string) ([]byte, time.Duration, error) {
+	value, expire, err := s.read(s.file(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	var ttl time.Duration
+	if expire != 0 {
+		ttl = time.Unix(0, expire).Sub(s.m.clock.Now())
+	}
+	return value, ttl, nil
+}
+
+func (s kv) Incr(key string, ttl time.Duration) (int64, error) {
+	file := s.file(key)
+	unlock, err := s.lock(file)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	value, expire, err := s.read(file)
+	if err == ErrNotfound {
+		return 1, s.write(file, []byte("1"), ttl)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %s is not an integer", key)
+	}
+	n++
+	return n, s.writeAt(file, []byte(strconv.FormatInt(n, 10)), expire)
+}
+
+func (s kv) Del(key string) error {
+	file := s.file(key)
+	unlock, err := s.lock(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// purgeKV remove expired kv files
+func (m *Mgr) purgeKV() {
+	s := kv{m: m, dir: path.Join(m.cacheDir, "kv")}
+	files, _ := filepath.Glob(path.Join(s.dir, "*.kv"))
+	for _, file := range files {
+		s.purge(file)
+	}
+}
+
+// purge remove kv file when it is expired
+func (s kv) purge(file string) {
+	unlock, err := s.lock(file)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	_, _, err = s.read(file)
+	if err == ErrNotfound {
+		os.Remove(file)
+	}
+}
@@ -0,0 +1,253 @@
+package file
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// parseName parse uid and token from file name
+func parseName(file string) (string, string, bool) {
+	name := strings.TrimSuffix(filepath.Base(file), ".token")
+	n := strings.Index(name, "_")
+	if n == -1 {
+		return "", "", false
+	}
+	return name[:n], name[n+1:], true
+}
+
+func (m *Mgr) entry(file string) (token.Entry, error) {
+	uid, tk, ok := parseName(file)
+	if !ok {
+		return token.Entry{}, ErrNotfound
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return token.Entry{}, err
+	}
+	if m.expired(file, fi) {
+		return token.Entry{}, ErrNotfound
+	}
+	var ttl time.Duration
+	if at := m.deadline(file, fi.ModTime()); !at.IsZero() {
+		ttl = at.Sub(m.clock.Now())
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return token.Entry{}, err
+	}
+	meta, err := readMeta(file)
+	if err != nil {
+		return token.Entry{}, err
+	}
+	return token.Entry{
+		UID:   uid,
+		Token: tk,
+		Data:  data,
+		TTL:   ttl,
+		Meta:  meta,
+	}, nil
+}
+
+// Walk walk all tokens which are not expired
+func (m *Mgr) Walk(fn func(token.Entry) error) error {
+	files, err := filepath.Glob(path.Join(m.cacheDir, "*.token"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		e, err := m.entry(file)
+		if err == ErrNotfound || os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup get raw entry by token
+func (m *Mgr) Lookup(tk string) (token.Entry, error) {
+	files, _ := filepath.Glob(path.Join(m.cacheDir, "*_"+tk+".token"))
+	if len(files) == 0 {
+		return token.Entry{}, ErrNotfound
+	}
+	e, err := m.entry(files[0])
+	if os.IsNotExist(err) {
+		return token.Entry{}, ErrNotfound
+	}
+	return e, err
+}
+
+// RevokeUID revoke all tokens of uid
+func (m *Mgr) RevokeUID(uid string) error {
+	return m.RevokeUIDBy("", uid)
+}
+
+// RevokeUIDBy revoke all tokens of uid, actor is reported to observers
+func (m *Mgr) RevokeUIDBy(actor, uid string) error {
+	files, err := filepath.Glob(path.Join(m.cacheDir, uid+"_*.token"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = remove(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, tk, _ := parseName(file)
+		m.emit(token.Event{
+			Op:    token.OpRevoke,
+			Actor: actor,
+			UID:   uid,
+			Token: tk,
+			OK:    true,
+		})
+		m.revokeChildren(actor, tk)
+	}
+	return nil
+}
+
+// Purge remove expired tokens and revoke their children, returns the
+// number of purged tokens
+func (m *Mgr) Purge() (int, error) {
+	files, err := filepath.Glob(path.Join(m.cacheDir, "*.token"))
+	if err != nil {
+		return 0, err
+	}
+	var cnt int
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if m.expired(file, fi) {
+			if remove(file) == nil {
+				cnt++
+				uid, tk, _ := parseName(file)
+				m.emit(token.Event{
+					Op:    token.OpExpire,
+					UID:   uid,
+					Token: tk,
+					OK:    true,
+				})
+				m.revokeChildren("", tk)
+			}
+		}
+	}
+	m.tel.Evicted(cnt)
+	return cnt, nil
+}
+
+// Restore restore raw entry with its metadata and remaining ttl, which is
+// kept like Expire. ErrNotfound is returned when the parent of entry does
+// not exist.
+func (m *Mgr) Restore(e token.Entry) error {
+	file := path.Join(m.cacheDir, e.UID+"_"+e.Token+".token")
+	err := writeMeta(file, e.Meta)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, e.Data, 0644)
+	if err != nil {
+		return err
+	}
+	os.Remove(seenName(file))
+	os.Remove(keepName(file))
+	now := m.clock.Now()
+	err = os.Chtimes(file, now, now)
+	if err == nil {
+		err = m.expire(file, e.TTL)
+	}
+	if err == nil && len(e.Meta.Parent) > 0 {
+		err = m.link(e.Meta.Parent, e.Token)
+	}
+	if err != nil {
+		remove(file)
+	}
+	return err
+}
+
+// Rewrite replace payload of token in place, the modify time is restored so
+// ttl and creation are kept, metadata and last seen time are untouched
+func (m *Mgr) Rewrite(tk string, data []byte) error {
+	files, _ := filepath.Glob(path.Join(m.cacheDir, "*_"+tk+".token"))
+	if len(files) == 0 {
+		return ErrNotfound
+	}
+	fi, err := os.Stat(files[0])
+	if os.IsNotExist(err) {
+		return ErrNotfound
+	}
+	if err != nil {
+		return err
+	}
+	if m.expired(files[0], fi) {
+		return ErrNotfound
+	}
+	err = ioutil.WriteFile(files[0], data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(files[0], fi.ModTime(), fi.ModTime())
+}
+
+// Expire set remaining ttl of token, zero ttl means the token never
+// expires. The expiry is kept by a .expire file, so creation is untouched.
+func (m *Mgr) Expire(tk string, ttl time.Duration) error {
+	files, _ := filepath.Glob(path.Join(m.cacheDir, "*_"+tk+".token"))
+	if len(files) == 0 {
+		return ErrNotfound
+	}
+	fi, err := os.Stat(files[0])
+	if os.IsNotExist(err) {
+		return ErrNotfound
+	}
+	if err != nil {
+		return err
+	}
+	if m.expired(files[0], fi) {
+		return ErrNotfound
+	}
+	return m.expire(files[0], ttl)
+}
+
+// expire keep remaining ttl of token file by its .expire file, zero ttl is
+// marked by a .keep file. The .expire file is renamed into place after its
+// modify time is set, so the janitor never sees it with a past deadline.
+func (m *Mgr) expire(file string, ttl time.Duration) error {
+	if ttl <= 0 {
+		os.Remove(expireName(file))
+		return ioutil.WriteFile(keepName(file), nil, 0644)
+	}
+	name := expireName(file)
+	tmp := name + "." + strconv.FormatUint(rand.Uint64(), 16) + ".tmp"
+	err := ioutil.WriteFile(tmp, nil, 0644)
+	if err != nil {
+		return err
+	}
+	at := m.clock.Now().Add(ttl)
+	err = os.Chtimes(tmp, at, at)
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	lockRetry   = time.Millisecond
+	lockTimeout = 10 * time.Second
+	lockStale   = 30 * time.Second
+)
+
+// errLockTimeout lock file is hold by others for too long
+var errLockTimeout = errors.New("lock timeout")
+
+// locks in-process mutexes by lock name, entries are removed when nobody
+// holds or waits for them so per-key locks do not grow without bound
+var locks = struct {
+	sync.Mutex
+	m map[string]*namedLock
+}{m: make(map[string]*namedLock)}
+
+type namedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func acquire(name string) *namedLock {
+	locks.Lock()
+	l := locks.m[name]
+	if l == nil {
+		l = new(namedLock)
+		locks.m[name] = l
+	}
+	l.refs++
+	locks.Unlock()
+	l.Lock()
+	return l
+}
+
+func release(name string, l *namedLock) {
+	l.Unlock()
+	locks.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(locks.m, name)
+	}
+	locks.Unlock()
+}
+
+// lock take exclusive lock by creating the lock file, it works across
+// processes sharing the directory, locks older than lockStale are treated as
+// left by crashed processes
+func lock(name string) (func(), error) {
+	mu := acquire(name)
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() {
+				os.Remove(name)
+				release(name, mu)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			release(name, mu)
+			return nil, err
+		}
+		fi, err := os.Stat(name)
+		if err == nil && time.Since(fi.ModTime()) > lockStale {
+			os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			release(name, mu)
+			return nil, errLockTimeout
+		}
+		time.Sleep(lockRetry)
+	}
+}
@@ -1,91 +1,294 @@
 package file
 
 import (
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lwch/token"
+	"github.com/lwch/token/internal/telemetry"
 )
 
+// ErrNotfound not found error
+var ErrNotfound = token.ErrNotfound
+
 // Mgr token manager
 type Mgr struct {
-	ttl      time.Duration
-	cacheDir string
+	ttl       time.Duration
+	cacheDir  string
+	clock     token.Clock
+	observers []token.Observer
+	tel       *telemetry.Instrument
+
+	maxSessions int
+	policy      token.SessionPolicy
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // DefaultTTL default ttl
 const DefaultTTL = time.Hour
 
-// NewManager new token manager
-func NewManager(dir string, ttl time.Duration) *Mgr {
+// NewManager new token manager, zero ttl means tokens never expire. A
+// janitor removes expired files every minute until Close unless
+// token.WithoutJanitor is given.
+func NewManager(dir string, ttl time.Duration, opts ...token.Option) *Mgr {
+	opt := token.NewOptions(opts...)
 	ret := new(Mgr)
 	ret.ttl = ttl
 	ret.cacheDir = dir
+	ret.clock = opt.Clock
+	ret.observers = opt.Observers
+	ret.maxSessions = opt.MaxSessions
+	ret.policy = opt.SessionPolicy
+	ret.tel = telemetry.New("file", "")
+	ret.tel.Active(ret.count)
+	ret.done = make(chan struct{})
 	os.MkdirAll(dir, 0755)
+	if opt.NoJanitor {
+		return ret
+	}
 	go func() {
 		for {
 			ret.clear()
-			time.Sleep(time.Minute)
+			select {
+			case <-ret.done:
+				return
+			case <-ret.clock.After(time.Minute):
+			}
 		}
 	}()
 	return ret
 }
 
+// Close stop janitor and reporting of active tokens, it returns
+// os.ErrClosed when the manager is closed already
+func (m *Mgr) Close() error {
+	err := os.ErrClosed
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.tel.Close()
+		err = nil
+	})
+	return err
+}
+
 func (m *Mgr) clear() {
-	files, _ := filepath.Glob(path.Join(m.cacheDir, "*.token"))
-	for _, file := range files {
-		fi, err := os.Stat(file)
-		if err != nil {
-			continue
-		}
-		if time.Since(fi.ModTime()) > m.ttl {
-			os.Remove(file)
-		}
+	m.Purge()
+	m.purgeKV()
+	m.purgeChildren()
+}
+
+// count returns number of token files, expired tokens are counted until the
+// janitor purges them
+func (m *Mgr) count() (int64, error) {
+	files, err := filepath.Glob(path.Join(m.cacheDir, "*.token"))
+	return int64(len(files)), err
+}
+
+func (m *Mgr) emit(e token.Event) {
+	if len(m.observers) == 0 {
+		return
 	}
+	e.Time = m.clock.Now()
+	token.Notify(m.observers, e)
+}
+
+// expired returns whether token file is past its deadline
+func (m *Mgr) expired(file string, fi os.FileInfo) bool {
+	at := m.deadline(file, fi.ModTime())
+	return !at.IsZero() && m.clock.Now().After(at)
+}
+
+// deadline returns time token file created at created expires at, zero
+// means never. It is the marker of Expire if any, or ttl after creation.
+func (m *Mgr) deadline(file string, created time.Time) time.Time {
+	if fi, err := os.Stat(expireName(file)); err == nil {
+		return fi.ModTime()
+	}
+	if m.ttl <= 0 || kept(file) {
+		return time.Time{}
+	}
+	return created.Add(m.ttl)
+}
+
+// kept returns whether token file never expires
+func kept(file string) bool {
+	_, err := os.Stat(keepName(file))
+	return err == nil
 }
 
 // Save save token
 func (m *Mgr) Save(tk token.Token) error {
+	return m.SaveSession(tk, token.Meta{})
+}
+
+// SaveSession save token with metadata
+func (m *Mgr) SaveSession(tk token.Token, meta token.Meta) error {
+	op := m.tel.Start(telemetry.OpSave)
+	err := m.save(tk, meta)
+	op.End(err == nil, err)
+	m.emit(token.Event{
+		Op:    token.OpSave,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    err == nil,
+		Err:   err,
+	})
+	return err
+}
+
+// save write token and link it to its parent, the token is removed again
+// when the parent does not exist
+func (m *Mgr) save(tk token.Token, meta token.Meta) error {
+	err := m.store(tk, meta)
+	if err != nil || len(meta.Parent) == 0 {
+		return err
+	}
+	err = m.link(meta.Parent, tk.GetTK())
+	if err != nil {
+		remove(path.Join(m.cacheDir, fmt.Sprintf("%s_%s.token", tk.GetUID(), tk.GetTK())))
+	}
+	return err
+}
+
+// store write token file, enforcing session limit when it is set
+func (m *Mgr) store(tk token.Token, meta token.Meta) error {
 	data, err := tk.Serialize()
 	if err != nil {
 		return err
 	}
+	if m.maxSessions <= 0 {
+		return m.write(tk, data, meta)
+	}
+	unlock, err := lock(lockName(m.cacheDir, tk.GetUID()))
+	if err != nil {
+		return err
+	}
+	evicted, err := m.limit(tk.GetUID(), tk.GetTK())
+	if err == nil {
+		err = m.write(tk, data, meta)
+	}
+	unlock()
+	for _, e := range evicted {
+		m.emit(e)
+		if e.OK {
+			m.revokeChildren(e.Actor, e.Token)
+		}
+	}
+	return err
+}
+
+func (m *Mgr) write(tk token.Token, data []byte, meta token.Meta) error {
 	dir := path.Join(m.cacheDir, fmt.Sprintf("%s_%s.token", tk.GetUID(), tk.GetTK()))
-	return ioutil.WriteFile(dir, []byte(data), 0644)
+	err := writeMeta(dir, meta)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(dir, []byte(data), 0644)
+	if err != nil {
+		return err
+	}
+	os.Remove(seenName(dir))
+	os.Remove(keepName(dir))
+	os.Remove(expireName(dir))
+	now := m.clock.Now()
+	return os.Chtimes(dir, now, now)
 }
 
 // Verify verify token
 func (m *Mgr) Verify(tk token.Token) (bool, error) {
+	op := m.tel.Start(telemetry.OpVerify)
+	ok, err := m.verify(tk)
+	op.End(ok, err)
+	m.emit(token.Event{
+		Op:    token.OpVerify,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    ok,
+		Err:   err,
+	})
+	return ok, err
+}
+
+func (m *Mgr) verify(tk token.Token) (bool, error) {
 	files, _ := filepath.Glob(path.Join(m.cacheDir, fmt.Sprintf("*_%s.token", tk.GetTK())))
 	if len(files) == 0 {
 		return false, nil
 	}
+	fi, err := os.Stat(files[0])
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if m.expired(files[0], fi) {
+		return false, nil
+	}
 	data, err := ioutil.ReadFile(files[0])
 	if err != nil {
 		return false, err
 	}
-	return tk.Verify(data)
+	ok, err := tk.Verify(data)
+	if ok {
+		m.touch(files[0])
+	}
+	return ok, err
 }
 
 // Revoke revoke token
 func (m *Mgr) Revoke(uid, tk string) {
+	m.RevokeBy("", uid, tk)
+}
+
+// RevokeBy revoke token, actor is reported to observers
+func (m *Mgr) RevokeBy(actor, uid, tk string) {
+	op := m.tel.Start(telemetry.OpRevoke)
+	var removed bool
+	var last error
 	files, _ := filepath.Glob(path.Join(m.cacheDir, fmt.Sprintf("*_%s.token", tk)))
 	for _, file := range files {
-		os.Remove(file)
+		err := remove(file)
+		if err == nil {
+			removed = true
+		} else {
+			last = err
+		}
+		owner, _, _ := parseName(file)
+		m.emit(token.Event{
+			Op:    token.OpRevoke,
+			Actor: actor,
+			UID:   owner,
+			Token: tk,
+			OK:    err == nil,
+			Err:   err,
+		})
 	}
+	op.End(removed, last)
+	m.revokeChildren(actor, tk)
 }
 
 // Get get token by uid
 func (m *Mgr) Get(uid string, tk token.Token) error {
+	op := m.tel.Start(telemetry.OpGet)
+	err := m.get(uid, tk)
+	op.End(err == nil, err)
+	return err
+}
+
+func (m *Mgr) get(uid string, tk token.Token) error {
 	files, _ := filepath.Glob(path.Join(m.cacheDir, fmt.Sprintf("%s_*.token", uid)))
 	if len(files) == 0 {
-		return errors.New("not found")
+		return ErrNotfound
 	}
 	data, err := ioutil.ReadFile(files[0])
 	if err != nil {
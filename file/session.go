@@ -0,0 +1,248 @@
+package file
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// session token file of uid, created is the modify time of token file and
+// seen is the modify time of the .seen file which is touched on Verify, it
+// equals to created when never verified
+type session struct {
+	file    string
+	tk      string
+	created time.Time
+	seen    time.Time
+}
+
+func seenName(file string) string {
+	return strings.TrimSuffix(file, ".token") + ".seen"
+}
+
+func metaName(file string) string {
+	return strings.TrimSuffix(file, ".token") + ".meta"
+}
+
+// keepName returns marker of token file restored or expired with zero ttl,
+// the token never expires while the marker exists
+func keepName(file string) string {
+	return strings.TrimSuffix(file, ".token") + ".keep"
+}
+
+// expireName returns marker of token file with its own expiry set by
+// Expire, the modify time of marker is the time the token expires at
+func expireName(file string) string {
+	return strings.TrimSuffix(file, ".token") + ".expire"
+}
+
+// remove remove token file and its .seen, .meta, .keep and .expire files
+func remove(file string) error {
+	err := os.Remove(file)
+	os.Remove(seenName(file))
+	os.Remove(metaName(file))
+	os.Remove(keepName(file))
+	os.Remove(expireName(file))
+	return err
+}
+
+// writeMeta write metadata of token file as json, empty metadata is not
+// written
+func writeMeta(file string, meta token.Meta) error {
+	if meta == (token.Meta{}) {
+		err := os.Remove(metaName(file))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaName(file), data, 0644)
+}
+
+func readMeta(file string) (token.Meta, error) {
+	var meta token.Meta
+	data, err := ioutil.ReadFile(metaName(file))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// touch record last use of token file
+func (m *Mgr) touch(file string) error {
+	now := m.clock.Now()
+	name := seenName(file)
+	err := os.Chtimes(name, now, now)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Chtimes(name, now, now)
+}
+
+// sessions returns tokens of uid which are not expired
+func (m *Mgr) sessions(uid string) ([]session, error) {
+	files, err := filepath.Glob(path.Join(m.cacheDir, uid+"_*.token"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []session
+	for _, file := range files {
+		s, err := m.stat(file)
+		if err == ErrNotfound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// stat returns ErrNotfound when token file is missing or expired
+func (m *Mgr) stat(file string) (session, error) {
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return session{}, ErrNotfound
+	}
+	if err != nil {
+		return session{}, err
+	}
+	if m.expired(file, fi) {
+		return session{}, ErrNotfound
+	}
+	_, tk, _ := parseName(file)
+	s := session{
+		file:    file,
+		tk:      tk,
+		created: fi.ModTime(),
+		seen:    fi.ModTime(),
+	}
+	if fi, err := os.Stat(seenName(file)); err == nil {
+		s.seen = fi.ModTime()
+	}
+	return s, nil
+}
+
+// limit make room for new token tk of uid, it must be called with the lock
+// of uid, returns the events of evicted tokens
+func (m *Mgr) limit(uid, tk string) ([]token.Event, error) {
+	list, err := m.sessions(uid)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range list {
+		// saving again is not a new session
+		if s.tk == tk {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	over := len(list) - m.maxSessions + 1
+	if over <= 0 {
+		return nil, nil
+	}
+	switch m.policy {
+	case token.EvictOldest:
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].created.Before(list[j].created)
+		})
+	case token.EvictLRU:
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].seen.Before(list[j].seen)
+		})
+	default:
+		return nil, token.ErrSessionLimit
+	}
+	var events []token.Event
+	for _, s := range list[:over] {
+		err := remove(s.file)
+		if err != nil && !os.IsNotExist(err) {
+			return events, err
+		}
+		events = append(events, token.Event{
+			Op:    token.OpEvict,
+			Actor: uid,
+			UID:   uid,
+			Token: s.tk,
+			OK:    err == nil,
+		})
+	}
+	return events, nil
+}
+
+func (m *Mgr) session(uid string, s session) (token.Session, error) {
+	meta, err := readMeta(s.file)
+	if err != nil {
+		return token.Session{}, err
+	}
+	ret := token.Session{
+		UID:      uid,
+		Token:    s.tk,
+		Meta:     meta,
+		Created:  s.created,
+		LastSeen: s.seen,
+	}
+	if at := m.deadline(s.file, s.created); !at.IsZero() {
+		ret.TTL = at.Sub(m.clock.Now())
+	}
+	return ret, nil
+}
+
+// Session get session by token
+func (m *Mgr) Session(tk string) (token.Session, error) {
+	files, _ := filepath.Glob(path.Join(m.cacheDir, "*_"+tk+".token"))
+	if len(files) == 0 {
+		return token.Session{}, ErrNotfound
+	}
+	s, err := m.stat(files[0])
+	if err != nil {
+		return token.Session{}, err
+	}
+	uid, _, _ := parseName(files[0])
+	return m.session(uid, s)
+}
+
+// Sessions list sessions of uid which are not expired, ordered by creation
+func (m *Mgr) Sessions(uid string) ([]token.Session, error) {
+	list, err := m.sessions(uid)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].created.Before(list[j].created)
+	})
+	ret := make([]token.Session, 0, len(list))
+	for _, s := range list {
+		sess, err := m.session(uid, s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, sess)
+	}
+	return ret, nil
+}
+
+func lockName(dir, uid string) string {
+	return path.Join(dir, uid+".lock")
+}
@@ -1,78 +1,36 @@
 package file
 
 import (
-	"crypto/md5"
-	"encoding/json"
 	"fmt"
-	"math/rand"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
-)
-
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
-type tk struct {
-	Token string
-	Uid   string
-	Name  string
-}
-
-func newToken(uid, name string) *tk {
-	enc := md5.Sum([]byte(fmt.Sprintf("%d", rand.Int())))
-	return &tk{
-		Token: fmt.Sprintf("%x", enc),
-		Uid:   uid,
-		Name:  name,
-	}
-}
 
-func (tk *tk) GetTK() string {
-	return tk.Token
-}
-
-func (tk *tk) GetUID() string {
-	return tk.Uid
-}
-
-func (tk *tk) GetName() string {
-	return tk.Name
-}
-
-func (tk *tk) Serialize() ([]byte, error) {
-	return json.Marshal(tk)
-}
-
-func (tk *tk) UnSerialize(token string, data []byte) error {
-	return json.Unmarshal(data, tk)
-}
-
-func (token *tk) Verify(data []byte) (bool, error) {
-	var dst tk
-	err := json.Unmarshal([]byte(data), &dst)
-	if err != nil {
-		return false, err
-	}
-	if token.Token == dst.Token {
-		*token = dst
-		return true, nil
-	}
-	return false, nil
-}
+	"github.com/lwch/token"
+	"github.com/lwch/token/internal/telemetry"
+	"github.com/lwch/token/tokentest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric/global"
+)
 
 func TestFileToken(t *testing.T) {
-	mgr := NewManager(os.TempDir(), time.Minute)
-	tk1 := newToken("1", "hello")
-	tk2 := newToken("2", "world")
-	var tk3 tk
+	clk := tokentest.NewClock(time.Now())
+	mgr := NewManager(t.TempDir(), time.Minute, token.WithClock(clk))
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("2", "world")
+	var tk3 tokentest.Token
 
 	err := mgr.Save(tk1)
 	if err != nil {
 		t.Fatalf("unexpected save token: %v", err)
 	}
-	ok, err := mgr.Verify(&tk{Token: tk1.Token})
+	ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
 	if err != nil {
 		t.Fatalf("unexpected verify token: %v", err)
 	}
@@ -90,7 +48,7 @@ func TestFileToken(t *testing.T) {
 		t.Fatalf("unexpected name between tk1 and tk3")
 	}
 	mgr.Revoke(tk1.Uid, tk1.Token)
-	ok, err = mgr.Verify(&tk{Token: tk1.Token})
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk1.Token})
 	if err != nil {
 		t.Fatalf("unexpected verify token: %v", err)
 	}
@@ -102,15 +60,15 @@ func TestFileToken(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected save token: %v", err)
 	}
-	ok, err = mgr.Verify(&tk{Token: tk2.Token})
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk2.Token})
 	if err != nil {
 		t.Fatalf("unexpected verify token: %v", err)
 	}
 	if !ok {
 		t.Fatal("verify token failed: tk2")
 	}
-	time.Sleep(time.Minute + 10*time.Second)
-	ok, err = mgr.Verify(&tk{Token: tk2.Token})
+	clk.Add(time.Minute + 10*time.Second)
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk2.Token})
 	if err != nil {
 		t.Fatalf("unexpected verify token: %v", err)
 	}
@@ -118,3 +76,691 @@ func TestFileToken(t *testing.T) {
 		t.Fatal("unxepected verify token success: tk2")
 	}
 }
+
+func TestFileWalk(t *testing.T) {
+	mgr := NewManager(t.TempDir(), time.Minute)
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("1", "world")
+	tk3 := tokentest.NewToken("2", "hello")
+	for _, tk := range []*tokentest.Token{tk1, tk2, tk3} {
+		err := mgr.Save(tk)
+		if err != nil {
+			t.Fatalf("unexpected save token: %v", err)
+		}
+	}
+	cnt := make(map[string]int)
+	err := mgr.Walk(func(e token.Entry) error {
+		cnt[e.UID]++
+		if e.TTL <= 0 || e.TTL > time.Minute {
+			t.Fatalf("unexpected ttl of %s: %s", e.Token, e.TTL)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected walk: %v", err)
+	}
+	if cnt["1"] != 2 || cnt["2"] != 1 {
+		t.Fatalf("unexpected walk result: %v", cnt)
+	}
+	e, err := mgr.Lookup(tk3.Token)
+	if err != nil {
+		t.Fatalf("unexpected lookup: %v", err)
+	}
+	if e.UID != tk3.Uid {
+		t.Fatalf("unexpected uid of lookup: %s", e.UID)
+	}
+	err = mgr.RevokeUID(tk1.Uid)
+	if err != nil {
+		t.Fatalf("unexpected revoke uid: %v", err)
+	}
+	_, err = mgr.Lookup(tk2.Token)
+	if err != ErrNotfound {
+		t.Fatalf("unexpected lookup after revoke uid: %v", err)
+	}
+}
+
+func TestFileRestore(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	mgr := NewManager(t.TempDir(), time.Hour,
+		token.WithClock(clk), token.WithoutJanitor())
+	defer mgr.Close()
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("1", "world")
+	for _, e := range []token.Entry{
+		{UID: tk1.Uid, Token: tk1.Token, Data: []byte(`{}`)},
+		{UID: tk2.Uid, Token: tk2.Token, Data: []byte(`{}`), TTL: 10 * time.Minute},
+	} {
+		err := mgr.Restore(e)
+		if err != nil {
+			t.Fatalf("unexpected restore: %v", err)
+		}
+	}
+	e, err := mgr.Lookup(tk1.Token)
+	if err != nil || e.TTL != 0 {
+		t.Fatalf("unexpected ttl of restored token: %s, %v", e.TTL, err)
+	}
+	e, err = mgr.Lookup(tk2.Token)
+	if err != nil || e.TTL != 10*time.Minute {
+		t.Fatalf("unexpected ttl of restored token: %s, %v", e.TTL, err)
+	}
+	clk.Add(time.Minute)
+	err = mgr.Rewrite(tk2.Token, []byte(`[]`))
+	if err != nil {
+		t.Fatalf("unexpected rewrite: %v", err)
+	}
+	e, err = mgr.Lookup(tk2.Token)
+	if err != nil || e.TTL != 9*time.Minute || string(e.Data) != `[]` {
+		t.Fatalf("unexpected entry after rewrite: %+v, %v", e, err)
+	}
+	err = mgr.Rewrite("missing", nil)
+	if err != ErrNotfound {
+		t.Fatalf("unexpected rewrite of missing token: %v", err)
+	}
+	before, err := mgr.Session(tk2.Token)
+	if err != nil {
+		t.Fatalf("unexpected session: %v", err)
+	}
+	for _, ttl := range []time.Duration{90 * time.Minute, 30 * time.Minute} {
+		err = mgr.Expire(tk2.Token, ttl)
+		if err != nil {
+			t.Fatalf("unexpected expire: %v", err)
+		}
+		sess, err := mgr.Session(tk2.Token)
+		if err != nil || sess.TTL != ttl || !sess.Created.Equal(before.Created) {
+			t.Fatalf("unexpected session after expire: %+v, %v", sess, err)
+		}
+	}
+	err = mgr.Expire("missing", time.Minute)
+	if err != ErrNotfound {
+		t.Fatalf("unexpected expire of missing token: %v", err)
+	}
+	clk.Add(2 * time.Hour)
+	n, err := mgr.Purge()
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected purge: %d, %v", n, err)
+	}
+	sess, err := mgr.Session(tk1.Token)
+	if err != nil || sess.TTL != 0 {
+		t.Fatalf("unexpected session of restored token: %+v, %v", sess, err)
+	}
+
+	// saving again applies ttl of manager
+	err = mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.Add(2 * time.Hour)
+	_, err = mgr.Lookup(tk1.Token)
+	if err != ErrNotfound {
+		t.Fatalf("unexpected lookup of saved token: %v", err)
+	}
+
+	// ttl of entry is kept by manager never expires tokens
+	keep := NewManager(t.TempDir(), 0, token.WithClock(clk), token.WithoutJanitor())
+	defer keep.Close()
+	err = keep.Restore(token.Entry{UID: tk2.Uid, Token: tk2.Token, Data: []byte(`{}`),
+		TTL: 10 * time.Minute, Meta: token.Meta{Purpose: "test"}})
+	if err != nil {
+		t.Fatalf("unexpected restore: %v", err)
+	}
+	e, err = keep.Lookup(tk2.Token)
+	if err != nil || e.TTL != 10*time.Minute || e.Meta.Purpose != "test" {
+		t.Fatalf("unexpected restored entry: %+v, %v", e, err)
+	}
+	clk.Add(11 * time.Minute)
+	_, err = keep.Lookup(tk2.Token)
+	if err != ErrNotfound {
+		t.Fatalf("unexpected lookup of expired restored token: %v", err)
+	}
+}
+
+func TestFileJanitor(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	dir := t.TempDir()
+	mgr := NewManager(dir, time.Minute, token.WithClock(clk))
+	tk1 := tokentest.NewToken("1", "hello")
+	err := mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.BlockUntil(1)
+	clk.Add(30 * time.Second)
+	err = mgr.Save(tokentest.NewToken("2", "world"))
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.Add(40 * time.Second)
+	clk.BlockUntil(1)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.token"))
+	if len(files) != 1 {
+		t.Fatalf("unexpected files after janitor: %v", files)
+	}
+	if _, tk, _ := parseName(files[0]); tk == tk1.Token {
+		t.Fatal("expired token is not removed by janitor")
+	}
+
+	// janitor is stopped by Close
+	err = mgr.Close()
+	if err != nil {
+		t.Fatalf("unexpected close: %v", err)
+	}
+	if err = mgr.Close(); err != os.ErrClosed {
+		t.Fatalf("unexpected close twice: %v", err)
+	}
+	clk.Add(2 * time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	files, _ = filepath.Glob(filepath.Join(dir, "*.token"))
+	if len(files) != 1 {
+		t.Fatalf("janitor is running after close: %v", files)
+	}
+}
+
+func TestFileTrace(t *testing.T) {
+	tracer := tokentest.NewTracer()
+	otel.SetTracerProvider(tracer)
+	mgr := NewManager(t.TempDir(), time.Minute)
+	tk1 := tokentest.NewToken("1", "hello")
+	err := mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	mgr.Verify(tokentest.NewToken("1", "guess"))
+	mgr.Revoke(tk1.Uid, tk1.Token)
+	mgr.Get(tk1.Uid, &tokentest.Token{})
+	var results []string
+	for _, span := range tracer.Spans() {
+		if span.Attributes["token.backend"].AsString() != "file" {
+			t.Fatalf("unexpected backend of %s", span.Name)
+		}
+		for _, v := range span.Attributes {
+			if v.AsString() == tk1.Token || v.AsString() == tk1.Uid {
+				t.Fatalf("sensitive attribute of %s", span.Name)
+			}
+		}
+		results = append(results, span.Name+":"+span.Attributes["token.result"].AsString())
+	}
+	want := "token.save:ok token.verify:hit token.verify:miss token.revoke:ok token.get:miss"
+	if strings.Join(results, " ") != want {
+		t.Fatalf("unexpected spans: %v", results)
+	}
+}
+
+// meter global meter provider is delegated once per process
+var meter = tokentest.NewMeter()
+
+func TestFileMetric(t *testing.T) {
+	global.SetMeterProvider(meter)
+	meter.Reset()
+	mgr := NewManager(t.TempDir(), time.Minute)
+	mgr.Save(tokentest.NewToken("1", "hello"))
+	meter.Collect()
+	n := len(meter.Find(telemetry.ActiveMetric))
+	if n == 0 {
+		t.Fatal("active tokens are not observed")
+	}
+	mgr.Close()
+	meter.Reset()
+	meter.Collect()
+	if left := len(meter.Find(telemetry.ActiveMetric)); left != n-1 {
+		t.Fatalf("closed manager is observed: %d of %d", left, n)
+	}
+}
+
+func testSessionLimit(t *testing.T, newMgr func(...token.Option) token.Manager) {
+	save := func(mgr token.Manager, clk *tokentest.Clock, uid string) *tokentest.Token {
+		tk := tokentest.NewToken(uid, "hello")
+		err := mgr.Save(tk)
+		if err != nil {
+			t.Fatalf("unexpected save token: %v", err)
+		}
+		clk.Add(time.Second)
+		return tk
+	}
+	verify := func(mgr token.Manager, tk1 *tokentest.Token) bool {
+		ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+		if err != nil {
+			t.Fatalf("unexpected verify token: %v", err)
+		}
+		return ok
+	}
+
+	clk := tokentest.NewClock(time.Now())
+	mgr := newMgr(token.WithClock(clk), token.WithSessionLimit(2, token.RejectNew))
+	save(mgr, clk, "1")
+	save(mgr, clk, "1")
+	err := mgr.Save(tokentest.NewToken("1", "hello"))
+	if err != token.ErrSessionLimit {
+		t.Fatalf("unexpected save over limit: %v", err)
+	}
+	save(mgr, clk, "2")
+
+	clk = tokentest.NewClock(time.Now())
+	mgr = newMgr(token.WithClock(clk), token.WithSessionLimit(2, token.EvictOldest))
+	tk1 := save(mgr, clk, "1")
+	tk2 := save(mgr, clk, "1")
+	verify(mgr, tk1)
+	tk3 := save(mgr, clk, "1")
+	if verify(mgr, tk1) || !verify(mgr, tk2) || !verify(mgr, tk3) {
+		t.Fatal("oldest token is not evicted")
+	}
+
+	clk = tokentest.NewClock(time.Now())
+	mgr = newMgr(token.WithClock(clk), token.WithSessionLimit(2, token.EvictLRU))
+	tk1 = save(mgr, clk, "1")
+	tk2 = save(mgr, clk, "1")
+	verify(mgr, tk1)
+	clk.Add(time.Second)
+	tk3 = save(mgr, clk, "1")
+	if !verify(mgr, tk1) || verify(mgr, tk2) || !verify(mgr, tk3) {
+		t.Fatal("least recently used token is not evicted")
+	}
+}
+
+func testSessionLimitConcurrent(t *testing.T, mgr token.Manager) {
+	var wg sync.WaitGroup
+	var saved int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := mgr.Save(tokentest.NewToken("1", "hello"))
+			if err == nil {
+				atomic.AddInt32(&saved, 1)
+			} else if err != token.ErrSessionLimit {
+				t.Errorf("unexpected save token: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if saved != 3 {
+		t.Fatalf("unexpected saved tokens: %d", saved)
+	}
+}
+
+func TestFileSessionLimit(t *testing.T) {
+	testSessionLimit(t, func(opts ...token.Option) token.Manager {
+		return NewManager(t.TempDir(), time.Hour, opts...)
+	})
+	testSessionLimitConcurrent(t, NewManager(t.TempDir(), time.Hour,
+		token.WithSessionLimit(3, token.RejectNew)))
+}
+
+func testSessions(t *testing.T, mgr token.SessionManager, clk *tokentest.Clock) {
+	near := func(a, b time.Time) bool {
+		d := a.Sub(b)
+		return d > -time.Millisecond && d < time.Millisecond
+	}
+	meta := token.Meta{IP: "10.0.0.1", UserAgent: "curl/7.68.0", Device: "laptop"}
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("1", "world")
+	created := clk.Now()
+	err := mgr.SaveSession(tk1, meta)
+	if err != nil {
+		t.Fatalf("unexpected save session: %v", err)
+	}
+	clk.Add(time.Second)
+	err = mgr.Save(tk2)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.Add(time.Second)
+	seen := clk.Now()
+	ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || !ok {
+		t.Fatalf("verify token failed: %v", err)
+	}
+
+	list, err := mgr.Sessions("1")
+	if err != nil {
+		t.Fatalf("unexpected list sessions: %v", err)
+	}
+	if len(list) != 2 || list[0].Token != tk1.Token || list[1].Token != tk2.Token {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+	if list[0].UID != "1" || list[0].Meta != meta {
+		t.Fatalf("unexpected metadata: %+v", list[0])
+	}
+	if !near(list[0].Created, created) || !near(list[0].LastSeen, seen) {
+		t.Fatalf("unexpected times of tk1: %s %s", list[0].Created, list[0].LastSeen)
+	}
+	if list[1].Meta != (token.Meta{}) || !near(list[1].LastSeen, list[1].Created) {
+		t.Fatalf("unexpected session of tk2: %+v", list[1])
+	}
+	if list[0].TTL <= 0 {
+		t.Fatalf("unexpected ttl: %s", list[0].TTL)
+	}
+
+	s, err := mgr.Session(tk1.Token)
+	if err != nil || s.Meta != meta || s.UID != "1" {
+		t.Fatalf("unexpected get session: %+v %v", s, err)
+	}
+	mgr.Revoke(tk1.Uid, tk1.Token)
+	_, err = mgr.Session(tk1.Token)
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected get revoked session: %v", err)
+	}
+	list, err = mgr.Sessions("1")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("unexpected sessions after revoke: %d %v", len(list), err)
+	}
+}
+
+func TestFileSessions(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	testSessions(t, NewManager(t.TempDir(), time.Hour, token.WithClock(clk)), clk)
+}
+
+func testConsume(t *testing.T, mgr token.OneTimeManager, clk *tokentest.Clock) {
+	tk1 := tokentest.NewToken("1", "reset")
+	err := mgr.SaveSession(tk1, token.Meta{Purpose: "reset"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	ok, err := mgr.VerifyAndConsume(&tokentest.Token{Token: tk1.Token}, "verify_email")
+	if err != token.ErrPurpose || ok {
+		t.Fatalf("unexpected consume for other purpose: %v", err)
+	}
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || !ok {
+		t.Fatalf("token is consumed by other purpose: %v", err)
+	}
+	dst := &tokentest.Token{Token: tk1.Token}
+	ok, err = mgr.VerifyAndConsume(dst, "reset")
+	if err != nil || !ok || dst.Name != "reset" {
+		t.Fatalf("consume failed: %v", err)
+	}
+	ok, err = mgr.VerifyAndConsume(&tokentest.Token{Token: tk1.Token}, "reset")
+	if err != nil || ok {
+		t.Fatalf("unexpected consume twice: %v", err)
+	}
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || ok {
+		t.Fatalf("unexpected verify of consumed token: %v", err)
+	}
+	list, err := mgr.Sessions("1")
+	if err != nil || len(list) != 0 {
+		t.Fatalf("unexpected sessions after consume: %d %v", len(list), err)
+	}
+
+	tk2 := tokentest.NewToken("2", "verify")
+	err = mgr.SaveSession(tk2, token.Meta{Purpose: "verify_email"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	var wg sync.WaitGroup
+	var consumed int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := mgr.VerifyAndConsume(&tokentest.Token{Token: tk2.Token}, "verify_email")
+			if err != nil {
+				t.Errorf("unexpected consume: %v", err)
+			}
+			if ok {
+				atomic.AddInt32(&consumed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed != 1 {
+		t.Fatalf("unexpected concurrent consumes: %d", consumed)
+	}
+
+	tk3 := tokentest.NewToken("3", "expired")
+	err = mgr.SaveSession(tk3, token.Meta{Purpose: "reset"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.Add(2 * time.Hour)
+	ok, err = mgr.VerifyAndConsume(&tokentest.Token{Token: tk3.Token}, "reset")
+	if err != nil || ok {
+		t.Fatalf("unexpected consume of expired token: %v", err)
+	}
+}
+
+func TestFileConsume(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	testConsume(t, NewManager(t.TempDir(), time.Hour, token.WithClock(clk)), clk)
+}
+
+func testChildren(t *testing.T, mgr *Mgr) {
+	verify := func(tk1 *tokentest.Token) bool {
+		ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+		if err != nil {
+			t.Fatalf("unexpected verify: %v", err)
+		}
+		return ok
+	}
+	children := func(tk1 *tokentest.Token, want ...*tokentest.Token) {
+		t.Helper()
+		list, err := mgr.Children(tk1.Token)
+		if err != nil {
+			t.Fatalf("unexpected children: %v", err)
+		}
+		tks := make([]string, 0, len(want))
+		for _, tk := range want {
+			tks = append(tks, tk.Token)
+		}
+		sort.Strings(tks)
+		if fmt.Sprint(list) != fmt.Sprint(tks) {
+			t.Fatalf("unexpected children of %s: %v, want %v", tk1.Token, list, tks)
+		}
+	}
+	save := func(tk1, parent *tokentest.Token) {
+		err := mgr.SaveSession(tk1, token.Meta{Parent: parent.Token})
+		if err != nil {
+			t.Fatalf("unexpected save child: %v", err)
+		}
+	}
+
+	parent := tokentest.NewToken("1", "session")
+	err := mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	job1 := tokentest.NewToken("1", "job1")
+	job2 := tokentest.NewToken("2", "job2")
+	step := tokentest.NewToken("1", "step")
+	save(job1, parent)
+	save(job2, parent)
+	save(step, job1)
+	orphan := tokentest.NewToken("1", "orphan")
+	err = mgr.SaveSession(orphan, token.Meta{Parent: tokentest.NewToken("1", "missing").Token})
+	if err != token.ErrNotfound || verify(orphan) {
+		t.Fatalf("unexpected save with missing parent: %v", err)
+	}
+	s, err := mgr.Session(step.Token)
+	if err != nil || s.Meta.Parent != job1.Token {
+		t.Fatalf("unexpected session of child: %+v %v", s, err)
+	}
+	children(parent, job1, job2)
+	children(job1, step)
+
+	mgr.Revoke("2", job2.Token)
+	children(parent, job1)
+	mgr.Revoke("1", parent.Token)
+	for _, tk := range []*tokentest.Token{parent, job1, step} {
+		if verify(tk) {
+			t.Fatalf("token %s is not revoked with its parent", tk.Name)
+		}
+	}
+	children(parent)
+	children(job1)
+
+	// children of other uid are revoked by RevokeUID
+	parent = tokentest.NewToken("3", "session")
+	err = mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	job1 = tokentest.NewToken("4", "job1")
+	save(job1, parent)
+	err = mgr.RevokeUID("3")
+	if err != nil {
+		t.Fatalf("unexpected revoke uid: %v", err)
+	}
+	if verify(job1) {
+		t.Fatal("child is not revoked with its parent uid")
+	}
+}
+
+func TestFileChildren(t *testing.T) {
+	testChildren(t, NewManager(t.TempDir(), time.Hour))
+}
+
+// testCascade children are revoked when their parent is consumed, evicted
+// or expired
+func testCascade(t *testing.T, clk *tokentest.Clock, newMgr func(...token.Option) *Mgr) {
+	verify := func(mgr *Mgr, tk1 *tokentest.Token) bool {
+		ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+		if err != nil {
+			t.Fatalf("unexpected verify: %v", err)
+		}
+		return ok
+	}
+	mgr := newMgr()
+	parent := tokentest.NewToken("1", "reset")
+	err := mgr.SaveSession(parent, token.Meta{Purpose: "reset"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	child := tokentest.NewToken("2", "job")
+	err = mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	if err != nil {
+		t.Fatalf("unexpected save child: %v", err)
+	}
+	ok, err := mgr.VerifyAndConsume(&tokentest.Token{Token: parent.Token}, "reset")
+	if err != nil || !ok {
+		t.Fatalf("unexpected consume: %v %v", ok, err)
+	}
+	if verify(mgr, child) {
+		t.Fatal("child is not revoked with its consumed parent")
+	}
+
+	mgr = newMgr(token.WithSessionLimit(1, token.EvictOldest))
+	parent = tokentest.NewToken("1", "session")
+	err = mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	child = tokentest.NewToken("2", "job")
+	err = mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	if err != nil {
+		t.Fatalf("unexpected save child: %v", err)
+	}
+	err = mgr.Save(tokentest.NewToken("1", "session"))
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	if verify(mgr, parent) || verify(mgr, child) {
+		t.Fatal("child is not revoked with its evicted parent")
+	}
+
+	mgr = newMgr(token.WithClock(clk), token.WithoutJanitor())
+	parent = tokentest.NewToken("1", "session")
+	err = mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	err = mgr.Expire(parent.Token, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected expire: %v", err)
+	}
+	child = tokentest.NewToken("2", "job")
+	err = mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	if err != nil {
+		t.Fatalf("unexpected save child: %v", err)
+	}
+	clk.Add(2 * time.Minute)
+	_, err = mgr.Purge()
+	if err != nil {
+		t.Fatalf("unexpected purge: %v", err)
+	}
+	if verify(mgr, child) {
+		t.Fatal("child is not revoked with its expired parent")
+	}
+}
+
+func TestFileCascade(t *testing.T) {
+	testCascade(t, tokentest.NewClock(time.Now()), func(opts ...token.Option) *Mgr {
+		return NewManager(t.TempDir(), time.Hour, opts...)
+	})
+}
+
+func TestFileOpen(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	dir := filepath.Join(t.TempDir(), "tokens")
+	dsn := &url.URL{Scheme: "file", Path: dir, RawQuery: "ttl=1m"}
+	mgr, err := token.Open(dsn.String(), token.WithClock(clk))
+	if err != nil {
+		t.Fatalf("unexpected open: %v", err)
+	}
+	saved := tokentest.NewToken("1", "session")
+	err = mgr.Save(saved)
+	if err != nil {
+		t.Fatalf("unexpected save: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.token"))
+	if len(files) != 1 {
+		t.Fatalf("token is not saved in directory of dsn: %v", files)
+	}
+	clk.Add(2 * time.Minute)
+	ok, err := mgr.Verify(&tokentest.Token{Token: saved.Token})
+	if err != nil || ok {
+		t.Fatalf("token is not expired by ttl of dsn: %v", err)
+	}
+
+	for _, dsn := range []string{
+		"file:tokens",
+		"file://",
+		"file://host/tokens",
+		"file://user@/tokens",
+		"file:///tokens?ttl=-1m",
+		"file:///tokens?ttl=",
+		"file:///tokens?prefix=app",
+	} {
+		_, err := token.Open(dsn)
+		if _, ok := err.(*token.DSNError); !ok {
+			t.Fatalf("unexpected open of %s: %v", dsn, err)
+		}
+	}
+	_, err = token.Open("memory:///tokens")
+	if _, ok := err.(*token.DSNError); !ok {
+		t.Fatalf("unexpected open of unknown driver: %v", err)
+	}
+}
+
+func TestFileKVLock(t *testing.T) {
+	kv := NewManager(t.TempDir(), time.Hour).KV()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := kv.Incr("shared", time.Hour)
+			if err != nil {
+				t.Errorf("unexpected incr: %v", err)
+			}
+			kv.Set(fmt.Sprintf("key%d", i), []byte("v"), time.Hour)
+			kv.Del(fmt.Sprintf("key%d", i))
+		}(i)
+	}
+	wg.Wait()
+	n, err := kv.Incr("shared", time.Hour)
+	if err != nil || n != 21 {
+		t.Fatalf("unexpected counter after concurrent incr: %d %v", n, err)
+	}
+	// janitors of managers may hold locks for a moment
+	held := -1
+	for i := 0; i < 100 && held != 0; i++ {
+		locks.Lock()
+		held = len(locks.m)
+		locks.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if held != 0 {
+		t.Fatalf("unexpected locks left after use: %d", held)
+	}
+}
@@ -2,4 +2,9 @@ module github.com/lwch/token
 
 go 1.16
 
-require github.com/go-redis/redis/v8 v8.7.1
+require (
+	github.com/go-redis/redis/v8 v8.7.1
+	go.opentelemetry.io/otel v0.18.0
+	go.opentelemetry.io/otel/metric v0.18.0
+	go.opentelemetry.io/otel/trace v0.18.0
+)
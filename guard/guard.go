@@ -0,0 +1,175 @@
+package guard
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+const (
+	// DefaultMaxFailures default failures in window which start the first
+	// lockout
+	DefaultMaxFailures = 5
+	// DefaultWindow default window of failure counter
+	DefaultWindow = 24 * time.Hour
+	// DefaultLockout default duration of the first lockout
+	DefaultLockout = time.Minute
+	// DefaultMaxLockout default upper bound of lockout
+	DefaultMaxLockout = time.Hour
+)
+
+// Config guard config
+type Config struct {
+	// MaxFailures failures in window which start the first lockout, the
+	// client is locked out by the MaxFailures-th failure
+	MaxFailures int
+	// Window failures are counted since the first failure in window, it
+	// should be larger than MaxLockout to keep lockouts growing
+	Window time.Duration
+	// Lockout duration of the first lockout, it is doubled for every failure
+	// after that
+	Lockout time.Duration
+	// MaxLockout upper bound of lockout
+	MaxLockout time.Duration
+	// Prefix prefix of keys in kv, default is "guard"
+	Prefix string
+}
+
+// LockedError client is locked out after too many failed verifications
+type LockedError struct {
+	Retry time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("guard: too many failed verifications, retry after %s",
+		e.Retry.Truncate(time.Second))
+}
+
+// Guard brute-force protection of token verification, failures are counted
+// per client key such as ip address and kept in kv so that the limits hold
+// across instances sharing the backend
+type Guard struct {
+	mgr token.Manager
+	kv  token.KV
+	cfg Config
+}
+
+// New new guard, kv is usually the KV of the backend of mgr
+func New(mgr token.Manager, kv token.KV, cfg Config) *Guard {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = DefaultMaxFailures
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.Lockout <= 0 {
+		cfg.Lockout = DefaultLockout
+	}
+	if cfg.MaxLockout <= 0 {
+		cfg.MaxLockout = DefaultMaxLockout
+	}
+	if len(cfg.Prefix) == 0 {
+		cfg.Prefix = "guard"
+	}
+	return &Guard{mgr: mgr, kv: kv, cfg: cfg}
+}
+
+func (g *Guard) failKey(key string) string {
+	return g.cfg.Prefix + ":fail:" + key
+}
+
+func (g *Guard) lockKey(key string) string {
+	return g.cfg.Prefix + ":lock:" + key
+}
+
+// Verify verify token for client key, returns *LockedError without asking
+// the manager while the client is locked out
+func (g *Guard) Verify(key string, tk token.Token) (bool, error) {
+	retry, err := g.Locked(key)
+	if err != nil {
+		return false, err
+	}
+	if retry > 0 {
+		return false, &LockedError{Retry: retry}
+	}
+	ok, err := g.mgr.Verify(tk)
+	if err != nil || ok {
+		return ok, err
+	}
+	return false, g.fail(key)
+}
+
+func (g *Guard) fail(key string) error {
+	n, err := g.kv.Incr(g.failKey(key), g.cfg.Window)
+	if err != nil {
+		return err
+	}
+	over := n - int64(g.cfg.MaxFailures)
+	if over < 0 {
+		return nil
+	}
+	return g.kv.Set(g.lockKey(key), nil, g.lockout(over))
+}
+
+// lockout returns Lockout * 2^over capped by MaxLockout
+func (g *Guard) lockout(over int64) time.Duration {
+	d := g.cfg.Lockout
+	for i := int64(0); i < over; i++ {
+		d *= 2
+		if d >= g.cfg.MaxLockout {
+			return g.cfg.MaxLockout
+		}
+	}
+	if d > g.cfg.MaxLockout {
+		return g.cfg.MaxLockout
+	}
+	return d
+}
+
+// Locked returns remaining lockout of client key, zero means not locked
+func (g *Guard) Locked(key string) (time.Duration, error) {
+	_, ttl, err := g.kv.Load(g.lockKey(key))
+	if err == token.ErrNotfound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// Reset clear failures and lockout of client key
+func (g *Guard) Reset(key string) error {
+	err := g.kv.Del(g.lockKey(key))
+	if err != nil {
+		return err
+	}
+	return g.kv.Del(g.failKey(key))
+}
+
+// Manager returns manager which verifies through guard for client key
+func (g *Guard) Manager(key string) token.Manager {
+	return client{g: g, key: key}
+}
+
+type client struct {
+	g   *Guard
+	key string
+}
+
+func (c client) Save(tk token.Token) error {
+	return c.g.mgr.Save(tk)
+}
+
+func (c client) Verify(tk token.Token) (bool, error) {
+	return c.g.Verify(c.key, tk)
+}
+
+func (c client) Revoke(uid, tk string) {
+	c.g.mgr.Revoke(uid, tk)
+}
+
+func (c client) Get(uid string, tk token.Token) error {
+	return c.g.mgr.Get(uid, tk)
+}
@@ -0,0 +1,90 @@
+package guard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+func testGuard(t *testing.T, mgr token.Manager, kv token.KV, clk *tokentest.Clock) {
+	g := New(mgr, kv, Config{
+		MaxFailures: 3,
+		Lockout:     time.Minute,
+		MaxLockout:  time.Hour,
+	})
+	tk1 := tokentest.NewToken("1", "hello")
+	err := mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ok, err := g.Verify("1.2.3.4", tokentest.NewToken("1", "guess"))
+		if err != nil || ok {
+			t.Fatalf("unexpected verify of unknown token: %v", err)
+		}
+		// locked by the MaxFailures-th failure, not before
+		retry, err := g.Locked("1.2.3.4")
+		if err != nil || (retry > 0) != (i == 2) {
+			t.Fatalf("unexpected lockout after %d failures: %s %v", i+1, retry, err)
+		}
+	}
+	_, err = g.Verify("1.2.3.4", &tokentest.Token{Token: tk1.Token})
+	if _, ok := err.(*LockedError); !ok {
+		t.Fatalf("unexpected verify while locked: %v", err)
+	}
+	ok, err := g.Verify("5.6.7.8", &tokentest.Token{Token: tk1.Token})
+	if err != nil || !ok {
+		t.Fatalf("verify of other client failed: %v", err)
+	}
+
+	clk.Add(time.Minute + time.Second)
+	ok, err = g.Manager("1.2.3.4").Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || !ok {
+		t.Fatalf("verify after lockout failed: %v", err)
+	}
+	ok, err = g.Verify("1.2.3.4", tokentest.NewToken("1", "guess"))
+	if err != nil || ok {
+		t.Fatalf("unexpected verify of unknown token: %v", err)
+	}
+	retry, err := g.Locked("1.2.3.4")
+	if err != nil {
+		t.Fatalf("unexpected locked: %v", err)
+	}
+	if retry <= time.Minute || retry > 2*time.Minute {
+		t.Fatalf("unexpected second lockout: %s", retry)
+	}
+
+	err = g.Reset("1.2.3.4")
+	if err != nil {
+		t.Fatalf("unexpected reset: %v", err)
+	}
+	retry, err = g.Locked("1.2.3.4")
+	if err != nil || retry != 0 {
+		t.Fatalf("unexpected locked after reset: %s %v", retry, err)
+	}
+}
+
+func TestGuardFile(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	mgr := file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk))
+	testGuard(t, mgr, mgr.KV(), clk)
+}
+
+func TestGuardRedis(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	srv.SetClock(clk)
+	mgr := redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, time.Hour, token.WithClock(clk))
+	testGuard(t, mgr, mgr.KV(), clk)
+}
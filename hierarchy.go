@@ -0,0 +1,12 @@
+package token
+
+// HierarchyManager manager which records the parent of tokens saved with
+// Meta.Parent, implemented by every backend. SaveSession returns ErrNotfound
+// when the parent does not exist, and revoking, consuming, evicting or
+// purging a token revokes every descendant of it.
+type HierarchyManager interface {
+	SessionManager
+	// Children returns tokens saved with tk as parent which are not revoked
+	// or expired, ordered by token
+	Children(tk string) ([]string, error)
+}
@@ -0,0 +1,76 @@
+package httpauth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Error bearer token error, see RFC 6750 section 3.1
+type Error struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) == 0 {
+		return "httpauth: missing token"
+	}
+	if len(e.Description) == 0 {
+		return "httpauth: " + e.Code
+	}
+	return "httpauth: " + e.Code + ": " + e.Description
+}
+
+var (
+	// ErrMissing request has no token, challenge without error code
+	ErrMissing = &Error{Status: http.StatusUnauthorized}
+	// ErrInvalidRequest malformed request
+	ErrInvalidRequest = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "invalid_request",
+		Description: "malformed authorization header",
+	}
+	// ErrInvalidToken token is expired, revoked or malformed
+	ErrInvalidToken = &Error{
+		Status:      http.StatusUnauthorized,
+		Code:        "invalid_token",
+		Description: "the access token is invalid or expired",
+	}
+	// ErrInsufficientScope token has not enough privileges
+	ErrInsufficientScope = &Error{
+		Status:      http.StatusForbidden,
+		Code:        "insufficient_scope",
+		Description: "the request requires higher privileges",
+	}
+)
+
+// WriteError write WWW-Authenticate challenge and status code
+func WriteError(w http.ResponseWriter, realm string, err *Error) {
+	w.Header().Set("WWW-Authenticate", Challenge("Bearer", realm, err))
+	w.WriteHeader(err.Status)
+}
+
+// Challenge build WWW-Authenticate header value
+func Challenge(scheme, realm string, err *Error) string {
+	var params []string
+	if len(realm) > 0 {
+		params = append(params, "realm="+quote(realm))
+	}
+	if len(err.Code) > 0 {
+		params = append(params, "error="+quote(err.Code))
+		if len(err.Description) > 0 {
+			params = append(params, "error_description="+quote(err.Description))
+		}
+	}
+	if len(params) == 0 {
+		return scheme
+	}
+	return scheme + " " + strings.Join(params, ", ")
+}
+
+func quote(str string) string {
+	str = strings.ReplaceAll(str, `\`, `\\`)
+	str = strings.ReplaceAll(str, `"`, `\"`)
+	return `"` + str + `"`
+}
@@ -0,0 +1,186 @@
+package httpauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lwch/token"
+)
+
+// Source where to lookup the token in request
+type Source int
+
+const (
+	// Header Authorization: Bearer <token>
+	Header Source = iota
+	// Cookie cookie named by Config.CookieName
+	Cookie
+	// Query query parameter named by Config.QueryName
+	Query
+)
+
+// DefaultCookieName default cookie name
+const DefaultCookieName = "token"
+
+// DefaultQueryName default query parameter name, see RFC 6750 section 2.3
+const DefaultQueryName = "access_token"
+
+// Config middleware config
+type Config struct {
+	// Mgr manager to verify the token, when it keeps sessions tokens bound
+	// by Meta.Binding are rejected since they are only accepted with a
+	// proof, see packages dpop and binding
+	Mgr token.Manager
+	// New create an empty token by the raw string for verify
+	New func(tk string) token.Token
+	// Sources lookup order, default is Header only
+	Sources    []Source
+	CookieName string
+	QueryName  string
+	// Realm realm in WWW-Authenticate challenge
+	Realm string
+}
+
+// Auth bearer token authenticator
+type Auth struct {
+	cfg      Config
+	sessions token.SessionManager
+}
+
+// New new authenticator, it panics on missing Mgr or New and on unknown
+// source so that bad config fails on startup
+func New(cfg Config) *Auth {
+	if cfg.Mgr == nil {
+		panic("httpauth: Mgr is nil")
+	}
+	if cfg.New == nil {
+		panic("httpauth: New is nil")
+	}
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = []Source{Header}
+	}
+	for _, src := range cfg.Sources {
+		if src < Header || src > Query {
+			panic(fmt.Sprintf("httpauth: unknown source %d", src))
+		}
+	}
+	if len(cfg.CookieName) == 0 {
+		cfg.CookieName = DefaultCookieName
+	}
+	if len(cfg.QueryName) == 0 {
+		cfg.QueryName = DefaultQueryName
+	}
+	sessions, _ := cfg.Mgr.(token.SessionManager)
+	return &Auth{cfg: cfg, sessions: sessions}
+}
+
+// Middleware net/http middleware, verified token is stored in request context
+func Middleware(cfg Config) func(http.Handler) http.Handler {
+	return New(cfg).Wrap
+}
+
+// Wrap wrap handler, requests without valid token are rejected
+func (a *Auth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tk, err := a.Authenticate(r)
+		if err != nil {
+			if e, ok := err.(*Error); ok {
+				WriteError(w, a.cfg.Realm, e)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), tk)))
+	})
+}
+
+// Authenticate extract and verify token from request, returns *Error on
+// authentication failure or manager error otherwise
+func (a *Auth) Authenticate(r *http.Request) (token.Token, error) {
+	raw, err := a.Extract(r)
+	if err != nil {
+		return nil, err
+	}
+	if a.sessions != nil {
+		s, err := a.sessions.Session(raw)
+		if err == token.ErrNotfound {
+			return nil, ErrInvalidToken
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(s.Meta.Binding) > 0 {
+			return nil, ErrInvalidToken
+		}
+	}
+	tk := a.cfg.New(raw)
+	ok, err := a.cfg.Mgr.Verify(tk)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return tk, nil
+}
+
+// Extract lookup raw token by configured sources in order
+func (a *Auth) Extract(r *http.Request) (string, error) {
+	for _, src := range a.cfg.Sources {
+		switch src {
+		case Header:
+			hdr := r.Header.Get("Authorization")
+			if len(hdr) == 0 {
+				continue
+			}
+			scheme, tk := ParseAuthorization(hdr)
+			if !strings.EqualFold(scheme, "Bearer") {
+				continue
+			}
+			if len(tk) == 0 || strings.ContainsAny(tk, " \t") {
+				return "", ErrInvalidRequest
+			}
+			return tk, nil
+		case Cookie:
+			c, err := r.Cookie(a.cfg.CookieName)
+			if err != nil || len(c.Value) == 0 {
+				continue
+			}
+			return c.Value, nil
+		case Query:
+			tk := r.URL.Query().Get(a.cfg.QueryName)
+			if len(tk) == 0 {
+				continue
+			}
+			return tk, nil
+		}
+	}
+	return "", ErrMissing
+}
+
+// ParseAuthorization split Authorization header into scheme and credentials
+func ParseAuthorization(hdr string) (string, string) {
+	hdr = strings.TrimSpace(hdr)
+	n := strings.IndexAny(hdr, " \t")
+	if n == -1 {
+		return hdr, ""
+	}
+	return hdr[:n], strings.TrimSpace(hdr[n+1:])
+}
+
+type ctxKey struct{}
+
+// NewContext returns context which carries the verified token
+func NewContext(ctx context.Context, tk token.Token) context.Context {
+	return context.WithValue(ctx, ctxKey{}, tk)
+}
+
+// FromContext get verified token from context
+func FromContext(ctx context.Context) (token.Token, bool) {
+	tk, ok := ctx.Value(ctxKey{}).(token.Token)
+	return tk, ok
+}
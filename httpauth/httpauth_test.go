@@ -0,0 +1,124 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/tokentest"
+)
+
+func TestMiddleware(t *testing.T) {
+	mgr := file.NewManager(t.TempDir(), time.Minute)
+	tk1 := tokentest.NewToken("1", "hello")
+	err := mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+
+	h := Middleware(Config{
+		Mgr: mgr,
+		New: func(raw string) token.Token {
+			return &tokentest.Token{Token: raw}
+		},
+		Sources: []Source{Header, Cookie, Query},
+		Realm:   "example",
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tk, ok := FromContext(r.Context())
+		if !ok {
+			t.Fatal("missing token in context")
+		}
+		fmt.Fprint(w, tk.GetUID())
+	}))
+
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tk1.Token)
+	w := do(r)
+	if w.Code != http.StatusOK || w.Body.String() != tk1.Uid {
+		t.Fatalf("unexpected header auth result: %d %s", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: tk1.Token})
+	w = do(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected cookie auth result: %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/?access_token="+tk1.Token, nil)
+	w = do(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected query auth result: %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	w = do(r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected missing token status: %d", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != `Bearer realm="example"` {
+		t.Fatalf("unexpected missing token challenge: %s", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tokentest.NewToken("2", "world").Token)
+	w = do(r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected invalid token status: %d", w.Code)
+	}
+	want := `Bearer realm="example", error="invalid_token", error_description="the access token is invalid or expired"`
+	if got := w.Header().Get("WWW-Authenticate"); got != want {
+		t.Fatalf("unexpected invalid token challenge: %s", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer")
+	w = do(r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected malformed header status: %d", w.Code)
+	}
+
+	// bound tokens need a proof which bearer scheme does not carry
+	bound := tokentest.NewToken("3", "bound")
+	err = mgr.SaveSession(bound, token.Meta{Binding: "fingerprint"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+bound.Token)
+	w = do(r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected bound token status: %d", w.Code)
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	mgr := file.NewManager(t.TempDir(), time.Minute)
+	newToken := func(raw string) token.Token {
+		return &tokentest.Token{Token: raw}
+	}
+	for i, cfg := range []Config{
+		{New: newToken},
+		{Mgr: mgr},
+		{Mgr: mgr, New: newToken, Sources: []Source{Header, Source(42)}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("bad config %d is accepted by New", i)
+				}
+			}()
+			New(cfg)
+		}()
+	}
+}
@@ -0,0 +1,89 @@
+package telemetry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/unit"
+)
+
+// metric names
+const (
+	OperationsMetric = "token.operations"
+	DurationMetric   = "token.operation.duration"
+	EvictionsMetric  = "token.evictions"
+	ActiveMetric     = "token.active"
+)
+
+type instruments struct {
+	ops       metric.Int64Counter
+	duration  metric.Float64ValueRecorder
+	evictions metric.Int64Counter
+}
+
+var (
+	instOnce sync.Once
+	inst     instruments
+	// active *Instrument => func() (int64, error)
+	active sync.Map
+)
+
+// instrumentsOf creates instruments once, the global meter provider
+// delegates them when it is installed later
+func instrumentsOf() *instruments {
+	instOnce.Do(func() {
+		meter := metric.Must(global.Meter(instrumentationName))
+		inst.ops = meter.NewInt64Counter(OperationsMetric,
+			metric.WithDescription("number of token operations"))
+		inst.duration = meter.NewFloat64ValueRecorder(DurationMetric,
+			metric.WithDescription("latency of token operations"),
+			metric.WithUnit(unit.Milliseconds))
+		inst.evictions = meter.NewInt64Counter(EvictionsMetric,
+			metric.WithDescription("number of expired tokens removed by janitor or purge"))
+		meter.NewInt64ValueObserver(ActiveMetric, observeActive,
+			metric.WithDescription("number of tokens in store"))
+	})
+	return &inst
+}
+
+func observeActive(ctx context.Context, result metric.Int64ObserverResult) {
+	active.Range(func(k, v interface{}) bool {
+		n, err := v.(func() (int64, error))()
+		if err == nil {
+			result.Observe(n, k.(*Instrument).attrs...)
+		}
+		return true
+	})
+}
+
+// Active report number of tokens of manager by fn on every collection until
+// Close, managers must call Close when they are closed or fn keeps them alive
+func (in *Instrument) Active(fn func() (int64, error)) {
+	instrumentsOf()
+	active.Store(in, fn)
+}
+
+// Close stop reporting number of tokens
+func (in *Instrument) Close() {
+	active.Delete(in)
+}
+
+// Evicted record expired tokens removed from store
+func (in *Instrument) Evicted(n int) {
+	if n <= 0 {
+		return
+	}
+	instrumentsOf().evictions.Add(context.Background(), int64(n), in.attrs...)
+}
+
+func (o Op) record(result string) {
+	ms := float64(time.Since(o.begin)) / float64(time.Millisecond)
+	attrs := append([]attribute.KeyValue{OperationKey.String(o.op)}, o.in.attrs...)
+	inst := instrumentsOf()
+	inst.duration.Record(context.Background(), ms, attrs...)
+	inst.ops.Add(context.Background(), 1, append(attrs, ResultKey.String(result))...)
+}
@@ -0,0 +1,119 @@
+// Package telemetry opentelemetry instrumentation shared by managers, spans
+// and metrics are created by the globally configured providers. Manager
+// methods take no context, so spans are roots of their own traces and are
+// not joined to the trace of the caller.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/lwch/token"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/lwch/token"
+
+// attribute keys, uid and token are never recorded
+const (
+	BackendKey   = attribute.Key("token.backend")
+	PrefixKey    = attribute.Key("token.prefix")
+	OperationKey = attribute.Key("token.operation")
+	ResultKey    = attribute.Key("token.result")
+)
+
+// operations
+const (
+	OpSave    = "save"
+	OpVerify  = "verify"
+	OpRevoke  = "revoke"
+	OpGet     = "get"
+	OpConsume = "consume"
+)
+
+// results
+const (
+	ResultOK    = "ok"
+	ResultHit   = "hit"
+	ResultMiss  = "miss"
+	ResultError = "error"
+)
+
+// Instrument instrumentation of one manager
+type Instrument struct {
+	attrs []attribute.KeyValue
+}
+
+// New new instrument, prefix is omitted when empty
+func New(backend, prefix string) *Instrument {
+	attrs := []attribute.KeyValue{BackendKey.String(backend)}
+	if len(prefix) > 0 {
+		attrs = append(attrs, PrefixKey.String(prefix))
+	}
+	return &Instrument{attrs: attrs}
+}
+
+// Op running operation
+type Op struct {
+	in    *Instrument
+	op    string
+	begin time.Time
+	span  trace.Span
+}
+
+// Start start operation, the span starts from context.Background since
+// managers have no context of the caller
+func (in *Instrument) Start(op string) Op {
+	attrs := append([]attribute.KeyValue{OperationKey.String(op)}, in.attrs...)
+	_, span := otel.Tracer(instrumentationName).Start(context.Background(), "token."+op,
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindInternal))
+	return Op{in: in, op: op, begin: time.Now(), span: span}
+}
+
+// End end operation, ok reports whether the token was found,
+// token.ErrNotfound and token.ErrPurpose are reported as miss
+func (o Op) End(ok bool, err error) {
+	if err == token.ErrNotfound || err == token.ErrPurpose {
+		ok, err = false, nil
+	}
+	result := Result(o.op, ok, err)
+	o.record(result)
+	o.span.SetAttributes(ResultKey.String(result))
+	if err != nil {
+		err = redact(err)
+		o.span.RecordError(err)
+		o.span.SetStatus(codes.Error, err.Error())
+	}
+	o.span.End()
+}
+
+// Result returns result of operation, lookups report hit or miss and the
+// others report ok or miss
+func Result(op string, ok bool, err error) string {
+	switch {
+	case err != nil:
+		return ResultError
+	case !ok:
+		return ResultMiss
+	case op == OpVerify || op == OpGet || op == OpConsume:
+		return ResultHit
+	}
+	return ResultOK
+}
+
+// redact drop file names which contain uid and token
+func redact(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return errors.New(e.Op + ": " + e.Err.Error())
+	case *os.LinkError:
+		return errors.New(e.Op + ": " + e.Err.Error())
+	}
+	return err
+}
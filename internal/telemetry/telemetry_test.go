@@ -0,0 +1,103 @@
+package telemetry
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/tokentest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric/global"
+)
+
+func TestTrace(t *testing.T) {
+	tracer := tokentest.NewTracer()
+	otel.SetTracerProvider(tracer)
+	in := New("redis", "app")
+
+	in.Start(OpVerify).End(true, nil)
+	in.Start(OpGet).End(false, token.ErrNotfound)
+	in.Start(OpSave).End(true, nil)
+	_, err := os.Open("/nonexistent/1_secret.token")
+	in.Start(OpRevoke).End(false, err)
+
+	want := []struct {
+		name   string
+		op     string
+		result string
+	}{
+		{"token.verify", OpVerify, ResultHit},
+		{"token.get", OpGet, ResultMiss},
+		{"token.save", OpSave, ResultOK},
+		{"token.revoke", OpRevoke, ResultError},
+	}
+	spans := tracer.Spans()
+	if len(spans) != len(want) {
+		t.Fatalf("unexpected spans count: %d", len(spans))
+	}
+	for i, span := range spans {
+		if span.Name != want[i].name {
+			t.Fatalf("unexpected span name: %s", span.Name)
+		}
+		attrs := span.Attributes
+		if attrs[BackendKey].AsString() != "redis" ||
+			attrs[PrefixKey].AsString() != "app" ||
+			attrs[OperationKey].AsString() != want[i].op ||
+			attrs[ResultKey].AsString() != want[i].result {
+			t.Fatalf("unexpected attributes of %s: %v", span.Name, attrs)
+		}
+	}
+	span := spans[3]
+	if span.Status != codes.Error || len(span.Errors) != 1 {
+		t.Fatalf("error not recorded: %v", span.Errors)
+	}
+	if strings.Contains(span.Errors[0].Error(), "secret") {
+		t.Fatalf("file name is recorded: %v", span.Errors[0])
+	}
+	if len(spans[1].Errors) != 0 {
+		t.Fatalf("not found is recorded as error: %v", spans[1].Errors)
+	}
+}
+
+func TestMetric(t *testing.T) {
+	meter := tokentest.NewMeter()
+	global.SetMeterProvider(meter)
+	in := New("file", "metric")
+	in.Active(func() (int64, error) {
+		return 3, nil
+	})
+	defer in.Close()
+	backend := BackendKey.String("file")
+
+	in.Start(OpVerify).End(true, nil)
+	in.Start(OpVerify).End(false, nil)
+	in.Start(OpVerify).End(false, token.ErrNotfound)
+	in.Start(OpSave).End(true, nil)
+	in.Evicted(2)
+
+	if n := meter.Sum(OperationsMetric, backend, OperationKey.String(OpVerify),
+		ResultKey.String(ResultMiss)); n != 2 {
+		t.Fatalf("unexpected verify misses: %v", n)
+	}
+	if n := meter.Sum(OperationsMetric, backend, PrefixKey.String("metric")); n != 4 {
+		t.Fatalf("unexpected operations: %v", n)
+	}
+	if n := len(meter.Find(DurationMetric, OperationKey.String(OpVerify))); n != 3 {
+		t.Fatalf("unexpected verify latencies: %d", n)
+	}
+	if n := meter.Sum(EvictionsMetric, backend); n != 2 {
+		t.Fatalf("unexpected evictions: %v", n)
+	}
+	meter.Collect()
+	if n := meter.Sum(ActiveMetric, backend); n != 3 {
+		t.Fatalf("unexpected active tokens: %v", n)
+	}
+	in.Close()
+	meter.Reset()
+	meter.Collect()
+	if n := len(meter.Find(ActiveMetric, backend)); n != 0 {
+		t.Fatalf("closed instrument is observed: %d", n)
+	}
+}
@@ -0,0 +1,24 @@
+package token
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotfound not found error
+var ErrNotfound = errors.New("not found")
+
+// KV small key value storage with expiration, extensions use it to keep
+// their state in the same backend as the tokens
+type KV interface {
+	// SetNX set key only if it does not exist, zero ttl means no expiration
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	// Set set key, zero ttl means no expiration
+	Set(key string, value []byte, ttl time.Duration) error
+	// Load returns value and remaining ttl of key, ErrNotfound if missing
+	Load(key string) ([]byte, time.Duration, error)
+	// Incr increase counter by one, ttl is applied when the counter is created
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Del remove key
+	Del(key string) error
+}
@@ -0,0 +1,30 @@
+package token
+
+import "errors"
+
+// ErrSessionLimit user reached max sessions and the policy rejects new ones
+var ErrSessionLimit = errors.New("token: too many sessions")
+
+// SessionPolicy policy applied when user reached max sessions on Save
+type SessionPolicy int
+
+const (
+	// RejectNew Save fails with ErrSessionLimit
+	RejectNew SessionPolicy = iota
+	// EvictOldest revoke sessions created first
+	EvictOldest
+	// EvictLRU revoke sessions verified least recently
+	EvictLRU
+)
+
+func (p SessionPolicy) String() string {
+	switch p {
+	case RejectNew:
+		return "reject"
+	case EvictOldest:
+		return "oldest"
+	case EvictLRU:
+		return "lru"
+	}
+	return "unknown"
+}
@@ -0,0 +1,59 @@
+package logfile
+
+import (
+	"encoding/json"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/internal/telemetry"
+)
+
+// VerifyAndConsume verify token and delete it with its children, the token
+// is deleted even when Token.Verify rejects its payload
+func (m *Mgr) VerifyAndConsume(tk token.Token, purpose string) (bool, error) {
+	op := m.tel.Start(telemetry.OpConsume)
+	ok, events, err := m.consume(tk, purpose)
+	op.End(ok, err)
+	m.emit(token.Event{
+		Op:    token.OpConsume,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    ok,
+		Err:   err,
+	})
+	for _, e := range events {
+		e.Actor = tk.GetUID()
+		m.emit(e)
+	}
+	return ok, err
+}
+
+// consume returns the events of revoked children to report
+func (m *Mgr) consume(tk token.Token, purpose string) (bool, []token.Event, error) {
+	m.Lock()
+	it := m.lookup(tk.GetTK())
+	if it == nil {
+		m.Unlock()
+		return false, nil, nil
+	}
+	var meta token.Meta
+	if len(it.meta) > 0 {
+		json.Unmarshal(it.meta, &meta)
+	}
+	if meta.Purpose != purpose {
+		m.Unlock()
+		return false, nil, token.ErrPurpose
+	}
+	kids := m.children[tk.GetTK()]
+	err := m.write(record{op: opDel, uid: it.uid, tk: tk.GetTK()})
+	var events []token.Event
+	if err == nil {
+		events = m.revokeChildren(kids)
+	}
+	m.Unlock()
+	if err != nil {
+		return false, nil, err
+	}
+	ok, err := tk.Verify(it.data)
+	return ok, events, err
+}
@@ -0,0 +1,52 @@
+package logfile
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+func init() {
+	token.Register("logfile", token.DriverFunc(open))
+}
+
+// open open manager of dsn like "logfile:///var/lib/tokens.log?ttl=30m",
+// ttl defaults to DefaultTTL
+func open(dsn *url.URL, opts ...token.Option) (token.Handle, error) {
+	name, ttl, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	mgr, err := NewManager(name, ttl, opts...)
+	if err != nil {
+		// a nil *Mgr would make a non-nil handle
+		return nil, err
+	}
+	return mgr, nil
+}
+
+func parseDSN(dsn *url.URL) (string, time.Duration, error) {
+	if len(dsn.Opaque) > 0 {
+		return "", 0, token.InvalidDSN(dsn, "path must be absolute")
+	}
+	if dsn.User != nil {
+		return "", 0, token.InvalidDSN(dsn, "unexpected user")
+	}
+	if len(dsn.Host) > 0 && dsn.Host != "localhost" {
+		return "", 0, token.InvalidDSN(dsn, "unexpected host %s", dsn.Host)
+	}
+	if len(dsn.Path) == 0 || strings.HasSuffix(dsn.Path, "/") {
+		return "", 0, token.InvalidDSN(dsn, "missing file name")
+	}
+	q, err := token.DSNQuery(dsn, "ttl")
+	if err != nil {
+		return "", 0, err
+	}
+	ttl, err := token.DSNDuration(dsn, q, "ttl", DefaultTTL)
+	if err != nil {
+		return "", 0, err
+	}
+	return dsn.Path, ttl, nil
+}
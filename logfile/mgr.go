@@ -0,0 +1,763 @@
+package logfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/internal/telemetry"
+)
+
+// ErrNotfound not found error
+var ErrNotfound = token.ErrNotfound
+
+// DefaultTTL default ttl
+const DefaultTTL = time.Hour
+
+// compactMinDead minimum dead bytes before compaction
+const compactMinDead = 1 << 20
+
+type item struct {
+	uid    string
+	data   []byte
+	expire int64
+	size   int
+	// seq order of put in log, seen unix nanos of last verify or creation,
+	// they are kept in memory only
+	seq     uint64
+	seen    int64
+	created int64
+	meta    []byte
+	parent  string
+}
+
+func (it *item) expired(now time.Time) bool {
+	return it.expire != 0 && now.UnixNano() >= it.expire
+}
+
+// Mgr token manager, all tokens are kept in one append-only log file with an
+// in-memory index
+type Mgr struct {
+	sync.RWMutex
+	ttl   time.Duration
+	name  string
+	f     *os.File
+	size  int64
+	index map[string]*item
+	uids  map[string]map[string]struct{}
+	live  int64
+	dead  int64
+	done  chan struct{}
+	clock token.Clock
+
+	closeOnce sync.Once
+
+	observers []token.Observer
+	tel       *telemetry.Instrument
+	seq       uint64
+
+	maxSessions int
+	policy      token.SessionPolicy
+
+	// children tokens saved with Meta.Parent by parent, it is rebuilt by
+	// replay
+	children map[string]map[string]struct{}
+}
+
+// NewManager new token manager, the log is replayed on startup and the
+// damaged tail left by a crash is truncated
+func NewManager(name string, ttl time.Duration, opts ...token.Option) (*Mgr, error) {
+	opt := token.NewOptions(opts...)
+	ret := &Mgr{
+		ttl:   ttl,
+		name:  name,
+		index: make(map[string]*item),
+		uids:  make(map[string]map[string]struct{}),
+		done:  make(chan struct{}),
+		clock: opt.Clock,
+
+		observers: opt.Observers,
+
+		maxSessions: opt.MaxSessions,
+		policy:      opt.SessionPolicy,
+		tel:         telemetry.New("logfile", ""),
+
+		children: make(map[string]map[string]struct{}),
+	}
+	err := ret.open()
+	if err != nil {
+		return nil, err
+	}
+	ret.tel.Active(ret.count)
+	if opt.NoJanitor {
+		return ret, nil
+	}
+	go func() {
+		for {
+			select {
+			case <-ret.done:
+				return
+			case <-ret.clock.After(time.Minute):
+			}
+			ret.Purge()
+			ret.Lock()
+			if ret.dead >= compactMinDead && ret.dead > ret.live {
+				ret.compact()
+			}
+			ret.Unlock()
+		}
+	}()
+	return ret, nil
+}
+
+func (m *Mgr) open() error {
+	f, err := os.OpenFile(m.name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	offset, err := m.replay(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Truncate(offset)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	m.f = f
+	m.size = offset
+	return nil
+}
+
+// replay rebuild index from log, returns the offset after the last valid
+// record. A damaged tail is left by a crash while appending and is dropped,
+// damage followed by valid records returns *CorruptError.
+func (m *Mgr) replay(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	now := m.clock.Now()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		rec, size, err := readRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err == errCorrupt {
+			if !tornTail(f, offset, fi.Size()) {
+				return offset, &CorruptError{Name: m.name, Offset: offset}
+			}
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(size)
+		m.apply(rec, size, now)
+	}
+}
+
+func (m *Mgr) apply(rec record, size int, now time.Time) {
+	kids := m.children[rec.tk]
+	m.drop(rec.tk)
+	if rec.op == opDel || rec.expired(now) {
+		m.dead += int64(size)
+		return
+	}
+	m.seq++
+	created := rec.created
+	if rec.op == opPut {
+		created = now.UnixNano()
+	}
+	m.index[rec.tk] = &item{
+		uid:     rec.uid,
+		data:    rec.data,
+		expire:  rec.expire,
+		size:    size,
+		seq:     m.seq,
+		seen:    created,
+		created: created,
+		meta:    rec.meta,
+	}
+	tks := m.uids[rec.uid]
+	if tks == nil {
+		tks = make(map[string]struct{})
+		m.uids[rec.uid] = tks
+	}
+	tks[rec.tk] = struct{}{}
+	m.live += int64(size)
+	m.link(rec)
+	// children are kept when the token is saved again
+	if kids != nil {
+		m.children[rec.tk] = kids
+	}
+}
+
+// link record token of rec as child of its parent, parents which are gone
+// before are ignored
+func (m *Mgr) link(rec record) {
+	if len(rec.meta) == 0 {
+		return
+	}
+	var meta token.Meta
+	json.Unmarshal(rec.meta, &meta)
+	if len(meta.Parent) == 0 || m.index[meta.Parent] == nil {
+		return
+	}
+	m.index[rec.tk].parent = meta.Parent
+	tks := m.children[meta.Parent]
+	if tks == nil {
+		tks = make(map[string]struct{})
+		m.children[meta.Parent] = tks
+	}
+	tks[rec.tk] = struct{}{}
+}
+
+func (m *Mgr) drop(tk string) {
+	it := m.index[tk]
+	if it == nil {
+		return
+	}
+	delete(m.index, tk)
+	tks := m.uids[it.uid]
+	delete(tks, tk)
+	if len(tks) == 0 {
+		delete(m.uids, it.uid)
+	}
+	if kids := m.children[it.parent]; kids != nil {
+		delete(kids, tk)
+		if len(kids) == 0 {
+			delete(m.children, it.parent)
+		}
+	}
+	delete(m.children, tk)
+	m.live -= int64(it.size)
+	m.dead += int64(it.size)
+}
+
+func (m *Mgr) write(rec record) error {
+	buf := rec.encode()
+	_, err := m.f.Write(buf)
+	if err == nil {
+		err = m.f.Sync()
+	}
+	if err != nil {
+		// drop the torn record, otherwise replay stops in front of it
+		m.f.Truncate(m.size)
+		m.f.Seek(m.size, io.SeekStart)
+		return err
+	}
+	m.size += int64(len(buf))
+	m.apply(rec, len(buf), m.clock.Now())
+	return nil
+}
+
+// Close stop janitor and close the log, it returns os.ErrClosed when the log
+// is closed already
+func (m *Mgr) Close() error {
+	err := os.ErrClosed
+	m.closeOnce.Do(func() {
+		m.Lock()
+		defer m.Unlock()
+		close(m.done)
+		m.tel.Close()
+		err = m.f.Close()
+	})
+	return err
+}
+
+// Compact rewrite the log with live records only
+func (m *Mgr) Compact() error {
+	m.Lock()
+	defer m.Unlock()
+	return m.compact()
+}
+
+func (m *Mgr) compact() error {
+	tmp := m.name + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	now := m.clock.Now()
+	var live int64
+	for _, tk := range m.order() {
+		it := m.index[tk]
+		if it.expired(now) {
+			continue
+		}
+		buf := record{
+			op:      opSession,
+			expire:  it.expire,
+			uid:     it.uid,
+			tk:      tk,
+			data:    it.data,
+			created: it.created,
+			meta:    it.meta,
+		}.encode()
+		_, err = w.Write(buf)
+		if err != nil {
+			break
+		}
+		live += int64(len(buf))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, m.name)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	m.f.Close()
+	m.f = f
+	m.size = live
+	m.live = live
+	m.dead = 0
+	return nil
+}
+
+// order returns tokens in the order of log, parents are moved in front of
+// their children so that links are rebuilt by replay even when a parent is
+// saved again after its children
+func (m *Mgr) order() []string {
+	tks := make([]string, 0, len(m.index))
+	for tk := range m.index {
+		tks = append(tks, tk)
+	}
+	sort.Slice(tks, func(i, j int) bool {
+		return m.index[tks[i]].seq < m.index[tks[j]].seq
+	})
+	ret := make([]string, 0, len(tks))
+	seen := make(map[string]bool, len(tks))
+	var visit func(tk string)
+	visit = func(tk string) {
+		if seen[tk] {
+			return
+		}
+		seen[tk] = true
+		if p := m.index[tk].parent; len(p) > 0 && m.index[p] != nil {
+			visit(p)
+		}
+		ret = append(ret, tk)
+	}
+	for _, tk := range tks {
+		visit(tk)
+	}
+	return ret
+}
+
+func (m *Mgr) expireAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return m.clock.Now().Add(ttl).UnixNano()
+}
+
+// count returns number of tokens in index, expired tokens are counted until
+// the janitor purges them
+func (m *Mgr) count() (int64, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return int64(len(m.index)), nil
+}
+
+// emit must be called without holding the lock so that observers may call
+// back into the manager
+func (m *Mgr) emit(e token.Event) {
+	if len(m.observers) == 0 {
+		return
+	}
+	e.Time = m.clock.Now()
+	token.Notify(m.observers, e)
+}
+
+func (m *Mgr) lookup(tk string) *item {
+	it := m.index[tk]
+	if it == nil || it.expired(m.clock.Now()) {
+		return nil
+	}
+	return it
+}
+
+// Save save token
+func (m *Mgr) Save(tk token.Token) error {
+	return m.SaveSession(tk, token.Meta{})
+}
+
+// SaveSession save token with metadata
+func (m *Mgr) SaveSession(tk token.Token, meta token.Meta) error {
+	op := m.tel.Start(telemetry.OpSave)
+	err := m.save(tk, meta)
+	op.End(err == nil, err)
+	m.emit(token.Event{
+		Op:    token.OpSave,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    err == nil,
+		Err:   err,
+	})
+	return err
+}
+
+func (m *Mgr) save(tk token.Token, meta token.Meta) error {
+	data, err := tk.Serialize()
+	if err != nil {
+		return err
+	}
+	raw, err := marshalMeta(meta)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	if len(meta.Parent) > 0 && m.lookup(meta.Parent) == nil {
+		m.Unlock()
+		return ErrNotfound
+	}
+	evicted, err := m.limit(tk.GetUID(), tk.GetTK())
+	if err == nil {
+		err = m.write(record{
+			op:      opSession,
+			expire:  m.expireAt(m.ttl),
+			uid:     tk.GetUID(),
+			tk:      tk.GetTK(),
+			data:    data,
+			created: m.clock.Now().UnixNano(),
+			meta:    raw,
+		})
+	}
+	m.Unlock()
+	for _, e := range evicted {
+		m.emit(e)
+	}
+	return err
+}
+
+// marshalMeta encode meta of record, it is empty without metadata
+func marshalMeta(meta token.Meta) ([]byte, error) {
+	if meta == (token.Meta{}) {
+		return nil, nil
+	}
+	return json.Marshal(meta)
+}
+
+// Verify verify token
+func (m *Mgr) Verify(tk token.Token) (bool, error) {
+	op := m.tel.Start(telemetry.OpVerify)
+	ok, err := m.verify(tk)
+	op.End(ok, err)
+	m.emit(token.Event{
+		Op:    token.OpVerify,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    ok,
+		Err:   err,
+	})
+	return ok, err
+}
+
+func (m *Mgr) verify(tk token.Token) (bool, error) {
+	m.RLock()
+	it := m.lookup(tk.GetTK())
+	m.RUnlock()
+	if it == nil {
+		return false, nil
+	}
+	ok, err := tk.Verify(it.data)
+	if ok {
+		atomic.StoreInt64(&it.seen, m.clock.Now().UnixNano())
+	}
+	return ok, err
+}
+
+// Revoke revoke token
+func (m *Mgr) Revoke(uid, tk string) {
+	m.RevokeBy("", uid, tk)
+}
+
+// RevokeBy revoke token, actor is reported to observers
+func (m *Mgr) RevokeBy(actor, uid, tk string) {
+	op := m.tel.Start(telemetry.OpRevoke)
+	m.Lock()
+	kids := m.children[tk]
+	e, ok := m.revoke(tk)
+	events := m.revokeChildren(kids)
+	m.Unlock()
+	op.End(ok && e.OK, e.Err)
+	if ok {
+		e.Actor = actor
+		m.emit(e)
+	}
+	for _, e := range events {
+		e.Actor = actor
+		m.emit(e)
+	}
+}
+
+// revokeChildren revoke tokens of kids and their descendants, returns the
+// events to report
+func (m *Mgr) revokeChildren(kids map[string]struct{}) []token.Event {
+	var events []token.Event
+	for tk := range kids {
+		grandkids := m.children[tk]
+		e, ok := m.revoke(tk)
+		if ok {
+			events = append(events, e)
+		}
+		events = append(events, m.revokeChildren(grandkids)...)
+	}
+	return events
+}
+
+// revoke returns the event to report and false when tk is unknown
+func (m *Mgr) revoke(tk string) (token.Event, bool) {
+	it := m.index[tk]
+	if it == nil {
+		return token.Event{}, false
+	}
+	err := m.write(record{op: opDel, uid: it.uid, tk: tk})
+	return token.Event{
+		Op:    token.OpRevoke,
+		UID:   it.uid,
+		Token: tk,
+		OK:    err == nil,
+		Err:   err,
+	}, true
+}
+
+// Get get token by uid
+func (m *Mgr) Get(uid string, tk token.Token) error {
+	op := m.tel.Start(telemetry.OpGet)
+	err := m.get(uid, tk)
+	op.End(err == nil, err)
+	return err
+}
+
+func (m *Mgr) get(uid string, tk token.Token) error {
+	m.RLock()
+	now := m.clock.Now()
+	var tks []string
+	for t := range m.uids[uid] {
+		if !m.index[t].expired(now) {
+			tks = append(tks, t)
+		}
+	}
+	if len(tks) == 0 {
+		m.RUnlock()
+		return ErrNotfound
+	}
+	sort.Strings(tks)
+	data := m.index[tks[0]].data
+	m.RUnlock()
+	return tk.UnSerialize(tks[0], data)
+}
+
+func (m *Mgr) entry(tk string, it *item) token.Entry {
+	e := token.Entry{
+		UID:   it.uid,
+		Token: tk,
+		Data:  it.data,
+	}
+	if it.expire != 0 {
+		e.TTL = time.Unix(0, it.expire).Sub(m.clock.Now())
+	}
+	if len(it.meta) > 0 {
+		json.Unmarshal(it.meta, &e.Meta)
+	}
+	return e
+}
+
+// Walk walk all tokens which are not expired
+func (m *Mgr) Walk(fn func(token.Entry) error) error {
+	m.RLock()
+	now := m.clock.Now()
+	list := make([]token.Entry, 0, len(m.index))
+	for tk, it := range m.index {
+		if !it.expired(now) {
+			list = append(list, m.entry(tk, it))
+		}
+	}
+	m.RUnlock()
+	for _, e := range list {
+		err := fn(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup get raw entry by token
+func (m *Mgr) Lookup(tk string) (token.Entry, error) {
+	m.RLock()
+	defer m.RUnlock()
+	it := m.lookup(tk)
+	if it == nil {
+		return token.Entry{}, ErrNotfound
+	}
+	return m.entry(tk, it), nil
+}
+
+// RevokeUID revoke all tokens of uid
+func (m *Mgr) RevokeUID(uid string) error {
+	return m.RevokeUIDBy("", uid)
+}
+
+// RevokeUIDBy revoke all tokens of uid, actor is reported to observers
+func (m *Mgr) RevokeUIDBy(actor, uid string) error {
+	var events []token.Event
+	var err error
+	m.Lock()
+	for tk := range m.uids[uid] {
+		kids := m.children[tk]
+		e, _ := m.revoke(tk)
+		events = append(events, e)
+		if e.Err != nil {
+			err = e.Err
+			break
+		}
+		events = append(events, m.revokeChildren(kids)...)
+	}
+	m.Unlock()
+	for _, e := range events {
+		e.Actor = actor
+		m.emit(e)
+	}
+	return err
+}
+
+// Children returns tokens saved with tk as parent which are not revoked or
+// expired, ordered by token
+func (m *Mgr) Children(tk string) ([]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	ret := []string{}
+	for child := range m.children[tk] {
+		if m.lookup(child) != nil {
+			ret = append(ret, child)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Purge drop expired tokens from index and revoke their children, records
+// are removed from the log by the next compaction, returns the number of
+// purged tokens
+func (m *Mgr) Purge() (int, error) {
+	var events []token.Event
+	m.Lock()
+	now := m.clock.Now()
+	var cnt int
+	for tk, it := range m.index {
+		if it.expired(now) {
+			cnt++
+			events = append(events, token.Event{
+				Op:    token.OpExpire,
+				UID:   it.uid,
+				Token: tk,
+				OK:    true,
+			})
+			kids := m.children[tk]
+			m.drop(tk)
+			events = append(events, m.revokeChildren(kids)...)
+		}
+	}
+	m.Unlock()
+	for _, e := range events {
+		m.emit(e)
+	}
+	m.tel.Evicted(cnt)
+	return cnt, nil
+}
+
+// Restore restore raw entry with its metadata and remaining ttl,
+// ErrNotfound is returned when the parent of entry does not exist
+func (m *Mgr) Restore(e token.Entry) error {
+	raw, err := marshalMeta(e.Meta)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(e.Meta.Parent) > 0 && m.lookup(e.Meta.Parent) == nil {
+		return ErrNotfound
+	}
+	return m.write(record{
+		op:      opSession,
+		expire:  m.expireAt(e.TTL),
+		uid:     e.UID,
+		tk:      e.Token,
+		data:    e.Data,
+		created: m.clock.Now().UnixNano(),
+		meta:    raw,
+	})
+}
+
+// Rewrite replace payload of token in place, expiry, creation, metadata,
+// last seen time and children are kept
+func (m *Mgr) Rewrite(tk string, data []byte) error {
+	return m.update(tk, func(rec *record) {
+		rec.data = data
+	})
+}
+
+// Expire set remaining ttl of token, zero ttl means the token never expires
+func (m *Mgr) Expire(tk string, ttl time.Duration) error {
+	return m.update(tk, func(rec *record) {
+		rec.expire = m.expireAt(ttl)
+	})
+}
+
+// update write record of token changed by fn, creation and last seen time
+// are kept
+func (m *Mgr) update(tk string, fn func(*record)) error {
+	m.Lock()
+	defer m.Unlock()
+	it := m.lookup(tk)
+	if it == nil {
+		return ErrNotfound
+	}
+	rec := record{
+		op:      opSession,
+		expire:  it.expire,
+		uid:     it.uid,
+		tk:      tk,
+		data:    it.data,
+		created: it.created,
+		meta:    it.meta,
+	}
+	fn(&rec)
+	err := m.write(rec)
+	if err != nil {
+		return err
+	}
+	m.index[tk].seen = atomic.LoadInt64(&it.seen)
+	return nil
+}
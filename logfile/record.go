@@ -0,0 +1,214 @@
+package logfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	opPut byte = iota + 1
+	opDel
+	// opSession put with creation time and session metadata
+	opSession
+)
+
+// headerSize crc32 and length of body
+const headerSize = 8
+
+// maxRecordSize upper bound of record body, larger length means corruption
+const maxRecordSize = 64 << 20
+
+var errCorrupt = errors.New("corrupt record")
+
+// CorruptError damaged record in the middle of log, valid records follow it
+// so the log is left untouched for repair or restore from backup
+type CorruptError struct {
+	Name   string
+	Offset int64
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("logfile: corrupt record at offset %d of %s", e.Offset, e.Name)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record one entry in log
+//
+//	| crc32 (4) | length (4) | op (1) | expire (8) | uid | token | data |
+//
+// uid, token and data are prefixed by their uvarint length, crc32 covers the
+// body after the header and expire is unix nanoseconds where zero means the
+// record never expires. opSession records are followed by
+//
+//	| created (8) | meta |
+//
+// where created is unix nanoseconds and meta is json prefixed by its uvarint
+// length, it is empty when there is no metadata
+type record struct {
+	op      byte
+	expire  int64
+	uid     string
+	tk      string
+	data    []byte
+	created int64
+	meta    []byte
+}
+
+func (r record) expired(now time.Time) bool {
+	return r.expire != 0 && now.UnixNano() >= r.expire
+}
+
+func (r record) encode() []byte {
+	body := make([]byte, 0, 1+8+3*binary.MaxVarintLen64+len(r.uid)+len(r.tk)+len(r.data))
+	body = append(body, r.op)
+	body = appendUint64(body, uint64(r.expire))
+	body = appendBytes(body, []byte(r.uid))
+	body = appendBytes(body, []byte(r.tk))
+	body = appendBytes(body, r.data)
+	if r.op == opSession {
+		body = appendUint64(body, uint64(r.created))
+		body = appendBytes(body, r.meta)
+	}
+	buf := make([]byte, headerSize, headerSize+len(body))
+	binary.LittleEndian.PutUint32(buf[0:], crc32.Checksum(body, crcTable))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(body)))
+	return append(buf, body...)
+}
+
+func appendUint64(buf []byte, n uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	return append(buf, b[:]...)
+}
+
+func appendBytes(buf, data []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(len(data)))
+	buf = append(buf, b[:n]...)
+	return append(buf, data...)
+}
+
+// readRecord read next record, returns io.EOF at the end of log and
+// errCorrupt for torn or damaged records, size is the encoded size
+func readRecord(r *bufio.Reader) (record, int, error) {
+	var hdr [headerSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err == io.EOF {
+		return record{}, 0, io.EOF
+	}
+	if err != nil {
+		return record{}, 0, errCorrupt
+	}
+	sum := binary.LittleEndian.Uint32(hdr[0:])
+	size := binary.LittleEndian.Uint32(hdr[4:])
+	if size > maxRecordSize {
+		return record{}, 0, errCorrupt
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return record{}, 0, errCorrupt
+	}
+	if crc32.Checksum(body, crcTable) != sum {
+		return record{}, 0, errCorrupt
+	}
+	rec, err := decode(body)
+	if err != nil {
+		return record{}, 0, err
+	}
+	return rec, headerSize + int(size), nil
+}
+
+func decode(body []byte) (record, error) {
+	var rec record
+	if len(body) < 9 {
+		return rec, errCorrupt
+	}
+	rec.op = body[0]
+	if rec.op != opPut && rec.op != opDel && rec.op != opSession {
+		return rec, errCorrupt
+	}
+	rec.expire = int64(binary.LittleEndian.Uint64(body[1:]))
+	body = body[9:]
+	var fields [4][]byte
+	for i := 0; i < 3; i++ {
+		fields[i], body = readBytes(body)
+		if fields[i] == nil {
+			return rec, errCorrupt
+		}
+	}
+	if rec.op == opSession {
+		if len(body) < 8 {
+			return rec, errCorrupt
+		}
+		rec.created = int64(binary.LittleEndian.Uint64(body))
+		fields[3], body = readBytes(body[8:])
+		if fields[3] == nil {
+			return rec, errCorrupt
+		}
+		if len(fields[3]) > 0 {
+			rec.meta = append([]byte(nil), fields[3]...)
+		}
+	}
+	if len(body) != 0 {
+		return rec, errCorrupt
+	}
+	rec.uid = string(fields[0])
+	rec.tk = string(fields[1])
+	if len(fields[2]) > 0 {
+		rec.data = append([]byte(nil), fields[2]...)
+	}
+	return rec, nil
+}
+
+// readBytes read uvarint length prefixed field, returns nil field when body
+// is too short
+func readBytes(body []byte) ([]byte, []byte) {
+	size, n := binary.Uvarint(body)
+	if n <= 0 || uint64(len(body)-n) < size {
+		return nil, body
+	}
+	return body[n : n+int(size) : n+int(size)], body[n+int(size):]
+}
+
+// recordAt returns whether a valid record starts at offset of f, end is the
+// size of f
+func recordAt(f *os.File, offset, end int64) bool {
+	var hdr [headerSize]byte
+	_, err := f.ReadAt(hdr[:], offset)
+	if err != nil {
+		return false
+	}
+	size := int64(binary.LittleEndian.Uint32(hdr[4:]))
+	if size > maxRecordSize || offset+headerSize+size > end {
+		return false
+	}
+	body := make([]byte, size)
+	_, err = f.ReadAt(body, offset+headerSize)
+	if err != nil {
+		return false
+	}
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(hdr[0:]) {
+		return false
+	}
+	_, err = decode(body)
+	return err == nil
+}
+
+// tornTail returns whether damaged data from offset to end is the tail left
+// by an interrupted write, that is no valid record starts after offset
+func tornTail(f *os.File, offset, end int64) bool {
+	for off := offset + 1; off+headerSize <= end; off++ {
+		if recordAt(f, off, end) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package logfile
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// limit make room for new token tk of uid, it must be called with the lock
+// held, returns the events of evicted tokens
+func (m *Mgr) limit(uid, tk string) ([]token.Event, error) {
+	if m.maxSessions <= 0 {
+		return nil, nil
+	}
+	now := m.clock.Now()
+	var list []string
+	for t := range m.uids[uid] {
+		// saving again is not a new session
+		if t != tk && !m.index[t].expired(now) {
+			list = append(list, t)
+		}
+	}
+	over := len(list) - m.maxSessions + 1
+	if over <= 0 {
+		return nil, nil
+	}
+	switch m.policy {
+	case token.EvictOldest:
+		sort.Slice(list, func(i, j int) bool {
+			return m.index[list[i]].seq < m.index[list[j]].seq
+		})
+	case token.EvictLRU:
+		sort.Slice(list, func(i, j int) bool {
+			a, b := m.index[list[i]], m.index[list[j]]
+			sa, sb := atomic.LoadInt64(&a.seen), atomic.LoadInt64(&b.seen)
+			if sa != sb {
+				return sa < sb
+			}
+			return a.seq < b.seq
+		})
+	default:
+		return nil, token.ErrSessionLimit
+	}
+	var events []token.Event
+	for _, t := range list[:over] {
+		kids := m.children[t]
+		e, _ := m.revoke(t)
+		e.Op = token.OpEvict
+		e.Actor = uid
+		events = append(events, e)
+		if e.Err != nil {
+			return events, e.Err
+		}
+		for _, e := range m.revokeChildren(kids) {
+			e.Actor = uid
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *Mgr) session(tk string, it *item) token.Session {
+	ret := token.Session{
+		UID:      it.uid,
+		Token:    tk,
+		Created:  time.Unix(0, it.created),
+		LastSeen: time.Unix(0, atomic.LoadInt64(&it.seen)),
+	}
+	if len(it.meta) > 0 {
+		json.Unmarshal(it.meta, &ret.Meta)
+	}
+	if it.expire != 0 {
+		ret.TTL = time.Unix(0, it.expire).Sub(m.clock.Now())
+	}
+	return ret
+}
+
+// Session get session by token
+func (m *Mgr) Session(tk string) (token.Session, error) {
+	m.RLock()
+	defer m.RUnlock()
+	it := m.lookup(tk)
+	if it == nil {
+		return token.Session{}, ErrNotfound
+	}
+	return m.session(tk, it), nil
+}
+
+// Sessions list sessions of uid which are not expired, ordered by creation
+func (m *Mgr) Sessions(uid string) ([]token.Session, error) {
+	m.RLock()
+	defer m.RUnlock()
+	now := m.clock.Now()
+	var tks []string
+	for tk := range m.uids[uid] {
+		if !m.index[tk].expired(now) {
+			tks = append(tks, tk)
+		}
+	}
+	sort.Slice(tks, func(i, j int) bool {
+		return m.index[tks[i]].seq < m.index[tks[j]].seq
+	})
+	ret := make([]token.Session, 0, len(tks))
+	for _, tk := range tks {
+		ret = append(ret, m.session(tk, m.index[tk]))
+	}
+	return ret, nil
+}
@@ -0,0 +1,798 @@
+package logfile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/tokentest"
+)
+
+func TestLogfileToken(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "tokens.log")
+	mgr, err := NewManager(name, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("2", "world")
+	var tk3 tokentest.Token
+
+	err = mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	err = mgr.Save(tk2)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil {
+		t.Fatalf("unexpected verify token: %v", err)
+	}
+	if !ok {
+		t.Fatal("verify token failed: tk1")
+	}
+	err = mgr.Get(tk1.Uid, &tk3)
+	if err != nil {
+		t.Fatalf("get token by tk1.Uid failed: %v", err)
+	}
+	if tk1.Name != tk3.Name {
+		t.Fatalf("unexpected name between tk1 and tk3")
+	}
+	mgr.Revoke(tk1.Uid, tk1.Token)
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil {
+		t.Fatalf("unexpected verify token: %v", err)
+	}
+	if ok {
+		t.Fatal("unxepected verify token success: tk1")
+	}
+	err = mgr.Close()
+	if err != nil {
+		t.Fatalf("unexpected close log: %v", err)
+	}
+
+	// simulate a torn write
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	f.Close()
+
+	mgr, err = NewManager(name, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected replay log: %v", err)
+	}
+	defer mgr.Close()
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || ok {
+		t.Fatalf("unexpected revoked token after replay: %v", err)
+	}
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk2.Token})
+	if err != nil || !ok {
+		t.Fatalf("verify token failed after replay: %v", err)
+	}
+	err = mgr.Save(tokentest.NewToken("3", "hello"))
+	if err != nil {
+		t.Fatalf("unexpected save token after replay: %v", err)
+	}
+
+	err = mgr.Compact()
+	if err != nil {
+		t.Fatalf("unexpected compact: %v", err)
+	}
+	var cnt int
+	mgr.Walk(func(token.Entry) error {
+		cnt++
+		return nil
+	})
+	if cnt != 2 {
+		t.Fatalf("unexpected tokens after compact: %d", cnt)
+	}
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk2.Token})
+	if err != nil || !ok {
+		t.Fatalf("verify token failed after compact: %v", err)
+	}
+
+	// compacted log is replayed
+	err = mgr.Close()
+	if err != nil {
+		t.Fatalf("unexpected close log: %v", err)
+	}
+	if err = mgr.Close(); err != os.ErrClosed {
+		t.Fatalf("unexpected close twice: %v", err)
+	}
+	mgr, err = NewManager(name, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected replay compacted log: %v", err)
+	}
+	defer mgr.Close()
+	cnt = 0
+	mgr.Walk(func(token.Entry) error {
+		cnt++
+		return nil
+	})
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk2.Token})
+	if cnt != 2 || err != nil || !ok {
+		t.Fatalf("unexpected tokens after replay of compacted log: %d %v", cnt, err)
+	}
+}
+
+func TestLogfileCorrupt(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "tokens.log")
+	mgr, err := NewManager(name, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	var sizes []int64
+	for i := 0; i < 3; i++ {
+		mgr.Save(tokentest.NewToken("1", "hello"))
+		fi, _ := os.Stat(name)
+		sizes = append(sizes, fi.Size())
+	}
+	mgr.Close()
+
+	// damage the body of the second record
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unexpected read log: %v", err)
+	}
+	data[sizes[0]+headerSize+2] ^= 0xff
+	err = ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		t.Fatalf("unexpected write log: %v", err)
+	}
+	_, err = NewManager(name, time.Minute)
+	if e, ok := err.(*CorruptError); !ok || e.Offset != sizes[0] {
+		t.Fatalf("unexpected open of log corrupt in the middle: %v", err)
+	}
+	fi, _ := os.Stat(name)
+	if fi.Size() != sizes[2] {
+		t.Fatalf("log corrupt in the middle is truncated: %d", fi.Size())
+	}
+
+	// damage of the last record is a torn write
+	data[sizes[0]+headerSize+2] ^= 0xff
+	data[sizes[1]+headerSize+2] ^= 0xff
+	ioutil.WriteFile(name, data, 0644)
+	mgr, err = NewManager(name, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected open log with torn tail: %v", err)
+	}
+	defer mgr.Close()
+	var cnt int
+	mgr.Walk(func(token.Entry) error {
+		cnt++
+		return nil
+	})
+	fi, _ = os.Stat(name)
+	if cnt != 2 || fi.Size() != sizes[1] {
+		t.Fatalf("unexpected replay of torn tail: %d tokens, %d bytes", cnt, fi.Size())
+	}
+}
+
+func TestLogfileExpire(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	name := filepath.Join(t.TempDir(), "tokens.log")
+	mgr, err := NewManager(name, time.Minute, token.WithClock(clk))
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	defer mgr.Close()
+	tk1 := tokentest.NewToken("1", "hello")
+	err = mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.BlockUntil(1)
+	clk.Add(time.Minute + 10*time.Second)
+	clk.BlockUntil(1)
+	ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil {
+		t.Fatalf("unexpected verify token: %v", err)
+	}
+	if ok {
+		t.Fatal("unxepected verify token success: tk1")
+	}
+	mgr.RLock()
+	n := len(mgr.index)
+	mgr.RUnlock()
+	if n != 0 {
+		t.Fatalf("unexpected index size after janitor: %d", n)
+	}
+}
+
+func testSessionLimit(t *testing.T, newMgr func(...token.Option) token.Manager) {
+	save := func(mgr token.Manager, clk *tokentest.Clock, uid string) *tokentest.Token {
+		tk := tokentest.NewToken(uid, "hello")
+		err := mgr.Save(tk)
+		if err != nil {
+			t.Fatalf("unexpected save token: %v", err)
+		}
+		clk.Add(time.Second)
+		return tk
+	}
+	verify := func(mgr token.Manager, tk1 *tokentest.Token) bool {
+		ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+		if err != nil {
+			t.Fatalf("unexpected verify token: %v", err)
+		}
+		return ok
+	}
+
+	clk := tokentest.NewClock(time.Now())
+	mgr := newMgr(token.WithClock(clk), token.WithSessionLimit(2, token.RejectNew))
+	save(mgr, clk, "1")
+	save(mgr, clk, "1")
+	err := mgr.Save(tokentest.NewToken("1", "hello"))
+	if err != token.ErrSessionLimit {
+		t.Fatalf("unexpected save over limit: %v", err)
+	}
+	save(mgr, clk, "2")
+
+	clk = tokentest.NewClock(time.Now())
+	mgr = newMgr(token.WithClock(clk), token.WithSessionLimit(2, token.EvictOldest))
+	tk1 := save(mgr, clk, "1")
+	tk2 := save(mgr, clk, "1")
+	verify(mgr, tk1)
+	tk3 := save(mgr, clk, "1")
+	if verify(mgr, tk1) || !verify(mgr, tk2) || !verify(mgr, tk3) {
+		t.Fatal("oldest token is not evicted")
+	}
+
+	clk = tokentest.NewClock(time.Now())
+	mgr = newMgr(token.WithClock(clk), token.WithSessionLimit(2, token.EvictLRU))
+	tk1 = save(mgr, clk, "1")
+	tk2 = save(mgr, clk, "1")
+	verify(mgr, tk1)
+	clk.Add(time.Second)
+	tk3 = save(mgr, clk, "1")
+	if !verify(mgr, tk1) || verify(mgr, tk2) || !verify(mgr, tk3) {
+		t.Fatal("least recently used token is not evicted")
+	}
+}
+
+func testSessionLimitConcurrent(t *testing.T, mgr token.Manager) {
+	var wg sync.WaitGroup
+	var saved int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := mgr.Save(tokentest.NewToken("1", "hello"))
+			if err == nil {
+				atomic.AddInt32(&saved, 1)
+			} else if err != token.ErrSessionLimit {
+				t.Errorf("unexpected save token: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if saved != 3 {
+		t.Fatalf("unexpected saved tokens: %d", saved)
+	}
+}
+
+func TestLogfileSessionLimit(t *testing.T) {
+	open := func(opts ...token.Option) token.Manager {
+		mgr, err := NewManager(filepath.Join(t.TempDir(), "tokens.log"), time.Hour, opts...)
+		if err != nil {
+			t.Fatalf("unexpected open log: %v", err)
+		}
+		t.Cleanup(func() {
+			mgr.Close()
+		})
+		return mgr
+	}
+	testSessionLimit(t, open)
+	testSessionLimitConcurrent(t, open(token.WithSessionLimit(3, token.RejectNew)))
+}
+
+func testSessions(t *testing.T, mgr token.SessionManager, clk *tokentest.Clock) {
+	near := func(a, b time.Time) bool {
+		d := a.Sub(b)
+		return d > -time.Millisecond && d < time.Millisecond
+	}
+	meta := token.Meta{IP: "10.0.0.1", UserAgent: "curl/7.68.0", Device: "laptop"}
+	tk1 := tokentest.NewToken("1", "hello")
+	tk2 := tokentest.NewToken("1", "world")
+	created := clk.Now()
+	err := mgr.SaveSession(tk1, meta)
+	if err != nil {
+		t.Fatalf("unexpected save session: %v", err)
+	}
+	clk.Add(time.Second)
+	err = mgr.Save(tk2)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.Add(time.Second)
+	seen := clk.Now()
+	ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || !ok {
+		t.Fatalf("verify token failed: %v", err)
+	}
+
+	list, err := mgr.Sessions("1")
+	if err != nil {
+		t.Fatalf("unexpected list sessions: %v", err)
+	}
+	if len(list) != 2 || list[0].Token != tk1.Token || list[1].Token != tk2.Token {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+	if list[0].UID != "1" || list[0].Meta != meta {
+		t.Fatalf("unexpected metadata: %+v", list[0])
+	}
+	if !near(list[0].Created, created) || !near(list[0].LastSeen, seen) {
+		t.Fatalf("unexpected times of tk1: %s %s", list[0].Created, list[0].LastSeen)
+	}
+	if list[1].Meta != (token.Meta{}) || !near(list[1].LastSeen, list[1].Created) {
+		t.Fatalf("unexpected session of tk2: %+v", list[1])
+	}
+	if list[0].TTL <= 0 {
+		t.Fatalf("unexpected ttl: %s", list[0].TTL)
+	}
+
+	s, err := mgr.Session(tk1.Token)
+	if err != nil || s.Meta != meta || s.UID != "1" {
+		t.Fatalf("unexpected get session: %+v %v", s, err)
+	}
+	mgr.Revoke(tk1.Uid, tk1.Token)
+	_, err = mgr.Session(tk1.Token)
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected get revoked session: %v", err)
+	}
+	list, err = mgr.Sessions("1")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("unexpected sessions after revoke: %d %v", len(list), err)
+	}
+}
+
+func TestLogfileSessions(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	name := filepath.Join(t.TempDir(), "tokens.log")
+	mgr, err := NewManager(name, time.Hour, token.WithClock(clk))
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	testSessions(t, mgr, clk)
+	tk1 := tokentest.NewToken("2", "hello")
+	err = mgr.SaveSession(tk1, token.Meta{Device: "phone"})
+	if err != nil {
+		t.Fatalf("unexpected save session: %v", err)
+	}
+	mgr.Close()
+
+	mgr, err = NewManager(name, time.Hour, token.WithClock(clk))
+	if err != nil {
+		t.Fatalf("unexpected reopen log: %v", err)
+	}
+	defer mgr.Close()
+	s, err := mgr.Session(tk1.Token)
+	if err != nil || s.Meta.Device != "phone" {
+		t.Fatalf("metadata is lost after reopen: %+v %v", s, err)
+	}
+	err = mgr.Compact()
+	if err != nil {
+		t.Fatalf("unexpected compact: %v", err)
+	}
+	list, err := mgr.Sessions("1")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("unexpected sessions after compact: %d %v", len(list), err)
+	}
+}
+
+func testConsume(t *testing.T, mgr token.OneTimeManager, clk *tokentest.Clock) {
+	tk1 := tokentest.NewToken("1", "reset")
+	err := mgr.SaveSession(tk1, token.Meta{Purpose: "reset"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	ok, err := mgr.VerifyAndConsume(&tokentest.Token{Token: tk1.Token}, "verify_email")
+	if err != token.ErrPurpose || ok {
+		t.Fatalf("unexpected consume for other purpose: %v", err)
+	}
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || !ok {
+		t.Fatalf("token is consumed by other purpose: %v", err)
+	}
+	dst := &tokentest.Token{Token: tk1.Token}
+	ok, err = mgr.VerifyAndConsume(dst, "reset")
+	if err != nil || !ok || dst.Name != "reset" {
+		t.Fatalf("consume failed: %v", err)
+	}
+	ok, err = mgr.VerifyAndConsume(&tokentest.Token{Token: tk1.Token}, "reset")
+	if err != nil || ok {
+		t.Fatalf("unexpected consume twice: %v", err)
+	}
+	ok, err = mgr.Verify(&tokentest.Token{Token: tk1.Token})
+	if err != nil || ok {
+		t.Fatalf("unexpected verify of consumed token: %v", err)
+	}
+	list, err := mgr.Sessions("1")
+	if err != nil || len(list) != 0 {
+		t.Fatalf("unexpected sessions after consume: %d %v", len(list), err)
+	}
+
+	tk2 := tokentest.NewToken("2", "verify")
+	err = mgr.SaveSession(tk2, token.Meta{Purpose: "verify_email"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	var wg sync.WaitGroup
+	var consumed int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := mgr.VerifyAndConsume(&tokentest.Token{Token: tk2.Token}, "verify_email")
+			if err != nil {
+				t.Errorf("unexpected consume: %v", err)
+			}
+			if ok {
+				atomic.AddInt32(&consumed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed != 1 {
+		t.Fatalf("unexpected concurrent consumes: %d", consumed)
+	}
+
+	tk3 := tokentest.NewToken("3", "expired")
+	err = mgr.SaveSession(tk3, token.Meta{Purpose: "reset"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.Add(2 * time.Hour)
+	ok, err = mgr.VerifyAndConsume(&tokentest.Token{Token: tk3.Token}, "reset")
+	if err != nil || ok {
+		t.Fatalf("unexpected consume of expired token: %v", err)
+	}
+}
+
+func TestLogfileConsume(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	name := filepath.Join(t.TempDir(), "tokens.log")
+	mgr, err := NewManager(name, time.Hour, token.WithClock(clk))
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	defer mgr.Close()
+	testConsume(t, mgr, clk)
+}
+
+func testChildren(t *testing.T, mgr *Mgr) {
+	verify := func(tk1 *tokentest.Token) bool {
+		ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+		if err != nil {
+			t.Fatalf("unexpected verify: %v", err)
+		}
+		return ok
+	}
+	children := func(tk1 *tokentest.Token, want ...*tokentest.Token) {
+		t.Helper()
+		list, err := mgr.Children(tk1.Token)
+		if err != nil {
+			t.Fatalf("unexpected children: %v", err)
+		}
+		tks := make([]string, 0, len(want))
+		for _, tk := range want {
+			tks = append(tks, tk.Token)
+		}
+		sort.Strings(tks)
+		if fmt.Sprint(list) != fmt.Sprint(tks) {
+			t.Fatalf("unexpected children of %s: %v, want %v", tk1.Token, list, tks)
+		}
+	}
+	save := func(tk1, parent *tokentest.Token) {
+		err := mgr.SaveSession(tk1, token.Meta{Parent: parent.Token})
+		if err != nil {
+			t.Fatalf("unexpected save child: %v", err)
+		}
+	}
+
+	parent := tokentest.NewToken("1", "session")
+	err := mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	job1 := tokentest.NewToken("1", "job1")
+	job2 := tokentest.NewToken("2", "job2")
+	step := tokentest.NewToken("1", "step")
+	save(job1, parent)
+	save(job2, parent)
+	save(step, job1)
+	orphan := tokentest.NewToken("1", "orphan")
+	err = mgr.SaveSession(orphan, token.Meta{Parent: tokentest.NewToken("1", "missing").Token})
+	if err != token.ErrNotfound || verify(orphan) {
+		t.Fatalf("unexpected save with missing parent: %v", err)
+	}
+	s, err := mgr.Session(step.Token)
+	if err != nil || s.Meta.Parent != job1.Token {
+		t.Fatalf("unexpected session of child: %+v %v", s, err)
+	}
+	children(parent, job1, job2)
+	children(job1, step)
+
+	mgr.Revoke("2", job2.Token)
+	children(parent, job1)
+	mgr.Revoke("1", parent.Token)
+	for _, tk := range []*tokentest.Token{parent, job1, step} {
+		if verify(tk) {
+			t.Fatalf("token %s is not revoked with its parent", tk.Name)
+		}
+	}
+	children(parent)
+	children(job1)
+
+	// children of other uid are revoked by RevokeUID
+	parent = tokentest.NewToken("3", "session")
+	err = mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	job1 = tokentest.NewToken("4", "job1")
+	save(job1, parent)
+	err = mgr.RevokeUID("3")
+	if err != nil {
+		t.Fatalf("unexpected revoke uid: %v", err)
+	}
+	if verify(job1) {
+		t.Fatal("child is not revoked with its parent uid")
+	}
+}
+
+func TestLogfileChildren(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "tokens.log")
+	mgr, err := NewManager(name, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	testChildren(t, mgr)
+
+	// relationships are rebuilt by replay of compacted log, the parent is
+	// saved again after its child
+	parent := tokentest.NewToken("1", "session")
+	child := tokentest.NewToken("1", "job")
+	mgr.Save(parent)
+	mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	mgr.Save(parent)
+	list, err := mgr.Children(parent.Token)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("unexpected children after saving parent again: %v %v", list, err)
+	}
+	err = mgr.Compact()
+	if err != nil {
+		t.Fatalf("unexpected compact: %v", err)
+	}
+	mgr.Close()
+	mgr, err = NewManager(name, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected reopen log: %v", err)
+	}
+	defer mgr.Close()
+	list, err = mgr.Children(parent.Token)
+	if err != nil || len(list) != 1 || list[0] != child.Token {
+		t.Fatalf("unexpected children after replay: %v %v", list, err)
+	}
+	mgr.Revoke("1", parent.Token)
+	ok, err := mgr.Verify(&tokentest.Token{Token: child.Token})
+	if err != nil || ok {
+		t.Fatalf("child is not revoked after replay: %v", err)
+	}
+}
+
+// testCascade children are revoked when their parent is consumed, evicted
+// or expired
+func testCascade(t *testing.T, clk *tokentest.Clock, newMgr func(...token.Option) *Mgr) {
+	verify := func(mgr *Mgr, tk1 *tokentest.Token) bool {
+		ok, err := mgr.Verify(&tokentest.Token{Token: tk1.Token})
+		if err != nil {
+			t.Fatalf("unexpected verify: %v", err)
+		}
+		return ok
+	}
+	mgr := newMgr()
+	parent := tokentest.NewToken("1", "reset")
+	err := mgr.SaveSession(parent, token.Meta{Purpose: "reset"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	child := tokentest.NewToken("2", "job")
+	err = mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	if err != nil {
+		t.Fatalf("unexpected save child: %v", err)
+	}
+	ok, err := mgr.VerifyAndConsume(&tokentest.Token{Token: parent.Token}, "reset")
+	if err != nil || !ok {
+		t.Fatalf("unexpected consume: %v %v", ok, err)
+	}
+	if verify(mgr, child) {
+		t.Fatal("child is not revoked with its consumed parent")
+	}
+
+	mgr = newMgr(token.WithSessionLimit(1, token.EvictOldest))
+	parent = tokentest.NewToken("1", "session")
+	err = mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	child = tokentest.NewToken("2", "job")
+	err = mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	if err != nil {
+		t.Fatalf("unexpected save child: %v", err)
+	}
+	err = mgr.Save(tokentest.NewToken("1", "session"))
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	if verify(mgr, parent) || verify(mgr, child) {
+		t.Fatal("child is not revoked with its evicted parent")
+	}
+
+	mgr = newMgr(token.WithClock(clk), token.WithoutJanitor())
+	parent = tokentest.NewToken("1", "session")
+	err = mgr.Save(parent)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	err = mgr.Expire(parent.Token, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected expire: %v", err)
+	}
+	child = tokentest.NewToken("2", "job")
+	err = mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	if err != nil {
+		t.Fatalf("unexpected save child: %v", err)
+	}
+	clk.Add(2 * time.Minute)
+	_, err = mgr.Purge()
+	if err != nil {
+		t.Fatalf("unexpected purge: %v", err)
+	}
+	if verify(mgr, child) {
+		t.Fatal("child is not revoked with its expired parent")
+	}
+}
+
+func TestLogfileCascade(t *testing.T) {
+	testCascade(t, tokentest.NewClock(time.Now()), func(opts ...token.Option) *Mgr {
+		mgr, err := NewManager(filepath.Join(t.TempDir(), "tokens.log"), time.Hour, opts...)
+		if err != nil {
+			t.Fatalf("unexpected open log: %v", err)
+		}
+		t.Cleanup(func() {
+			mgr.Close()
+		})
+		return mgr
+	})
+}
+
+func TestLogfileUpdate(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	mgr, err := NewManager(filepath.Join(t.TempDir(), "tokens.log"), time.Hour,
+		token.WithClock(clk), token.WithoutJanitor())
+	if err != nil {
+		t.Fatalf("unexpected open log: %v", err)
+	}
+	defer mgr.Close()
+	parent := tokentest.NewToken("1", "session")
+	child := tokentest.NewToken("1", "job")
+	err = mgr.SaveSession(parent, token.Meta{Device: "phone"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	err = mgr.SaveSession(child, token.Meta{Parent: parent.Token})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	clk.Add(time.Minute)
+	mgr.Verify(&tokentest.Token{Token: parent.Token})
+	before, err := mgr.Session(parent.Token)
+	if err != nil {
+		t.Fatalf("unexpected session: %v", err)
+	}
+	clk.Add(time.Minute)
+	err = mgr.Rewrite(parent.Token, []byte(`{"Token":"`+parent.Token+`","Name":"rewritten"}`))
+	if err != nil {
+		t.Fatalf("unexpected rewrite: %v", err)
+	}
+	after, err := mgr.Session(parent.Token)
+	if err != nil {
+		t.Fatalf("unexpected session after rewrite: %v", err)
+	}
+	if !after.Created.Equal(before.Created) || !after.LastSeen.Equal(before.LastSeen) ||
+		after.TTL != before.TTL-time.Minute || after.Meta != before.Meta {
+		t.Fatalf("unexpected session after rewrite: %+v, before %+v", after, before)
+	}
+	e, err := mgr.Lookup(parent.Token)
+	if err != nil || !bytes.Contains(e.Data, []byte("rewritten")) {
+		t.Fatalf("unexpected payload after rewrite: %s %v", e.Data, err)
+	}
+	list, err := mgr.Children(parent.Token)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("unexpected children after rewrite: %v %v", list, err)
+	}
+	err = mgr.Rewrite("missing", nil)
+	if err != ErrNotfound {
+		t.Fatalf("unexpected rewrite of missing token: %v", err)
+	}
+
+	err = mgr.Expire(parent.Token, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected expire: %v", err)
+	}
+	after, err = mgr.Session(parent.Token)
+	if err != nil || after.TTL != time.Minute || !after.Created.Equal(before.Created) {
+		t.Fatalf("unexpected session after expire: %+v %v", after, err)
+	}
+	list, err = mgr.Children(parent.Token)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("unexpected children after expire: %v %v", list, err)
+	}
+	err = mgr.Expire("missing", time.Minute)
+	if err != ErrNotfound {
+		t.Fatalf("unexpected expire of missing token: %v", err)
+	}
+}
+
+func TestLogfileOpen(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "tokens.log")
+	dsn := &url.URL{Scheme: "logfile", Path: name, RawQuery: "ttl=0"}
+	mgr, err := token.Open(dsn.String())
+	if err != nil {
+		t.Fatalf("unexpected open: %v", err)
+	}
+	defer mgr.Close()
+	saved := tokentest.NewToken("1", "session")
+	err = mgr.Save(saved)
+	if err != nil {
+		t.Fatalf("unexpected save: %v", err)
+	}
+	s, err := mgr.Session(saved.Token)
+	if err != nil || s.TTL != 0 {
+		t.Fatalf("unexpected session of token without ttl: %+v %v", s, err)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("log of dsn is not written: %v", err)
+	}
+	err = mgr.Close()
+	if err != nil {
+		t.Fatalf("unexpected close: %v", err)
+	}
+	err = mgr.Close()
+	if err != os.ErrClosed {
+		t.Fatalf("unexpected close of closed manager: %v", err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing", "tokens.log")
+	h, err := token.Open((&url.URL{Scheme: "logfile", Path: missing}).String())
+	if err == nil || h != nil {
+		t.Fatalf("unexpected open of missing dir: %v, %v", h, err)
+	}
+
+	for _, dsn := range []string{
+		"logfile:tokens.log",
+		"logfile:///var/lib/",
+		"logfile://host/tokens.log",
+		"logfile:///tokens.log?ttl=1d",
+		"logfile:///tokens.log?ttl=1m&ttl=2m",
+	} {
+		_, err := token.Open(dsn)
+		if _, ok := err.(*token.DSNError); !ok {
+			t.Fatalf("unexpected open of %s: %v", dsn, err)
+		}
+	}
+}
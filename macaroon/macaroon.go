@@ -0,0 +1,183 @@
+package macaroon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// version version byte of binary form
+const version = 1
+
+// ErrMalformed string is not a serialized macaroon
+var ErrMalformed = errors.New("macaroon: malformed")
+
+// Macaroon bearer token whose holder may add caveats without the root key,
+// see "Macaroons: Cookies with Contextual Caveats". The signature is
+// HMAC-SHA256 of the id by the root key, chained over every caveat.
+type Macaroon struct {
+	Location string
+	ID       string
+	Caveats  []string
+	Sig      []byte
+}
+
+// sign returns signature of caveats chained after sig
+func sign(sig []byte, caveats ...string) []byte {
+	for _, c := range caveats {
+		mac := hmac.New(sha256.New, sig)
+		mac.Write([]byte(c))
+		sig = mac.Sum(nil)
+	}
+	return sig
+}
+
+// Add returns copy of m narrowed by caveats, m is not changed
+func (m *Macaroon) Add(caveats ...string) *Macaroon {
+	return &Macaroon{
+		Location: m.Location,
+		ID:       m.ID,
+		Caveats:  append(append([]string{}, m.Caveats...), caveats...),
+		Sig:      sign(m.Sig, caveats...),
+	}
+}
+
+// String returns compact form as base64url of binary form
+func (m *Macaroon) String() string {
+	var buf []byte
+	buf = append(buf, version)
+	buf = appendString(buf, m.Location)
+	buf = appendString(buf, m.ID)
+	buf = appendUvarint(buf, uint64(len(m.Caveats)))
+	for _, c := range m.Caveats {
+		buf = appendString(buf, c)
+	}
+	buf = append(buf, m.Sig...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], n)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// Parse parse compact form
+func Parse(s string) (*Macaroon, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 || buf[0] != version {
+		return nil, ErrMalformed
+	}
+	buf = buf[1:]
+	var m Macaroon
+	var ok bool
+	if m.Location, buf, ok = readString(buf); !ok {
+		return nil, ErrMalformed
+	}
+	if m.ID, buf, ok = readString(buf); !ok {
+		return nil, ErrMalformed
+	}
+	n, size := binary.Uvarint(buf)
+	// every caveat takes one byte at least
+	if size <= 0 || n > uint64(len(buf)) {
+		return nil, ErrMalformed
+	}
+	buf = buf[size:]
+	for i := uint64(0); i < n; i++ {
+		var c string
+		if c, buf, ok = readString(buf); !ok {
+			return nil, ErrMalformed
+		}
+		m.Caveats = append(m.Caveats, c)
+	}
+	if len(buf) != sha256.Size {
+		return nil, ErrMalformed
+	}
+	m.Sig = buf
+	return &m, nil
+}
+
+func readString(buf []byte) (string, []byte, bool) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return "", nil, false
+	}
+	buf = buf[size:]
+	return string(buf[:n]), buf[n:], true
+}
+
+// Attenuate add caveats to compact form of macaroon, it does not need the
+// root key so holders can narrow their own macaroons offline
+func Attenuate(s string, caveats ...string) (string, error) {
+	m, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return m.Add(caveats...).String(), nil
+}
+
+// Context request context checked by caveats
+type Context struct {
+	// Time time of request, default is time of clock of Store
+	Time   time.Time
+	Method string
+	Path   string
+	// Values application values checked by custom caveats
+	Values map[string]string
+}
+
+// FromRequest returns context of request
+func FromRequest(r *http.Request) Context {
+	return Context{Method: r.Method, Path: r.URL.Path}
+}
+
+// caveat names of builtin checkers
+const (
+	CaveatExpires = "expires"
+	CaveatPath    = "path"
+	CaveatMethod  = "method"
+)
+
+// Caveat returns caveat of name with argument, caveats are checked by the
+// checker registered by name
+func Caveat(name, arg string) string {
+	return name + " " + arg
+}
+
+// split returns name and argument of caveat
+func split(c string) (string, string) {
+	n := strings.IndexByte(c, ' ')
+	if n == -1 {
+		return c, ""
+	}
+	return c[:n], c[n+1:]
+}
+
+// Expires caveat which expires at t
+func Expires(t time.Time) string {
+	return Caveat(CaveatExpires, t.UTC().Format(time.RFC3339))
+}
+
+// ExpiresIn caveat which expires after d from now
+func ExpiresIn(d time.Duration) string {
+	return Expires(time.Now().Add(d))
+}
+
+// Path caveat which allows path and paths under it only
+func Path(path string) string {
+	return Caveat(CaveatPath, path)
+}
+
+// Method caveat which allows methods only
+func Method(methods ...string) string {
+	return Caveat(CaveatMethod, strings.Join(methods, " "))
+}
@@ -0,0 +1,128 @@
+package macaroon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+func testStore(t *testing.T, mgr token.SessionManager, clk *tokentest.Clock) {
+	s := New(mgr, Config{Location: "https://api.example.com", Clock: clk})
+	m, err := s.Mint("1", Path("/reports"))
+	if err != nil {
+		t.Fatalf("unexpected mint: %v", err)
+	}
+	str := m.String()
+	ctx := Context{Method: "GET", Path: "/reports/2026"}
+	uid, err := s.VerifyString(str, ctx)
+	if err != nil || uid != "1" {
+		t.Fatalf("unexpected verify: %s %v", uid, err)
+	}
+
+	// holder narrows the macaroon offline
+	narrow, err := Attenuate(str, Expires(clk.Now().Add(5*time.Minute)), Method("GET", "HEAD"))
+	if err != nil {
+		t.Fatalf("unexpected attenuate: %v", err)
+	}
+	_, err = s.VerifyString(narrow, ctx)
+	if err != nil {
+		t.Fatalf("unexpected verify of attenuated macaroon: %v", err)
+	}
+	cases := []struct {
+		ctx Context
+		ok  bool
+	}{
+		{Context{Method: "HEAD", Path: "/reports"}, true},
+		{Context{Method: "POST", Path: "/reports"}, false},
+		{Context{Method: "GET", Path: "/reportsx"}, false},
+		{Context{Method: "GET", Path: "/reports/../admin"}, false},
+		{Context{Method: "GET", Path: "/reports", Time: clk.Now().Add(6 * time.Minute)}, false},
+	}
+	for i, c := range cases {
+		_, err := s.VerifyString(narrow, c.ctx)
+		if _, ok := err.(*CaveatError); (err == nil) != c.ok || (err != nil && !ok) {
+			t.Fatalf("unexpected verify of case %d: %v", i, err)
+		}
+	}
+	clk.Add(6 * time.Minute)
+	if _, err = s.VerifyString(narrow, ctx); err == nil {
+		t.Fatal("expired macaroon is accepted")
+	}
+
+	// caveats can not be removed or changed without the root key
+	parsed, err := Parse(narrow)
+	if err != nil || len(parsed.Caveats) != 3 || parsed.Location != "https://api.example.com" {
+		t.Fatalf("unexpected parse: %+v %v", parsed, err)
+	}
+	parsed.Caveats = parsed.Caveats[:1]
+	if _, err = s.Verify(parsed, ctx); err != ErrInvalid {
+		t.Fatalf("unexpected verify without caveats: %v", err)
+	}
+	parsed, _ = Parse(str)
+	parsed.Caveats[0] = Path("/")
+	if _, err = s.Verify(parsed, Context{Path: "/admin"}); err != ErrInvalid {
+		t.Fatalf("unexpected verify of changed caveat: %v", err)
+	}
+
+	// unknown caveats are never satisfied until a checker is registered
+	tenant, _ := Attenuate(str, Caveat("tenant", "acme"))
+	ctx.Values = map[string]string{"tenant": "acme"}
+	_, err = s.VerifyString(tenant, ctx)
+	if e, ok := err.(*CaveatError); !ok || e.Err != ErrUnknownCaveat {
+		t.Fatalf("unexpected verify of unknown caveat: %v", err)
+	}
+	s.Register("tenant", func(arg string, ctx Context) error {
+		if ctx.Values["tenant"] != arg {
+			return ErrUnknownCaveat
+		}
+		return nil
+	})
+	if _, err = s.VerifyString(tenant, ctx); err != nil {
+		t.Fatalf("unexpected verify of registered caveat: %v", err)
+	}
+
+	s.Revoke("1", m.ID)
+	if _, err = s.VerifyString(str, ctx); err != ErrInvalid {
+		t.Fatalf("unexpected verify of revoked macaroon: %v", err)
+	}
+	if _, err = s.VerifyString(tenant, ctx); err != ErrInvalid {
+		t.Fatalf("unexpected verify of attenuated revoked macaroon: %v", err)
+	}
+}
+
+func TestStoreFile(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	testStore(t, file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk)), clk)
+}
+
+func TestStoreRedis(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	srv.SetClock(clk)
+	testStore(t, redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, time.Hour, token.WithClock(clk)), clk)
+}
+
+func TestParse(t *testing.T) {
+	m := (&Macaroon{ID: "id", Sig: make([]byte, 32)}).Add("a", "b b")
+	parsed, err := Parse(m.String())
+	if err != nil || parsed.ID != "id" || len(parsed.Caveats) != 2 || parsed.Caveats[1] != "b b" {
+		t.Fatalf("unexpected parse: %+v %v", parsed, err)
+	}
+	str := m.String()
+	for i, s := range []string{"", "!", str[:len(str)-1], str + "AA", "AgAA"} {
+		if _, err := Parse(s); err != ErrMalformed {
+			t.Fatalf("unexpected parse of case %d: %v", i, err)
+		}
+	}
+}
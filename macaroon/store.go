@@ -0,0 +1,232 @@
+package macaroon
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// ErrInvalid macaroon is forged, revoked or its root key is expired
+var ErrInvalid = errors.New("macaroon: invalid signature or revoked")
+
+// ErrUnknownCaveat caveat has no registered checker, unknown caveats are
+// never satisfied
+var ErrUnknownCaveat = errors.New("unknown caveat")
+
+// CaveatError caveat is not satisfied by the context
+type CaveatError struct {
+	Caveat string
+	Err    error
+}
+
+func (e *CaveatError) Error() string {
+	return "macaroon: caveat " + e.Caveat + ": " + e.Err.Error()
+}
+
+// Checker check argument of caveat against context
+type Checker func(arg string, ctx Context) error
+
+// rootKey root key of macaroon saved in manager by macaroon id
+type rootKey struct {
+	ID  string `json:"id"`
+	UID string `json:"uid"`
+	Key []byte `json:"key"`
+}
+
+// GetTK get macaroon id
+func (k *rootKey) GetTK() string {
+	return k.ID
+}
+
+// GetUID get uid
+func (k *rootKey) GetUID() string {
+	return k.UID
+}
+
+// GetName get name
+func (k *rootKey) GetName() string {
+	return "macaroon"
+}
+
+// Serialize serialize root key
+func (k *rootKey) Serialize() ([]byte, error) {
+	return json.Marshal(k)
+}
+
+// UnSerialize unserialize root key
+func (k *rootKey) UnSerialize(id string, data []byte) error {
+	err := json.Unmarshal(data, k)
+	k.ID = id
+	return err
+}
+
+// Verify load root key
+func (k *rootKey) Verify(data []byte) (bool, error) {
+	var dst rootKey
+	err := json.Unmarshal(data, &dst)
+	if err != nil {
+		return false, err
+	}
+	if dst.ID != k.ID {
+		return false, nil
+	}
+	*k = dst
+	return true, nil
+}
+
+// Config store config
+type Config struct {
+	// Location hint of the service which verifies the macaroons
+	Location string
+	// Clock time source, default is token.SystemClock
+	Clock token.Clock
+}
+
+// Store mint and verify macaroons, root keys are saved in the manager by
+// macaroon id so they live for the ttl of manager and revoking the id
+// invalidates every macaroon derived from it. Root keys are kept in clear
+// text by the manager.
+type Store struct {
+	mgr      token.SessionManager
+	cfg      Config
+	mu       sync.RWMutex
+	checkers map[string]Checker
+}
+
+// New new store with checkers of expires, path and method caveats
+func New(mgr token.SessionManager, cfg Config) *Store {
+	if cfg.Clock == nil {
+		cfg.Clock = token.SystemClock
+	}
+	ret := &Store{mgr: mgr, cfg: cfg, checkers: make(map[string]Checker)}
+	ret.Register(CaveatExpires, checkExpires)
+	ret.Register(CaveatPath, checkPath)
+	ret.Register(CaveatMethod, checkMethod)
+	return ret
+}
+
+// Register set checker of caveat name
+func (s *Store) Register(name string, fn Checker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkers[name] = fn
+}
+
+func random(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	return buf, err
+}
+
+// Mint new macaroon of uid with caveats
+func (s *Store) Mint(uid string, caveats ...string) (*Macaroon, error) {
+	id, err := random(16)
+	if err != nil {
+		return nil, err
+	}
+	key, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+	k := &rootKey{
+		ID:  base64.RawURLEncoding.EncodeToString(id),
+		UID: uid,
+		Key: key,
+	}
+	err = s.mgr.Save(k)
+	if err != nil {
+		return nil, err
+	}
+	m := &Macaroon{
+		Location: s.cfg.Location,
+		ID:       k.ID,
+		Sig:      sign(key, k.ID),
+	}
+	return m.Add(caveats...), nil
+}
+
+// Verify verify signature and caveats of macaroon, returns uid of it
+func (s *Store) Verify(m *Macaroon, ctx Context) (string, error) {
+	k := &rootKey{ID: m.ID}
+	ok, err := s.mgr.Verify(k)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrInvalid
+	}
+	sig := sign(sign(k.Key, m.ID), m.Caveats...)
+	if !hmac.Equal(sig, m.Sig) {
+		return "", ErrInvalid
+	}
+	if ctx.Time.IsZero() {
+		ctx.Time = s.cfg.Clock.Now()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range m.Caveats {
+		name, arg := split(c)
+		fn, ok := s.checkers[name]
+		if !ok {
+			return "", &CaveatError{Caveat: c, Err: ErrUnknownCaveat}
+		}
+		if err := fn(arg, ctx); err != nil {
+			return "", &CaveatError{Caveat: c, Err: err}
+		}
+	}
+	return k.UID, nil
+}
+
+// VerifyString parse and verify compact form of macaroon
+func (s *Store) VerifyString(str string, ctx Context) (string, error) {
+	m, err := Parse(str)
+	if err != nil {
+		return "", err
+	}
+	return s.Verify(m, ctx)
+}
+
+// Revoke revoke root key of macaroon id of uid, every macaroon attenuated
+// from it is invalid after
+func (s *Store) Revoke(uid, id string) {
+	s.mgr.Revoke(uid, id)
+}
+
+func checkExpires(arg string, ctx Context) error {
+	t, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		return err
+	}
+	if !ctx.Time.Before(t) {
+		return errors.New("expired")
+	}
+	return nil
+}
+
+// checkPath allow the path and paths under it, paths are cleaned before so
+// dot segments can not escape
+func checkPath(arg string, ctx Context) error {
+	p := path.Clean("/" + ctx.Path)
+	prefix := path.Clean("/" + arg)
+	if p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/") {
+		return nil
+	}
+	return errors.New("path not allowed")
+}
+
+func checkMethod(arg string, ctx Context) error {
+	for _, m := range strings.Fields(arg) {
+		if strings.EqualFold(m, ctx.Method) {
+			return nil
+		}
+	}
+	return errors.New("method not allowed")
+}
@@ -0,0 +1,259 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// Client registered client
+type Client struct {
+	ID string `json:"id"`
+	// SecretHash hex sha256 of secret, see HashSecret, it is empty for
+	// public clients
+	SecretHash string `json:"secret_hash,omitempty"`
+	// Scopes scopes the client may request
+	Scopes []string `json:"scopes,omitempty"`
+	// Grants grant types the client may use, empty allows every grant
+	Grants []string `json:"grants,omitempty"`
+	// RedirectURIs redirect uris of authorization code grant, they are
+	// compared exactly
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+}
+
+// HashSecret returns hash of client secret to register
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Public returns whether the client has no secret
+func (c *Client) Public() bool {
+	return len(c.SecretHash) == 0
+}
+
+// CheckSecret compare secret in constant time
+func (c *Client) CheckSecret(secret string) bool {
+	if c.Public() {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(c.SecretHash)) == 1
+}
+
+// AllowGrant returns whether the client may use grant
+func (c *Client) AllowGrant(grant string) bool {
+	if len(c.Grants) == 0 {
+		return true
+	}
+	for _, g := range c.Grants {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowRedirect returns whether uri is registered redirect uri
+func (c *Client) AllowRedirect(uri string) bool {
+	if len(uri) == 0 {
+		return false
+	}
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowScope returns granted scope of requested scope, every scope of client
+// is granted when scope is empty
+func (c *Client) AllowScope(scope string) (string, bool) {
+	if len(strings.TrimSpace(scope)) == 0 {
+		return strings.Join(c.Scopes, " "), true
+	}
+	return scope, subset(scope, c.Scopes)
+}
+
+// subset returns whether every scope of space separated scope is in scopes
+func subset(scope string, scopes []string) bool {
+	for _, s := range strings.Fields(scope) {
+		var ok bool
+		for _, allowed := range scopes {
+			if s == allowed {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Registry client registry, ErrNotfound is returned for unknown clients
+type Registry interface {
+	Client(id string) (*Client, error)
+}
+
+// MemoryRegistry in-memory client registry
+type MemoryRegistry struct {
+	sync.RWMutex
+	clients map[string]*Client
+}
+
+// NewMemoryRegistry new in-memory registry
+func NewMemoryRegistry(clients ...*Client) *MemoryRegistry {
+	ret := &MemoryRegistry{clients: make(map[string]*Client)}
+	for _, c := range clients {
+		ret.clients[c.ID] = c
+	}
+	return ret
+}
+
+// Add add or replace client
+func (reg *MemoryRegistry) Add(c *Client) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.clients[c.ID] = c
+}
+
+// Remove remove client
+func (reg *MemoryRegistry) Remove(id string) {
+	reg.Lock()
+	defer reg.Unlock()
+	delete(reg.clients, id)
+}
+
+// Client get client by id
+func (reg *MemoryRegistry) Client(id string) (*Client, error) {
+	reg.RLock()
+	defer reg.RUnlock()
+	c, ok := reg.clients[id]
+	if !ok {
+		return nil, token.ErrNotfound
+	}
+	return c, nil
+}
+
+// FileRegistry client registry kept in json file as array of clients, the
+// file is reloaded when it is modified
+type FileRegistry struct {
+	sync.Mutex
+	name    string
+	mtime   time.Time
+	clients map[string]*Client
+}
+
+// NewFileRegistry new file registry
+func NewFileRegistry(name string) (*FileRegistry, error) {
+	ret := &FileRegistry{name: name}
+	err := ret.reload()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (reg *FileRegistry) reload() error {
+	fi, err := os.Stat(reg.name)
+	if err != nil {
+		return err
+	}
+	if reg.clients != nil && fi.ModTime().Equal(reg.mtime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(reg.name)
+	if err != nil {
+		return err
+	}
+	var list []*Client
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	clients := make(map[string]*Client, len(list))
+	for _, c := range list {
+		clients[c.ID] = c
+	}
+	reg.clients = clients
+	reg.mtime = fi.ModTime()
+	return nil
+}
+
+// Client get client by id, the last loaded clients are used when the file
+// can not be reloaded
+func (reg *FileRegistry) Client(id string) (*Client, error) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.reload()
+	c, ok := reg.clients[id]
+	if !ok {
+		return nil, token.ErrNotfound
+	}
+	return c, nil
+}
+
+// authenticate authenticate client by client_secret_basic or
+// client_secret_post, public clients are identified by client_id in form
+func authenticate(reg Registry, r *http.Request) (*Client, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		if _, ok := r.PostForm["client_secret"]; ok {
+			return nil, invalidRequest("multiple client authentication methods")
+		}
+		// credentials are form-urlencoded, see RFC 6749 section 2.3.1
+		var err1, err2 error
+		id, err1 = url.QueryUnescape(id)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return nil, ErrInvalidClient
+		}
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if len(id) == 0 {
+		return nil, ErrInvalidClient
+	}
+	c, err := reg.Client(id)
+	if err == token.ErrNotfound {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Public() && !basic && len(secret) == 0 {
+		return c, nil
+	}
+	if !c.CheckSecret(secret) {
+		return nil, ErrInvalidClient
+	}
+	return c, nil
+}
+
+// ClientAuth authenticate confidential clients of reg by client_secret_basic
+// or client_secret_post
+func ClientAuth(reg Registry) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		c, err := authenticate(reg, r)
+		if err != nil {
+			return "", err
+		}
+		if c.Public() {
+			return "", ErrInvalidClient
+		}
+		return c.ID, nil
+	})
+}
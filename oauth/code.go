@@ -0,0 +1,243 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lwch/token"
+)
+
+// PurposeCode purpose of authorization codes in manager
+const PurposeCode = "authorization_code"
+
+// ErrAccessDenied resource owner denied the request
+var ErrAccessDenied = &Error{
+	Status:      http.StatusBadRequest,
+	Code:        "access_denied",
+	Description: "the resource owner denied the request",
+}
+
+// Code authorization code
+type Code struct {
+	TK          string `json:"tk"`
+	Subject     string `json:"sub"`
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri"`
+	// ExplicitRedirect redirect_uri is included in authorization request, so
+	// the token request must repeat it, see RFC 6749 section 4.1.3
+	ExplicitRedirect bool   `json:"explicit_redirect,omitempty"`
+	Scope            string `json:"scope,omitempty"`
+	// Challenge S256 code challenge, see RFC 7636
+	Challenge string `json:"challenge"`
+}
+
+// GetTK get code
+func (c *Code) GetTK() string {
+	return c.TK
+}
+
+// GetUID get subject
+func (c *Code) GetUID() string {
+	return c.Subject
+}
+
+// GetName get client id
+func (c *Code) GetName() string {
+	return c.ClientID
+}
+
+// Serialize serialize code
+func (c *Code) Serialize() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// UnSerialize unserialize code
+func (c *Code) UnSerialize(tk string, data []byte) error {
+	err := json.Unmarshal(data, c)
+	c.TK = tk
+	return err
+}
+
+// Verify verify code
+func (c *Code) Verify(data []byte) (bool, error) {
+	var dst Code
+	err := json.Unmarshal(data, &dst)
+	if err != nil {
+		return false, err
+	}
+	if dst.TK != c.TK {
+		return false, nil
+	}
+	*c = dst
+	return true, nil
+}
+
+// validVerifier check length and characters of code verifier, see RFC 7636
+// section 4.1
+func validVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, ch := range verifier {
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9':
+		case ch == '-' || ch == '.' || ch == '_' || ch == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Challenge returns S256 code challenge of verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthorizeRequest authorization request, see RFC 6749 section 4.1.1
+type AuthorizeRequest struct {
+	Client      *Client
+	RedirectURI string
+	// ExplicitRedirect redirect_uri is included in request, RedirectURI is
+	// the only registered one otherwise
+	ExplicitRedirect bool
+	Scope            string
+	State            string
+	Challenge        string
+}
+
+// ParseAuthorize parse and validate authorization request. Errors returned
+// with nil request must be shown to the user, the others are sent back to
+// the client by redirecting to ErrorURL.
+func ParseAuthorize(reg Registry, r *http.Request) (*AuthorizeRequest, error) {
+	q := r.URL.Query()
+	c, err := reg.Client(q.Get("client_id"))
+	if err == token.ErrNotfound {
+		return nil, invalidRequest("unknown client")
+	}
+	if err != nil {
+		return nil, err
+	}
+	redirect := q.Get("redirect_uri")
+	if len(redirect) == 0 && len(c.RedirectURIs) == 1 {
+		redirect = c.RedirectURIs[0]
+	}
+	if !c.AllowRedirect(redirect) {
+		return nil, invalidRequest("redirect_uri is not registered")
+	}
+	req := &AuthorizeRequest{
+		Client:           c,
+		RedirectURI:      redirect,
+		ExplicitRedirect: len(q.Get("redirect_uri")) > 0,
+		State:            q.Get("state"),
+		Challenge:        q.Get("code_challenge"),
+	}
+	if q.Get("response_type") != "code" {
+		return req, &Error{
+			Status:      http.StatusBadRequest,
+			Code:        "unsupported_response_type",
+			Description: "only code response type is supported",
+		}
+	}
+	if !c.AllowGrant(GrantAuthorizationCode) {
+		return req, ErrUnauthorizedClient
+	}
+	if len(req.Challenge) == 0 || q.Get("code_challenge_method") != "S256" {
+		return req, invalidRequest("S256 code challenge is required")
+	}
+	var ok bool
+	req.Scope, ok = c.AllowScope(q.Get("scope"))
+	if !ok {
+		return req, ErrInvalidScope
+	}
+	return req, nil
+}
+
+func (req *AuthorizeRequest) redirect(params url.Values) string {
+	if len(req.State) > 0 {
+		params.Set("state", req.State)
+	}
+	sep := "?"
+	if strings.Contains(req.RedirectURI, "?") {
+		sep = "&"
+	}
+	return req.RedirectURI + sep + params.Encode()
+}
+
+// ErrorURL returns redirect url which reports err to the client, errors
+// other than *Error are reported as server_error
+func (req *AuthorizeRequest) ErrorURL(err error) string {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: "server_error"}
+	}
+	params := url.Values{"error": {e.Code}}
+	if len(e.Description) > 0 {
+		params.Set("error_description", e.Description)
+	}
+	return req.redirect(params)
+}
+
+// CodeStore store of authorization codes, codes live for the ttl of the
+// manager which should be short such as one minute
+type CodeStore struct {
+	mgr token.OneTimeManager
+}
+
+// NewCodeStore new code store
+func NewCodeStore(mgr token.OneTimeManager) *CodeStore {
+	return &CodeStore{mgr: mgr}
+}
+
+// Approve issue code of request approved by subject, returns the url to
+// redirect the user agent to
+func (s *CodeStore) Approve(req *AuthorizeRequest, subject string) (string, error) {
+	raw, err := random(32)
+	if err != nil {
+		return "", err
+	}
+	err = s.mgr.SaveSession(&Code{
+		TK:               raw,
+		Subject:          subject,
+		ClientID:         req.Client.ID,
+		RedirectURI:      req.RedirectURI,
+		ExplicitRedirect: req.ExplicitRedirect,
+		Scope:            req.Scope,
+		Challenge:        req.Challenge,
+	}, token.Meta{Purpose: PurposeCode})
+	if err != nil {
+		return "", err
+	}
+	return req.redirect(url.Values{"code": {raw}}), nil
+}
+
+// Exchange consume code issued to client, the code can not be used again
+// even when the redirect uri or verifier does not match. redirectURI may be
+// empty when it is omitted from the authorization request.
+func (s *CodeStore) Exchange(client, raw, redirectURI, verifier string) (*Code, error) {
+	c := &Code{TK: raw}
+	ok, err := s.mgr.VerifyAndConsume(c, PurposeCode)
+	if err == token.ErrPurpose {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok || c.ClientID != client {
+		return nil, ErrInvalidGrant
+	}
+	if (c.ExplicitRedirect || len(redirectURI) > 0) && c.RedirectURI != redirectURI {
+		return nil, ErrInvalidGrant
+	}
+	if !validVerifier(verifier) ||
+		subtle.ConstantTimeCompare([]byte(Challenge(verifier)), []byte(c.Challenge)) != 1 {
+		return nil, ErrInvalidGrant
+	}
+	return c, nil
+}
@@ -0,0 +1,472 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// purposes of device flow records in manager
+const (
+	PurposeDeviceCode = "device_code"
+	PurposeUserCode   = "user_code"
+)
+
+// default device flow config
+const (
+	DefaultDeviceLifetime = 10 * time.Minute
+	DefaultDeviceInterval = 5 * time.Second
+)
+
+// userCodeChars consonants without ambiguous characters, see RFC 8628
+// section 6.1
+const userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+
+var (
+	// ErrAuthorizationPending user has not approved or denied the request yet
+	ErrAuthorizationPending = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "authorization_pending",
+		Description: "the authorization request is still pending",
+	}
+	// ErrSlowDown client polls faster than the interval, it must increase
+	// the interval by 5 seconds
+	ErrSlowDown = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "slow_down",
+		Description: "polling too frequently",
+	}
+	// ErrExpiredToken device code is expired
+	ErrExpiredToken = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "expired_token",
+		Description: "the device code is expired",
+	}
+)
+
+// DeviceCode device authorization record, it is saved by device code and
+// its uid is the client id
+type DeviceCode struct {
+	TK       string    `json:"tk"`
+	UserCode string    `json:"user_code"`
+	ClientID string    `json:"client_id"`
+	Scope    string    `json:"scope,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// decision decision of user, it is kept in KV because managers do not
+// overwrite saved tokens
+type decision struct {
+	Approved bool   `json:"approved"`
+	Subject  string `json:"sub,omitempty"`
+}
+
+// GetTK get device code
+func (d *DeviceCode) GetTK() string {
+	return d.TK
+}
+
+// GetUID get client id
+func (d *DeviceCode) GetUID() string {
+	return d.ClientID
+}
+
+// GetName get user code
+func (d *DeviceCode) GetName() string {
+	return d.UserCode
+}
+
+// Serialize serialize record
+func (d *DeviceCode) Serialize() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+// UnSerialize unserialize record
+func (d *DeviceCode) UnSerialize(tk string, data []byte) error {
+	err := json.Unmarshal(data, d)
+	d.TK = tk
+	return err
+}
+
+// Verify verify device code
+func (d *DeviceCode) Verify(data []byte) (bool, error) {
+	var dst DeviceCode
+	err := json.Unmarshal(data, &dst)
+	if err != nil {
+		return false, err
+	}
+	if dst.TK != d.TK {
+		return false, nil
+	}
+	*d = dst
+	return true, nil
+}
+
+// userCode index from user code to device code
+type userCode struct {
+	TK         string `json:"tk"`
+	ClientID   string `json:"client_id"`
+	DeviceCode string `json:"device_code"`
+}
+
+// GetTK get token of user code
+func (u *userCode) GetTK() string {
+	return u.TK
+}
+
+// GetUID get client id
+func (u *userCode) GetUID() string {
+	return u.ClientID
+}
+
+// GetName get device code
+func (u *userCode) GetName() string {
+	return u.DeviceCode
+}
+
+// Serialize serialize entry
+func (u *userCode) Serialize() ([]byte, error) {
+	return json.Marshal(u)
+}
+
+// UnSerialize unserialize entry
+func (u *userCode) UnSerialize(tk string, data []byte) error {
+	err := json.Unmarshal(data, u)
+	u.TK = tk
+	return err
+}
+
+// Verify verify user code
+func (u *userCode) Verify(data []byte) (bool, error) {
+	var dst userCode
+	err := json.Unmarshal(data, &dst)
+	if err != nil {
+		return false, err
+	}
+	if dst.TK != u.TK {
+		return false, nil
+	}
+	*u = dst
+	return true, nil
+}
+
+// userCodeKey returns token of user code entry, user codes are compared
+// without case and separators
+func userCodeKey(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return "uc-" + code
+}
+
+// userCodeAttempts number of user codes drawn before Authorize gives up
+const userCodeAttempts = 5
+
+// errUserCode no free user code is drawn in userCodeAttempts
+var errUserCode = errors.New("oauth: no free user code")
+
+// newUserCode generator of user codes, it is replaced by tests
+var newUserCode = randomUserCode
+
+// randomUserCode returns random user code such as BDFH-JKLM
+func randomUserCode() (string, error) {
+	var ret []byte
+	buf := make([]byte, 16)
+	for len(ret) < 8 {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// reject to keep the distribution uniform
+			if int(b) >= 256/len(userCodeChars)*len(userCodeChars) {
+				continue
+			}
+			ret = append(ret, userCodeChars[int(b)%len(userCodeChars)])
+			if len(ret) == 8 {
+				break
+			}
+		}
+	}
+	return string(ret[:4]) + "-" + string(ret[4:]), nil
+}
+
+// DeviceResponse device authorization response, see RFC 8628 section 3.2
+type DeviceResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceConfig device flow config
+type DeviceConfig struct {
+	// Clients registry of clients
+	Clients Registry
+	// Mgr manager of device and user codes, its ttl should be longer than
+	// Lifetime so that late polls are answered by expired_token
+	Mgr token.OneTimeManager
+	// KV storage of decisions and poll rate limits, such as KV of file and
+	// redis managers
+	KV token.KV
+	// VerificationURI page where users enter the user code
+	VerificationURI string
+	// Lifetime lifetime of device codes, default is DefaultDeviceLifetime
+	Lifetime time.Duration
+	// Interval minimum polling interval, default is DefaultDeviceInterval
+	Interval time.Duration
+	// Prefix prefix of keys in KV, default is "device"
+	Prefix string
+	// Clock time source, default is token.SystemClock
+	Clock token.Clock
+}
+
+// DeviceFlow device authorization grant, see RFC 8628. It serves the device
+// authorization endpoint, the token endpoint polls it by TokenConfig.Devices.
+type DeviceFlow struct {
+	cfg DeviceConfig
+}
+
+// NewDeviceFlow new device flow
+func NewDeviceFlow(cfg DeviceConfig) *DeviceFlow {
+	if cfg.Lifetime <= 0 {
+		cfg.Lifetime = DefaultDeviceLifetime
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultDeviceInterval
+	}
+	if len(cfg.Prefix) == 0 {
+		cfg.Prefix = "device"
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = token.SystemClock
+	}
+	return &DeviceFlow{cfg: cfg}
+}
+
+func (d *DeviceFlow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !parseForm(w, r) {
+		return
+	}
+	c, err := authenticate(d.cfg.Clients, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := d.Authorize(c, r.PostForm.Get("scope"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Authorize issue device code and user code of client
+func (d *DeviceFlow) Authorize(c *Client, scope string) (*DeviceResponse, error) {
+	if !c.AllowGrant(GrantDeviceCode) {
+		return nil, ErrUnauthorizedClient
+	}
+	scope, ok := c.AllowScope(scope)
+	if !ok {
+		return nil, ErrInvalidScope
+	}
+	raw, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+	user, err := d.reserveUserCode()
+	if err != nil {
+		return nil, err
+	}
+	rec := &DeviceCode{
+		TK:       raw,
+		UserCode: user,
+		ClientID: c.ID,
+		Scope:    scope,
+		Expires:  d.cfg.Clock.Now().Add(d.cfg.Lifetime),
+	}
+	err = d.cfg.Mgr.SaveSession(rec, token.Meta{Purpose: PurposeDeviceCode})
+	if err != nil {
+		return nil, err
+	}
+	err = d.cfg.Mgr.SaveSession(&userCode{
+		TK:         userCodeKey(user),
+		ClientID:   c.ID,
+		DeviceCode: raw,
+	}, token.Meta{Purpose: PurposeUserCode})
+	if err != nil {
+		d.cfg.Mgr.Revoke(c.ID, raw)
+		return nil, err
+	}
+	resp := &DeviceResponse{
+		DeviceCode:      raw,
+		UserCode:        user,
+		VerificationURI: d.cfg.VerificationURI,
+		ExpiresIn:       int64(d.cfg.Lifetime / time.Second),
+		Interval:        int64(d.cfg.Interval / time.Second),
+	}
+	if len(d.cfg.VerificationURI) > 0 {
+		sep := "?"
+		if strings.Contains(d.cfg.VerificationURI, "?") {
+			sep = "&"
+		}
+		resp.VerificationURIComplete = d.cfg.VerificationURI + sep + "user_code=" + user
+	}
+	return resp, nil
+}
+
+// reserveUserCode draw user code which is not in use and reserve it in KV
+// for the lifetime of device code, so concurrent Authorize never share one.
+// Codes whose record is still kept by manager are skipped as well since
+// saving them again is ignored by some backends.
+func (d *DeviceFlow) reserveUserCode() (string, error) {
+	for i := 0; i < userCodeAttempts; i++ {
+		user, err := newUserCode()
+		if err != nil {
+			return "", err
+		}
+		ok, err := d.cfg.KV.SetNX(d.kvKey("user", userCodeKey(user)), nil, d.cfg.Lifetime)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		_, err = d.cfg.Mgr.Session(userCodeKey(user))
+		if err == token.ErrNotfound {
+			return user, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", errUserCode
+}
+
+// Pending returns pending record of user code for the verification page,
+// ErrNotfound is returned for unknown, expired and decided user codes
+func (d *DeviceFlow) Pending(code string) (*DeviceCode, error) {
+	u := &userCode{TK: userCodeKey(code)}
+	ok, err := d.cfg.Mgr.Verify(u)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, token.ErrNotfound
+	}
+	return d.pending(u.DeviceCode)
+}
+
+func (d *DeviceFlow) pending(raw string) (*DeviceCode, error) {
+	rec := &DeviceCode{TK: raw}
+	ok, err := d.cfg.Mgr.Verify(rec)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !d.cfg.Clock.Now().Before(rec.Expires) {
+		return nil, token.ErrNotfound
+	}
+	return rec, nil
+}
+
+// Approve approve request of user code by subject
+func (d *DeviceFlow) Approve(code, subject string) error {
+	return d.decide(code, decision{Approved: true, Subject: subject})
+}
+
+// Deny deny request of user code
+func (d *DeviceFlow) Deny(code string) error {
+	return d.decide(code, decision{})
+}
+
+// decide consume user code, so only one of concurrent decisions is taken,
+// and keep the decision until the device code expires
+func (d *DeviceFlow) decide(code string, dec decision) error {
+	u := &userCode{TK: userCodeKey(code)}
+	ok, err := d.cfg.Mgr.VerifyAndConsume(u, PurposeUserCode)
+	if err == token.ErrPurpose {
+		return token.ErrNotfound
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return token.ErrNotfound
+	}
+	rec, err := d.pending(u.DeviceCode)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(dec)
+	if err != nil {
+		return err
+	}
+	return d.cfg.KV.Set(d.kvKey("decision", rec.TK), data, rec.Expires.Sub(d.cfg.Clock.Now()))
+}
+
+// kvKey returns key of device code in KV, device codes are hashed so they
+// can not be read from the storage
+func (d *DeviceFlow) kvKey(kind, raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return d.cfg.Prefix + ":" + kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// poll returns approved record and subject of device code issued to client,
+// the record is consumed once it is approved, denied or expired
+func (d *DeviceFlow) poll(client, raw string) (*DeviceCode, string, error) {
+	rec := &DeviceCode{TK: raw}
+	ok, err := d.cfg.Mgr.Verify(rec)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok || rec.ClientID != client {
+		return nil, "", ErrInvalidGrant
+	}
+	if !d.cfg.Clock.Now().Before(rec.Expires) {
+		d.cfg.Mgr.Revoke(rec.ClientID, raw)
+		d.cfg.Mgr.Revoke(rec.ClientID, userCodeKey(rec.UserCode))
+		return nil, "", ErrExpiredToken
+	}
+	data, _, err := d.cfg.KV.Load(d.kvKey("decision", raw))
+	if err == token.ErrNotfound {
+		first, err := d.cfg.KV.SetNX(d.kvKey("poll", raw), nil, d.cfg.Interval)
+		if err != nil {
+			return nil, "", err
+		}
+		if !first {
+			return nil, "", ErrSlowDown
+		}
+		return nil, "", ErrAuthorizationPending
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var dec decision
+	err = json.Unmarshal(data, &dec)
+	if err != nil {
+		return nil, "", err
+	}
+	ok, err = d.cfg.Mgr.VerifyAndConsume(rec, PurposeDeviceCode)
+	if err == token.ErrPurpose {
+		return nil, "", ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", ErrInvalidGrant
+	}
+	d.cfg.KV.Del(d.kvKey("decision", raw))
+	if !dec.Approved {
+		return nil, "", ErrAccessDenied
+	}
+	return rec, dec.Subject, nil
+}
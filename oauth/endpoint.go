@@ -0,0 +1,292 @@
+package oauth
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// grant types
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+var (
+	// ErrInvalidGrant grant is invalid, expired, revoked or issued to
+	// another client
+	ErrInvalidGrant = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "invalid_grant",
+		Description: "the grant is invalid, expired or revoked",
+	}
+	// ErrInvalidScope requested scope exceeds the allowed scope
+	ErrInvalidScope = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "invalid_scope",
+		Description: "the requested scope is invalid or exceeds the allowed scope",
+	}
+	// ErrUnsupportedGrantType grant type is not supported
+	ErrUnsupportedGrantType = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "unsupported_grant_type",
+		Description: "the grant type is not supported",
+	}
+)
+
+// TokenResponse successful token response, see RFC 6749 section 5.1
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// IssuedTokenType type of token issued by token exchange
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// Grant handle token request of authenticated client for one grant type,
+// returns *Error to reject the request
+type Grant func(c *Client, r *http.Request) (*TokenResponse, error)
+
+// RefreshStore manager of refresh tokens which reads raw entries,
+// implemented by every backend
+type RefreshStore interface {
+	token.OneTimeManager
+	Lookup(tk string) (token.Entry, error)
+}
+
+// TokenConfig token endpoint config
+type TokenConfig struct {
+	// Clients registry of clients
+	Clients Registry
+	// Access manager to issue access tokens, the ttl of manager is the
+	// lifetime of access tokens
+	Access token.SessionManager
+	// Refresh manager to issue refresh tokens of authorization_code grant,
+	// refresh tokens are rotated on every use. It is optional and enables
+	// refresh_token grant.
+	Refresh RefreshStore
+	// Codes store of authorization codes, it is optional and enables
+	// authorization_code grant
+	Codes *CodeStore
+	// Devices device flow, it is optional and enables device_code grant
+	Devices *DeviceFlow
+	// Exchange token exchange, it is optional and enables token-exchange
+	// grant, exchanged tokens are saved in Subjects of it
+	Exchange *Exchange
+}
+
+// TokenEndpoint token endpoint, see RFC 6749 section 3.2
+type TokenEndpoint struct {
+	cfg    TokenConfig
+	mu     sync.RWMutex
+	grants map[string]Grant
+}
+
+// NewTokenEndpoint new token endpoint which supports client_credentials
+// grant, authorization_code, refresh_token, device_code and token-exchange
+// grants when Codes, Refresh, Devices and Exchange are set, other grants are
+// added by Handle
+func NewTokenEndpoint(cfg TokenConfig) *TokenEndpoint {
+	ret := &TokenEndpoint{cfg: cfg, grants: make(map[string]Grant)}
+	ret.Handle(GrantClientCredentials, ret.clientCredentials)
+	if cfg.Codes != nil {
+		ret.Handle(GrantAuthorizationCode, ret.authorizationCode)
+	}
+	if cfg.Refresh != nil {
+		ret.Handle(GrantRefreshToken, ret.refreshToken)
+	}
+	if cfg.Devices != nil {
+		ret.Handle(GrantDeviceCode, ret.deviceCode)
+	}
+	if cfg.Exchange != nil {
+		ret.Handle(GrantTokenExchange, ret.tokenExchange)
+	}
+	return ret
+}
+
+// Handle set handler of grant type
+func (h *TokenEndpoint) Handle(grant string, fn Grant) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.grants[grant] = fn
+}
+
+func (h *TokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !parseForm(w, r) {
+		return
+	}
+	c, err := authenticate(h.cfg.Clients, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	grant := r.PostForm.Get("grant_type")
+	h.mu.RLock()
+	fn, ok := h.grants[grant]
+	h.mu.RUnlock()
+	if !ok {
+		writeError(w, ErrUnsupportedGrantType)
+		return
+	}
+	if !c.AllowGrant(grant) {
+		writeError(w, ErrUnauthorizedClient)
+		return
+	}
+	resp, err := fn(c, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Issue save access token and returns the response, the token is set to a
+// new random value
+func (h *TokenEndpoint) Issue(tk *Token) (*TokenResponse, error) {
+	raw, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+	tk.TK = raw
+	err = h.cfg.Access.Save(tk)
+	if err != nil {
+		return nil, err
+	}
+	resp := &TokenResponse{
+		AccessToken: raw,
+		TokenType:   "Bearer",
+		Scope:       tk.Scope,
+	}
+	s, err := h.cfg.Access.Session(raw)
+	if err != nil {
+		return nil, err
+	}
+	resp.ExpiresIn = int64(s.TTL.Round(time.Second).Seconds())
+	return resp, nil
+}
+
+// issueRefresh issue access token with refresh token of scope when refresh
+// tokens are enabled
+func (h *TokenEndpoint) issueRefresh(tk *Token, scope string) (*TokenResponse, error) {
+	refresh := *tk
+	refresh.Scope = scope
+	resp, err := h.Issue(tk)
+	if err != nil || h.cfg.Refresh == nil {
+		return resp, err
+	}
+	refresh.TK, err = random(32)
+	if err != nil {
+		return nil, err
+	}
+	err = h.cfg.Refresh.SaveSession(&refresh, token.Meta{Purpose: GrantRefreshToken})
+	if err != nil {
+		return nil, err
+	}
+	resp.RefreshToken = refresh.TK
+	return resp, nil
+}
+
+// clientCredentials client_credentials grant, see RFC 6749 section 4.4, the
+// subject of token is the client itself
+func (h *TokenEndpoint) clientCredentials(c *Client, r *http.Request) (*TokenResponse, error) {
+	if c.Public() {
+		return nil, ErrUnauthorizedClient
+	}
+	scope, ok := c.AllowScope(r.PostForm.Get("scope"))
+	if !ok {
+		return nil, ErrInvalidScope
+	}
+	return h.Issue(&Token{
+		Subject:  c.ID,
+		ClientID: c.ID,
+		Scope:    scope,
+	})
+}
+
+// authorizationCode authorization_code grant with PKCE, see RFC 6749
+// section 4.1.3 and RFC 7636 section 4.5
+func (h *TokenEndpoint) authorizationCode(c *Client, r *http.Request) (*TokenResponse, error) {
+	raw := r.PostForm.Get("code")
+	if len(raw) == 0 {
+		return nil, invalidRequest("missing code")
+	}
+	code, err := h.cfg.Codes.Exchange(c.ID, raw,
+		r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	if err != nil {
+		return nil, err
+	}
+	return h.issueRefresh(&Token{
+		Subject:  code.Subject,
+		ClientID: c.ID,
+		Scope:    code.Scope,
+	}, code.Scope)
+}
+
+// refreshToken refresh_token grant, see RFC 6749 section 6, the refresh
+// token is consumed and a new one of the original scope is issued. Tokens of
+// other clients are refused before they are consumed.
+func (h *TokenEndpoint) refreshToken(c *Client, r *http.Request) (*TokenResponse, error) {
+	raw := r.PostForm.Get("refresh_token")
+	if len(raw) == 0 {
+		return nil, invalidRequest("missing refresh_token")
+	}
+	e, err := h.cfg.Refresh.Lookup(raw)
+	if err == token.ErrNotfound {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	old := &Token{TK: raw}
+	ok, err := old.Verify(e.Data)
+	if err != nil || !ok || old.ClientID != c.ID {
+		return nil, ErrInvalidGrant
+	}
+	ok, err = h.cfg.Refresh.VerifyAndConsume(old, GrantRefreshToken)
+	if err == token.ErrPurpose {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok || old.ClientID != c.ID {
+		return nil, ErrInvalidGrant
+	}
+	scope := old.Scope
+	if s := r.PostForm.Get("scope"); len(s) > 0 {
+		if !subset(s, strings.Fields(old.Scope)) {
+			return nil, ErrInvalidScope
+		}
+		scope = s
+	}
+	return h.issueRefresh(&Token{
+		Subject:  old.Subject,
+		ClientID: c.ID,
+		Scope:    scope,
+	}, old.Scope)
+}
+
+// deviceCode device_code grant, see RFC 8628 section 3.4
+func (h *TokenEndpoint) deviceCode(c *Client, r *http.Request) (*TokenResponse, error) {
+	raw := r.PostForm.Get("device_code")
+	if len(raw) == 0 {
+		return nil, invalidRequest("missing device_code")
+	}
+	rec, subject, err := h.cfg.Devices.poll(c.ID, raw)
+	if err != nil {
+		return nil, err
+	}
+	return h.issueRefresh(&Token{
+		Subject:  subject,
+		ClientID: c.ID,
+		Scope:    rec.Scope,
+	}, rec.Scope)
+}
@@ -0,0 +1,214 @@
+package oauth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// TokenTypeAccessToken token type of access tokens, see RFC 8693 section 3
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// DefaultExchangeLifetime default lifetime of exchanged tokens
+const DefaultExchangeLifetime = 5 * time.Minute
+
+// Delegation manager of subject tokens, exchanged tokens are saved in it as
+// children of their subject token, implemented by every backend
+type Delegation interface {
+	token.HierarchyManager
+	// Expire set remaining ttl of token
+	Expire(tk string, ttl time.Duration) error
+}
+
+// ExchangeConfig token exchange config
+type ExchangeConfig struct {
+	// Subjects manager of subject tokens which may be exchanged, it is
+	// usually the Access manager of token endpoint. Exchanged tokens are
+	// saved in it with the subject token as parent and their own lifetime.
+	Subjects Delegation
+	// Actors manager of actor tokens, default is Subjects
+	Actors token.SessionManager
+	// Lifetime maximum lifetime of exchanged tokens, default is
+	// DefaultExchangeLifetime
+	Lifetime time.Duration
+	// Clock time source, default is token.SystemClock
+	Clock token.Clock
+}
+
+// Exchange token exchange, see RFC 8693. Exchanged tokens are downscoped,
+// never outlive their parent and are revoked with the parent by Subjects.
+type Exchange struct {
+	cfg ExchangeConfig
+}
+
+// NewExchange new token exchange
+func NewExchange(cfg ExchangeConfig) *Exchange {
+	if cfg.Actors == nil {
+		cfg.Actors = cfg.Subjects
+	}
+	if cfg.Lifetime <= 0 {
+		cfg.Lifetime = DefaultExchangeLifetime
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = token.SystemClock
+	}
+	return &Exchange{cfg: cfg}
+}
+
+// Manager wrap mgr so that Verify also rejects exchanged tokens past the
+// expiry of their payload. Subjects keeps the lifetime by Expire which is
+// respected by Verify of every backend, so the wrapper is only needed to
+// verify by another manager.
+func (e *Exchange) Manager(mgr token.SessionManager) token.SessionManager {
+	return &delegated{SessionManager: mgr, e: e}
+}
+
+type delegated struct {
+	token.SessionManager
+	e *Exchange
+}
+
+// Verify verify token and its expiry
+func (m *delegated) Verify(tk token.Token) (bool, error) {
+	ok, err := m.SessionManager.Verify(tk)
+	if err != nil || !ok {
+		return ok, err
+	}
+	return !m.e.expired(tk), nil
+}
+
+// expired returns whether verified token is exchanged token which is expired
+func (e *Exchange) expired(tk token.Token) bool {
+	t, ok := tk.(*Token)
+	return ok && t.Expires > 0 && e.cfg.Clock.Now().Unix() >= t.Expires
+}
+
+// subject returns verified subject token and the time it expires at, zero
+// time means never
+func (e *Exchange) subject(raw string) (*Token, time.Time, error) {
+	tk := &Token{TK: raw}
+	ok, err := e.Manager(e.cfg.Subjects).Verify(tk)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !ok {
+		return nil, time.Time{}, ErrInvalidGrant
+	}
+	s, err := e.cfg.Subjects.Session(raw)
+	if err == token.ErrNotfound {
+		return nil, time.Time{}, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var exp time.Time
+	if s.TTL > 0 {
+		exp = e.cfg.Clock.Now().Add(s.TTL)
+	}
+	if tk.Expires > 0 && (exp.IsZero() || tk.Expires < exp.Unix()) {
+		exp = time.Unix(tk.Expires, 0)
+	}
+	return tk, exp, nil
+}
+
+// exchange returns token exchanged from subject token for client, actor is
+// the subject of actor token or the client itself
+func (e *Exchange) exchange(c *Client, r *http.Request) (*Token, string, error) {
+	form := r.PostForm
+	raw := form.Get("subject_token")
+	if len(raw) == 0 {
+		return nil, "", invalidRequest("missing subject_token")
+	}
+	if form.Get("subject_token_type") != TokenTypeAccessToken {
+		return nil, "", invalidRequest("unsupported subject_token_type")
+	}
+	if t := form.Get("requested_token_type"); len(t) > 0 && t != TokenTypeAccessToken {
+		return nil, "", invalidRequest("unsupported requested_token_type")
+	}
+	subject, exp, err := e.subject(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	actor := c.ID
+	if actorToken := form.Get("actor_token"); len(actorToken) > 0 {
+		if form.Get("actor_token_type") != TokenTypeAccessToken {
+			return nil, "", invalidRequest("unsupported actor_token_type")
+		}
+		tk := &Token{TK: actorToken}
+		ok, err := e.Manager(e.cfg.Actors).Verify(tk)
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			return nil, "", ErrInvalidGrant
+		}
+		actor = tk.Subject
+	}
+	scope := subject.Scope
+	if s := form.Get("scope"); len(s) > 0 {
+		if !subset(s, strings.Fields(subject.Scope)) {
+			return nil, "", ErrInvalidScope
+		}
+		scope = s
+	}
+	now := e.cfg.Clock.Now()
+	if max := now.Add(e.cfg.Lifetime); exp.IsZero() || max.Before(exp) {
+		exp = max
+	}
+	// unix seconds are rounded down so the token never outlives the parent
+	if exp.Unix() <= now.Unix() {
+		return nil, "", ErrInvalidGrant
+	}
+	return &Token{
+		Subject:  subject.Subject,
+		ClientID: c.ID,
+		Scope:    scope,
+		Act:      &Actor{Sub: actor, Act: subject.Act},
+		Expires:  exp.Unix(),
+	}, raw, nil
+}
+
+// issue save exchanged token as child of subject token parent, the stored
+// token expires with the exchanged token
+func (e *Exchange) issue(tk *Token, parent string) (*TokenResponse, error) {
+	raw, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+	tk.TK = raw
+	err = e.cfg.Subjects.SaveSession(tk, token.Meta{Parent: parent})
+	if err == token.ErrNotfound {
+		// the parent is revoked since it was verified
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := e.cfg.Clock.Now()
+	err = e.cfg.Subjects.Expire(raw, time.Unix(tk.Expires, 0).Sub(now))
+	if err != nil {
+		e.cfg.Subjects.Revoke(tk.Subject, raw)
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken:     raw,
+		TokenType:       "Bearer",
+		ExpiresIn:       tk.Expires - now.Unix(),
+		Scope:           tk.Scope,
+		IssuedTokenType: TokenTypeAccessToken,
+	}, nil
+}
+
+// tokenExchange token-exchange grant, see RFC 8693 section 2
+func (h *TokenEndpoint) tokenExchange(c *Client, r *http.Request) (*TokenResponse, error) {
+	if c.Public() {
+		return nil, ErrUnauthorizedClient
+	}
+	tk, parent, err := h.cfg.Exchange.exchange(c, r)
+	if err != nil {
+		return nil, err
+	}
+	return h.cfg.Exchange.issue(tk, parent)
+}
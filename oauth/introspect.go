@@ -0,0 +1,180 @@
+package oauth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/dpop"
+)
+
+// Introspection introspection response, see RFC 7662 section 2.2
+type Introspection struct {
+	Active    bool          `json:"active"`
+	Scope     string        `json:"scope,omitempty"`
+	ClientID  string        `json:"client_id,omitempty"`
+	Username  string        `json:"username,omitempty"`
+	TokenType string        `json:"token_type,omitempty"`
+	Exp       int64         `json:"exp,omitempty"`
+	Iat       int64         `json:"iat,omitempty"`
+	Sub       string        `json:"sub,omitempty"`
+	Aud       string        `json:"aud,omitempty"`
+	Iss       string        `json:"iss,omitempty"`
+	Cnf       *Confirmation `json:"cnf,omitempty"`
+	Act       *Actor        `json:"act,omitempty"`
+	// Extra extension members, they never override the members above
+	Extra map[string]interface{} `json:"-"`
+}
+
+// Confirmation key confirmation of proof-of-possession tokens
+type Confirmation struct {
+	JKT string `json:"jkt,omitempty"`
+}
+
+// MarshalJSON marshal members with extension members
+func (i Introspection) MarshalJSON() ([]byte, error) {
+	type members Introspection
+	data, err := json.Marshal(members(i))
+	if err != nil || len(i.Extra) == 0 {
+		return data, err
+	}
+	var ret map[string]interface{}
+	err = json.Unmarshal(data, &ret)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range i.Extra {
+		if _, ok := ret[k]; !ok {
+			ret[k] = v
+		}
+	}
+	return json.Marshal(ret)
+}
+
+// TokenStore manager of tokens which reads raw entries, implemented by every
+// backend
+type TokenStore interface {
+	token.SessionManager
+	Lookup(tk string) (token.Entry, error)
+}
+
+// IntrospectionConfig introspection endpoint config
+type IntrospectionConfig struct {
+	// Mgr manager of tokens, tokens are read without Verify of manager so
+	// introspection never extends their ttl or last seen time
+	Mgr TokenStore
+	// Auth authenticate callers, it is required by RFC 7662
+	Auth Authenticator
+	// New create an empty token by the raw string for verify, default is
+	// NewToken
+	New func(tk string) token.Token
+	// Map fill response of active token, it is called after the members
+	// known by manager such as sub, exp and iat are filled, default fills
+	// scope and client_id of *Token
+	Map func(tk token.Token, s token.Session, resp *Introspection)
+	// Issuer iss member of response
+	Issuer string
+	// Clock time source, default is token.SystemClock
+	Clock token.Clock
+}
+
+// Introspect introspection endpoint, see RFC 7662
+type Introspect struct {
+	cfg IntrospectionConfig
+}
+
+// NewIntrospection new introspection endpoint
+func NewIntrospection(cfg IntrospectionConfig) *Introspect {
+	if cfg.New == nil {
+		cfg.New = NewToken
+	}
+	if cfg.Map == nil {
+		cfg.Map = MapToken
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = token.SystemClock
+	}
+	return &Introspect{cfg: cfg}
+}
+
+// MapToken fill scope, client_id and act of *Token, exp is limited by the
+// expiry of exchanged token
+func MapToken(tk token.Token, s token.Session, resp *Introspection) {
+	t, ok := tk.(*Token)
+	if !ok {
+		return
+	}
+	resp.Scope = t.Scope
+	resp.ClientID = t.ClientID
+	resp.Act = t.Act
+	if t.Expires > 0 && (resp.Exp == 0 || t.Expires < resp.Exp) {
+		resp.Exp = t.Expires
+	}
+}
+
+func (h *Introspect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !parseForm(w, r) {
+		return
+	}
+	_, err := h.cfg.Auth.Authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	raw := r.PostForm.Get("token")
+	if len(raw) == 0 {
+		writeError(w, invalidRequest("missing token"))
+		return
+	}
+	resp, err := h.Introspect(raw)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Introspect returns introspection of raw token, revoked, expired and
+// unknown tokens are inactive. The payload is checked by Verify of token.
+func (h *Introspect) Introspect(raw string) (Introspection, error) {
+	s, err := h.cfg.Mgr.Session(raw)
+	if err == token.ErrNotfound {
+		return Introspection{}, nil
+	}
+	if err != nil {
+		return Introspection{}, err
+	}
+	e, err := h.cfg.Mgr.Lookup(raw)
+	if err == token.ErrNotfound {
+		return Introspection{}, nil
+	}
+	if err != nil {
+		return Introspection{}, err
+	}
+	tk := h.cfg.New(raw)
+	ok, err := tk.Verify(e.Data)
+	if err != nil || !ok {
+		return Introspection{}, err
+	}
+	now := h.cfg.Clock.Now()
+	resp := Introspection{
+		Active:    true,
+		TokenType: "Bearer",
+		Sub:       tk.GetUID(),
+		Iat:       s.Created.Unix(),
+		Iss:       h.cfg.Issuer,
+	}
+	if s.TTL > 0 {
+		resp.Exp = now.Add(s.TTL).Unix()
+	}
+	if jkt := dpop.JKT(s.Meta); len(jkt) > 0 {
+		resp.TokenType = "DPoP"
+		resp.Cnf = &Confirmation{JKT: jkt}
+	}
+	h.cfg.Map(tk, s, &resp)
+	// exp may be limited by Map such as the expiry of exchanged token
+	if resp.Exp > 0 && resp.Exp <= now.Unix() {
+		return Introspection{}, nil
+	}
+	return resp, nil
+}
@@ -0,0 +1,186 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/httpauth"
+)
+
+// Token token issued by this package, it carries the claims reported by
+// introspection
+type Token struct {
+	TK       string `json:"tk"`
+	Subject  string `json:"sub"`
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// Act acting party of exchanged token, see RFC 8693 section 4.1
+	Act *Actor `json:"act,omitempty"`
+	// Expires unix time the exchanged token expires at, it never outlives
+	// the parent
+	Expires int64 `json:"exp,omitempty"`
+}
+
+// Actor acting party, Act is the prior actor of a delegation chain
+type Actor struct {
+	Sub string `json:"sub"`
+	Act *Actor `json:"act,omitempty"`
+}
+
+// NewToken create an empty token by the raw string for verify
+func NewToken(tk string) token.Token {
+	return &Token{TK: tk}
+}
+
+// GetTK get token
+func (t *Token) GetTK() string {
+	return t.TK
+}
+
+// GetUID get subject
+func (t *Token) GetUID() string {
+	return t.Subject
+}
+
+// GetName get client id
+func (t *Token) GetName() string {
+	return t.ClientID
+}
+
+// Serialize serialize token
+func (t *Token) Serialize() ([]byte, error) {
+	return json.Marshal(t)
+}
+
+// UnSerialize unserialize token
+func (t *Token) UnSerialize(tk string, data []byte) error {
+	err := json.Unmarshal(data, t)
+	t.TK = tk
+	return err
+}
+
+// Verify verify token
+func (t *Token) Verify(data []byte) (bool, error) {
+	var dst Token
+	err := json.Unmarshal(data, &dst)
+	if err != nil {
+		return false, err
+	}
+	if dst.TK != t.TK {
+		return false, nil
+	}
+	*t = dst
+	return true, nil
+}
+
+// random returns random string of n bytes entropy
+func random(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Error oauth error response, see RFC 6749 section 5.2
+type Error struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Description) == 0 {
+		return "oauth: " + e.Code
+	}
+	return "oauth: " + e.Code + ": " + e.Description
+}
+
+var (
+	// ErrInvalidRequest request is missing a parameter or malformed
+	ErrInvalidRequest = &Error{
+		Status:      http.StatusBadRequest,
+		Code:        "invalid_request",
+		Description: "the request is missing a required parameter or malformed",
+	}
+	// ErrInvalidClient client authentication failed
+	ErrInvalidClient = &Error{
+		Status:      http.StatusUnauthorized,
+		Code:        "invalid_client",
+		Description: "client authentication failed",
+	}
+)
+
+func invalidRequest(desc string) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: "invalid_request", Description: desc}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError write oauth error, errors other than *Error are reported as
+// server_error without details
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Status: http.StatusInternalServerError, Code: "server_error"}
+	}
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+	writeJSON(w, e.Status, e)
+}
+
+// parseForm parse POST form, other methods are rejected
+func parseForm(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, invalidRequest("malformed form"))
+		return false
+	}
+	return true
+}
+
+// Authenticator authenticate caller of endpoints, returns the client id of
+// caller or ErrInvalidClient
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// AuthenticatorFunc adapter to use function as authenticator
+type AuthenticatorFunc func(r *http.Request) (string, error)
+
+// Authenticate call fn
+func (fn AuthenticatorFunc) Authenticate(r *http.Request) (string, error) {
+	return fn(r)
+}
+
+// BearerAuth authenticate callers by bearer token saved in mgr, the uid of
+// token is returned as client id, see httpauth.Config for newToken
+func BearerAuth(mgr token.Manager, newToken func(tk string) token.Token) Authenticator {
+	auth := httpauth.New(httpauth.Config{Mgr: mgr, New: newToken})
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		tk, err := auth.Authenticate(r)
+		if _, ok := err.(*httpauth.Error); ok {
+			return "", ErrInvalidClient
+		}
+		if err != nil {
+			return "", err
+		}
+		return tk.GetUID(), nil
+	})
+}
@@ -0,0 +1,835 @@
+package oauth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/binding"
+	"github.com/lwch/token/dpop"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+func post(h http.Handler, form url.Values, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if setup != nil {
+		setup(r)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	var ret map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &ret)
+	if err != nil {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	return ret
+}
+
+func TestIntrospection(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	mgr := file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk))
+	caller := &Token{TK: "caller", Subject: "gateway"}
+	err := mgr.Save(caller)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	tk1 := &Token{TK: "tk1", Subject: "1", ClientID: "app", Scope: "read write"}
+	err = mgr.Save(tk1)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	h := NewIntrospection(IntrospectionConfig{
+		Mgr:    mgr,
+		Auth:   BearerAuth(mgr, NewToken),
+		Issuer: "https://auth.example.com",
+		Clock:  clk,
+	})
+	auth := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer caller")
+	}
+
+	clk.Add(time.Minute)
+	before, err := mgr.Session("tk1")
+	if err != nil {
+		t.Fatalf("unexpected session: %v", err)
+	}
+	w := post(h, url.Values{"token": {"tk1"}}, auth)
+	resp := decode(t, w)
+	if w.Code != http.StatusOK || resp["active"] != true || resp["sub"] != "1" ||
+		resp["scope"] != "read write" || resp["client_id"] != "app" ||
+		resp["token_type"] != "Bearer" || resp["iss"] != "https://auth.example.com" {
+		t.Fatalf("unexpected introspection: %d %v", w.Code, resp)
+	}
+	if exp := int64(resp["exp"].(float64)); exp != clk.Now().Add(59*time.Minute).Unix() {
+		t.Fatalf("unexpected exp: %d", exp)
+	}
+	// introspection is not a use of the token
+	after, err := mgr.Session("tk1")
+	if err != nil || !after.LastSeen.Equal(before.LastSeen) || after.TTL != before.TTL {
+		t.Fatalf("unexpected session after introspection: %+v, before %+v", after, before)
+	}
+
+	w = post(h, url.Values{"token": {"tk1"}}, nil)
+	if w.Code != http.StatusUnauthorized || decode(t, w)["error"] != "invalid_client" {
+		t.Fatalf("unexpected introspection without auth: %d", w.Code)
+	}
+	w = post(h, url.Values{}, auth)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_request" {
+		t.Fatalf("unexpected introspection without token: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?token=tk1", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected introspection by GET: %d", w.Code)
+	}
+
+	mgr.Revoke("1", "tk1")
+	for _, raw := range []string{"tk1", "unknown"} {
+		w = post(h, url.Values{"token": {raw}}, auth)
+		if body := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || body != `{"active":false}` {
+			t.Fatalf("unexpected introspection of %s: %d %s", raw, w.Code, body)
+		}
+	}
+
+	// key bound token with mapping hook
+	tk2 := &Token{TK: "tk2", Subject: "2"}
+	err = binding.New(mgr, dpop.Binder()).Save(tk2, binding.Context{Value: "thumbprint"}, token.Meta{})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	h = NewIntrospection(IntrospectionConfig{
+		Mgr:  mgr,
+		Auth: BearerAuth(mgr, NewToken),
+		Map: func(tk token.Token, s token.Session, resp *Introspection) {
+			resp.Username = "user-" + tk.GetUID()
+			resp.Extra = map[string]interface{}{"tenant": "acme", "sub": "override"}
+		},
+	})
+	resp = decode(t, post(h, url.Values{"token": {"tk2"}}, auth))
+	cnf, _ := resp["cnf"].(map[string]interface{})
+	if resp["token_type"] != "DPoP" || cnf["jkt"] != "thumbprint" || resp["username"] != "user-2" ||
+		resp["tenant"] != "acme" || resp["sub"] != "2" {
+		t.Fatalf("unexpected introspection of bound token: %v", resp)
+	}
+
+	clk.Add(2 * time.Hour)
+	resp = decode(t, post(NewIntrospection(IntrospectionConfig{
+		Mgr: mgr,
+		Auth: AuthenticatorFunc(func(r *http.Request) (string, error) {
+			return "test", nil
+		}),
+	}), url.Values{"token": {"tk2"}}, nil))
+	if resp["active"] != false {
+		t.Fatalf("unexpected introspection of expired token: %v", resp)
+	}
+}
+
+// basicAuth accept client "app" and "other" with secret "secret"
+var basicAuth = AuthenticatorFunc(func(r *http.Request) (string, error) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || secret != "secret" || (id != "app" && id != "other") {
+		return "", ErrInvalidClient
+	}
+	return id, nil
+})
+
+func TestRevocation(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	var actors []string
+	access := file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk),
+		token.WithObserver(token.ObserverFunc(func(e token.Event) {
+			if e.Op == token.OpRevoke {
+				actors = append(actors, e.Actor)
+			}
+		})))
+	refresh := file.NewManager(t.TempDir(), 24*time.Hour)
+	for _, tk := range []*Token{
+		{TK: "at1", Subject: "1", ClientID: "app"},
+		{TK: "at2", Subject: "1", ClientID: "app"},
+	} {
+		if err := access.Save(tk); err != nil {
+			t.Fatalf("unexpected save token: %v", err)
+		}
+	}
+	err := refresh.Save(&Token{TK: "rt1", Subject: "1", ClientID: "app"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	h := NewRevocation(RevocationConfig{
+		Access:  access,
+		Refresh: refresh,
+		Auth:    basicAuth,
+	})
+	as := func(client string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.SetBasicAuth(client, "secret")
+		}
+	}
+
+	w := post(h, url.Values{"token": {"at1"}}, nil)
+	if w.Code != http.StatusUnauthorized || decode(t, w)["error"] != "invalid_client" {
+		t.Fatalf("unexpected revoke without auth: %d", w.Code)
+	}
+	clk.Add(30 * time.Minute)
+	w = post(h, url.Values{"token": {"at1"}}, as("other"))
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "unauthorized_client" {
+		t.Fatalf("unexpected revoke by other client: %d", w.Code)
+	}
+	s, err := access.Session("at1")
+	if err != nil || s.TTL != 30*time.Minute {
+		t.Fatalf("unexpected session after revoke by other client: %+v, %v", s, err)
+	}
+
+	cases := []struct {
+		raw  string
+		hint string
+		mgr  token.Manager
+	}{
+		{"at1", HintAccessToken, access},
+		{"rt1", HintAccessToken, refresh},
+		{"at2", HintRefreshToken, access},
+		{"unknown", "", nil},
+		{"at1", "unknown_hint", nil},
+	}
+	for _, c := range cases {
+		w = post(h, url.Values{"token": {c.raw}, "token_type_hint": {c.hint}}, as("app"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected revoke of %s: %d %s", c.raw, w.Code, w.Body.String())
+		}
+		if c.mgr == nil {
+			continue
+		}
+		ok, err := c.mgr.Verify(NewToken(c.raw))
+		if err != nil || ok {
+			t.Fatalf("token %s is not revoked: %v", c.raw, err)
+		}
+	}
+	if len(actors) != 2 || actors[0] != "app" || actors[1] != "app" {
+		t.Fatalf("unexpected actors of revoke: %v", actors)
+	}
+}
+
+func testClientCredentials(t *testing.T, reg Registry) {
+	access := file.NewManager(t.TempDir(), time.Hour)
+	h := NewTokenEndpoint(TokenConfig{Clients: reg, Access: access})
+	form := func(kv ...string) url.Values {
+		ret := url.Values{"grant_type": {GrantClientCredentials}}
+		for i := 0; i+1 < len(kv); i += 2 {
+			ret.Set(kv[i], kv[i+1])
+		}
+		return ret
+	}
+	basic := func(id, secret string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+		}
+	}
+
+	w := post(h, form("scope", "read"), basic("svc", "s3cret:+&"))
+	resp := decode(t, w)
+	if w.Code != http.StatusOK || resp["token_type"] != "Bearer" || resp["scope"] != "read" ||
+		resp["expires_in"] != float64(3600) || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("unexpected token response: %d %v", w.Code, resp)
+	}
+	tk := NewToken(resp["access_token"].(string)).(*Token)
+	ok, err := access.Verify(tk)
+	if err != nil || !ok || tk.Subject != "svc" || tk.ClientID != "svc" {
+		t.Fatalf("unexpected issued token: %+v %v", tk, err)
+	}
+
+	w = post(h, form("client_id", "svc", "client_secret", "s3cret:+&"), nil)
+	resp = decode(t, w)
+	if w.Code != http.StatusOK || resp["scope"] != "read write" {
+		t.Fatalf("unexpected token response by post: %d %v", w.Code, resp)
+	}
+
+	cases := []struct {
+		form   url.Values
+		setup  func(r *http.Request)
+		status int
+		code   string
+	}{
+		{form(), basic("svc", "wrong"), http.StatusUnauthorized, "invalid_client"},
+		{form(), basic("unknown", "s3cret:+&"), http.StatusUnauthorized, "invalid_client"},
+		{form(), nil, http.StatusUnauthorized, "invalid_client"},
+		{form("client_secret", "s3cret:+&"), basic("svc", "s3cret:+&"), http.StatusBadRequest, "invalid_request"},
+		{form("scope", "admin"), basic("svc", "s3cret:+&"), http.StatusBadRequest, "invalid_scope"},
+		{form("grant_type", "password"), basic("svc", "s3cret:+&"), http.StatusBadRequest, "unsupported_grant_type"},
+		{form(), basic("web", "secret"), http.StatusBadRequest, "unauthorized_client"},
+		{form("client_id", "spa"), nil, http.StatusBadRequest, "unauthorized_client"},
+	}
+	for i, c := range cases {
+		w := post(h, c.form, c.setup)
+		if w.Code != c.status || decode(t, w)["error"] != c.code {
+			t.Fatalf("unexpected response of case %d: %d %s", i, w.Code, w.Body.String())
+		}
+	}
+}
+
+var testClients = []*Client{
+	{ID: "svc", SecretHash: HashSecret("s3cret:+&"), Scopes: []string{"read", "write"}},
+	{ID: "web", SecretHash: HashSecret("secret"), Scopes: []string{"profile", "email"},
+		Grants: []string{"authorization_code", "refresh_token"}, RedirectURIs: []string{"https://web/cb"}},
+	{ID: "spa", Scopes: []string{"profile"}, RedirectURIs: []string{"https://spa/cb", "https://spa/cb2"}},
+}
+
+func TestClientCredentialsMemory(t *testing.T) {
+	testClientCredentials(t, NewMemoryRegistry(testClients...))
+}
+
+func TestClientCredentialsFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "clients.json")
+	data, _ := json.Marshal(testClients[:1])
+	err := ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		t.Fatalf("unexpected write clients: %v", err)
+	}
+	reg, err := NewFileRegistry(name)
+	if err != nil {
+		t.Fatalf("unexpected open registry: %v", err)
+	}
+	_, err = reg.Client("web")
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected client: %v", err)
+	}
+	data, _ = json.Marshal(testClients)
+	err = ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		t.Fatalf("unexpected write clients: %v", err)
+	}
+	mtime := time.Now().Add(time.Second)
+	os.Chtimes(name, mtime, mtime)
+	testClientCredentials(t, reg)
+}
+
+func TestAuthorizationCode(t *testing.T) {
+	reg := NewMemoryRegistry(testClients...)
+	codes := NewCodeStore(file.NewManager(t.TempDir(), time.Minute))
+	access := file.NewManager(t.TempDir(), time.Hour)
+	refresh := file.NewManager(t.TempDir(), 24*time.Hour)
+	h := NewTokenEndpoint(TokenConfig{
+		Clients: reg,
+		Access:  access,
+		Refresh: refresh,
+		Codes:   codes,
+	})
+	verifier := strings.Repeat("v", 43)
+	authorize := func(query string) (*AuthorizeRequest, error) {
+		return ParseAuthorize(reg, httptest.NewRequest("GET", "/authorize?"+query, nil))
+	}
+	approve := func(client, redirect string) string {
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {client},
+			"redirect_uri":          {redirect},
+			"state":                 {"xyz"},
+			"scope":                 {"profile"},
+			"code_challenge":        {Challenge(verifier)},
+			"code_challenge_method": {"S256"},
+		}
+		req, err := authorize(q.Encode())
+		if err != nil {
+			t.Fatalf("unexpected authorize: %v", err)
+		}
+		loc, err := codes.Approve(req, "alice")
+		if err != nil {
+			t.Fatalf("unexpected approve: %v", err)
+		}
+		u, _ := url.Parse(loc)
+		if !strings.HasPrefix(loc, redirect+"?") || u.Query().Get("state") != "xyz" {
+			t.Fatalf("unexpected redirect: %s", loc)
+		}
+		return u.Query().Get("code")
+	}
+	webAuth := func(r *http.Request) { r.SetBasicAuth("web", "secret") }
+	exchange := func(code, redirect, verifier string) url.Values {
+		return url.Values{
+			"grant_type":    {GrantAuthorizationCode},
+			"code":          {code},
+			"redirect_uri":  {redirect},
+			"code_verifier": {verifier},
+		}
+	}
+
+	code := approve("web", "https://web/cb")
+	w := post(h, exchange(code, "https://web/cb", verifier), webAuth)
+	resp := decode(t, w)
+	if w.Code != http.StatusOK || resp["scope"] != "profile" || resp["refresh_token"] == nil {
+		t.Fatalf("unexpected token response: %d %v", w.Code, resp)
+	}
+	tk := NewToken(resp["access_token"].(string)).(*Token)
+	ok, err := access.Verify(tk)
+	if err != nil || !ok || tk.Subject != "alice" || tk.ClientID != "web" {
+		t.Fatalf("unexpected issued token: %+v %v", tk, err)
+	}
+	w = post(h, exchange(code, "https://web/cb", verifier), webAuth)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+		t.Fatalf("code is used twice: %d %s", w.Code, w.Body.String())
+	}
+
+	// refresh token is rotated and can not out-scope the original grant
+	rt := resp["refresh_token"].(string)
+	refreshForm := func(rt, scope string) url.Values {
+		return url.Values{"grant_type": {GrantRefreshToken}, "refresh_token": {rt}, "scope": {scope}}
+	}
+	w = post(h, refreshForm(rt, "profile email"), webAuth)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_scope" {
+		t.Fatalf("unexpected refresh with wider scope: %d %s", w.Code, w.Body.String())
+	}
+	code = approve("web", "https://web/cb")
+	w = post(h, exchange(code, "https://web/cb", verifier), webAuth)
+	rt = decode(t, w)["refresh_token"].(string)
+	w = post(h, refreshForm(rt, ""), webAuth)
+	resp = decode(t, w)
+	if w.Code != http.StatusOK || resp["scope"] != "profile" || resp["refresh_token"] == rt {
+		t.Fatalf("unexpected refresh response: %d %v", w.Code, resp)
+	}
+	w = post(h, refreshForm(rt, ""), webAuth)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+		t.Fatalf("refresh token is used twice: %d %s", w.Code, w.Body.String())
+	}
+
+	// refresh token of other client is refused and kept
+	rt = resp["refresh_token"].(string)
+	form := refreshForm(rt, "")
+	form.Set("client_id", "spa")
+	w = post(h, form, nil)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+		t.Fatalf("unexpected refresh by other client: %d %s", w.Code, w.Body.String())
+	}
+	w = post(h, refreshForm(rt, ""), webAuth)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh token is consumed by other client: %d %s", w.Code, w.Body.String())
+	}
+
+	// public client with PKCE only, the code is consumed by failed attempts
+	cases := []struct {
+		redirect string
+		verifier string
+	}{
+		{"https://spa/cb2", verifier},
+		{"https://spa/cb", strings.Repeat("w", 43)},
+		{"https://spa/cb", "short"},
+	}
+	for i, c := range cases {
+		code := approve("spa", "https://spa/cb")
+		form := exchange(code, c.redirect, c.verifier)
+		form.Set("client_id", "spa")
+		w := post(h, form, nil)
+		if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+			t.Fatalf("unexpected response of case %d: %d %s", i, w.Code, w.Body.String())
+		}
+		form = exchange(code, "https://spa/cb", verifier)
+		form.Set("client_id", "spa")
+		w = post(h, form, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("code is not consumed of case %d: %d %s", i, w.Code, w.Body.String())
+		}
+	}
+	code = approve("spa", "https://spa/cb")
+	w = post(h, exchange(code, "https://spa/cb", verifier), webAuth)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+		t.Fatalf("code of another client is exchanged: %d %s", w.Code, w.Body.String())
+	}
+
+	// redirect_uri is only required by token request when it is included in
+	// authorization request
+	implicit := func() string {
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {"web"},
+			"code_challenge":        {Challenge(verifier)},
+			"code_challenge_method": {"S256"},
+		}
+		req, err := authorize(q.Encode())
+		if err != nil || req.ExplicitRedirect {
+			t.Fatalf("unexpected authorize: %+v %v", req, err)
+		}
+		loc, err := codes.Approve(req, "alice")
+		if err != nil || !strings.HasPrefix(loc, "https://web/cb?") {
+			t.Fatalf("unexpected approve: %s %v", loc, err)
+		}
+		u, _ := url.Parse(loc)
+		return u.Query().Get("code")
+	}
+	for _, redirect := range []string{"", "https://web/cb"} {
+		w = post(h, exchange(implicit(), redirect, verifier), webAuth)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected exchange of %q without redirect_uri in request: %d %s",
+				redirect, w.Code, w.Body.String())
+		}
+	}
+	w = post(h, exchange(implicit(), "https://evil/cb", verifier), webAuth)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+		t.Fatalf("unexpected exchange with other redirect_uri: %d %s", w.Code, w.Body.String())
+	}
+	w = post(h, exchange(approve("web", "https://web/cb"), "", verifier), webAuth)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+		t.Fatalf("unexpected exchange without explicit redirect_uri: %d %s", w.Code, w.Body.String())
+	}
+
+	// invalid authorization requests
+	_, err = authorize("response_type=code&client_id=web&redirect_uri=https://evil/cb")
+	if err == nil {
+		t.Fatal("unregistered redirect_uri is accepted")
+	}
+	req, err := authorize("response_type=code&client_id=web&state=s")
+	if err == nil || req == nil || req.RedirectURI != "https://web/cb" {
+		t.Fatalf("missing challenge is accepted: %v", err)
+	}
+	loc := req.ErrorURL(err)
+	if loc != "https://web/cb?error=invalid_request&error_description=S256+code+challenge+is+required&state=s" {
+		t.Fatalf("unexpected error url: %s", loc)
+	}
+	_, err = authorize("response_type=code&client_id=web&code_challenge=x&code_challenge_method=plain")
+	if err == nil {
+		t.Fatal("plain challenge is accepted")
+	}
+	_, err = authorize("response_type=code&client_id=svc&code_challenge=x&code_challenge_method=S256")
+	if err == nil {
+		t.Fatal("client without redirect_uri is accepted")
+	}
+}
+
+func testDevice(t *testing.T, mgr token.OneTimeManager, kv token.KV, clk *tokentest.Clock) {
+	reg := NewMemoryRegistry(append(testClients, &Client{
+		ID:     "tv",
+		Scopes: []string{"profile"},
+		Grants: []string{GrantDeviceCode},
+	})...)
+	devices := NewDeviceFlow(DeviceConfig{
+		Clients:         reg,
+		Mgr:             mgr,
+		KV:              kv,
+		VerificationURI: "https://example.com/device",
+		Clock:           clk,
+	})
+	access := file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk))
+	h := NewTokenEndpoint(TokenConfig{Clients: reg, Access: access, Devices: devices})
+	authorize := func() (string, string) {
+		w := post(devices, url.Values{"client_id": {"tv"}}, nil)
+		resp := decode(t, w)
+		if w.Code != http.StatusOK || resp["expires_in"] != float64(600) || resp["interval"] != float64(5) ||
+			resp["verification_uri_complete"] != "https://example.com/device?user_code="+resp["user_code"].(string) {
+			t.Fatalf("unexpected device response: %d %v", w.Code, resp)
+		}
+		return resp["device_code"].(string), resp["user_code"].(string)
+	}
+	poll := func(client, code string) *httptest.ResponseRecorder {
+		return post(h, url.Values{
+			"grant_type":  {GrantDeviceCode},
+			"client_id":   {client},
+			"device_code": {code},
+		}, nil)
+	}
+	expect := func(w *httptest.ResponseRecorder, code string) {
+		t.Helper()
+		if w.Code != http.StatusBadRequest || decode(t, w)["error"] != code {
+			t.Fatalf("unexpected poll response, want %s: %d %s", code, w.Code, w.Body.String())
+		}
+	}
+
+	device, user := authorize()
+	expect(poll("tv", device), "authorization_pending")
+	expect(poll("tv", device), "slow_down")
+	clk.Add(6 * time.Second)
+	expect(poll("tv", device), "authorization_pending")
+	expect(poll("spa", device), "invalid_grant")
+
+	// user codes are matched without case and separator
+	rec, err := devices.Pending(strings.ToLower(strings.Replace(user, "-", "", 1)))
+	if err != nil || rec.ClientID != "tv" || rec.Scope != "profile" {
+		t.Fatalf("unexpected pending record: %+v %v", rec, err)
+	}
+	err = devices.Approve(user, "alice")
+	if err != nil {
+		t.Fatalf("unexpected approve: %v", err)
+	}
+	if err = devices.Deny(user); err != token.ErrNotfound {
+		t.Fatalf("user code is decided twice: %v", err)
+	}
+	clk.Add(6 * time.Second)
+	w := poll("tv", device)
+	resp := decode(t, w)
+	if w.Code != http.StatusOK || resp["scope"] != "profile" {
+		t.Fatalf("unexpected token response: %d %v", w.Code, resp)
+	}
+	tk := NewToken(resp["access_token"].(string)).(*Token)
+	ok, err := access.Verify(tk)
+	if err != nil || !ok || tk.Subject != "alice" || tk.ClientID != "tv" {
+		t.Fatalf("unexpected issued token: %+v %v", tk, err)
+	}
+	expect(poll("tv", device), "invalid_grant")
+
+	device, user = authorize()
+	err = devices.Deny(user)
+	if err != nil {
+		t.Fatalf("unexpected deny: %v", err)
+	}
+	expect(poll("tv", device), "access_denied")
+	expect(poll("tv", device), "invalid_grant")
+
+	device, user = authorize()
+	clk.Add(11 * time.Minute)
+	if _, err = devices.Pending(user); err != token.ErrNotfound {
+		t.Fatalf("expired user code is pending: %v", err)
+	}
+	if err = devices.Approve(user, "alice"); err != token.ErrNotfound {
+		t.Fatalf("expired user code is approved: %v", err)
+	}
+	expect(poll("tv", device), "expired_token")
+
+	// user codes in use are drawn again
+	codes := []string{"BCDF-GHJK", "BCDF-GHJK", "LMNP-QRST"}
+	newUserCode = func() (string, error) {
+		code := codes[0]
+		if len(codes) > 1 {
+			codes = codes[1:]
+		}
+		return code, nil
+	}
+	defer func() { newUserCode = randomUserCode }()
+	first, _ := authorize()
+	second, user := authorize()
+	if user != "LMNP-QRST" {
+		t.Fatalf("unexpected user code of collision: %s", user)
+	}
+	for code, device := range map[string]string{"BCDF-GHJK": first, "LMNP-QRST": second} {
+		rec, err := devices.Pending(code)
+		if err != nil || rec.TK != device {
+			t.Fatalf("unexpected pending record of %s: %+v %v", code, rec, err)
+		}
+	}
+	w = post(devices, url.Values{"client_id": {"tv"}}, nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected device response without free user code: %d %s", w.Code, w.Body.String())
+	}
+	newUserCode = randomUserCode
+
+	w = post(devices, url.Values{"client_id": {"tv"}, "scope": {"admin"}}, nil)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_scope" {
+		t.Fatalf("unexpected device response: %d %s", w.Code, w.Body.String())
+	}
+	w = post(devices, url.Values{}, func(r *http.Request) { r.SetBasicAuth("web", "secret") })
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "unauthorized_client" {
+		t.Fatalf("unexpected device response: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeviceFile(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	mgr := file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk))
+	testDevice(t, mgr, mgr.KV(), clk)
+}
+
+func TestDeviceRedis(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	srv.SetClock(clk)
+	mgr := redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, time.Hour, token.WithClock(clk))
+	testDevice(t, mgr, mgr.KV(), clk)
+}
+
+func TestTokenExchange(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	access := file.NewManager(t.TempDir(), time.Hour, token.WithClock(clk))
+	ex := NewExchange(ExchangeConfig{Subjects: access, Clock: clk})
+	h := NewTokenEndpoint(TokenConfig{
+		Clients:  NewMemoryRegistry(testClients...),
+		Access:   access,
+		Exchange: ex,
+	})
+	for _, tk := range []*Token{
+		{TK: "user", Subject: "alice", ClientID: "web", Scope: "profile email"},
+		{TK: "batch", Subject: "batch-job", ClientID: "svc"},
+	} {
+		err := access.Save(tk)
+		if err != nil {
+			t.Fatalf("unexpected save token: %v", err)
+		}
+	}
+	svc := func(r *http.Request) { r.SetBasicAuth("svc", url.QueryEscape("s3cret:+&")) }
+	exchange := func(subject string, kv ...string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":         {GrantTokenExchange},
+			"subject_token":      {subject},
+			"subject_token_type": {TokenTypeAccessToken},
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			form.Set(kv[i], kv[i+1])
+		}
+		return post(h, form, svc)
+	}
+	verify := func(raw string) (*Token, bool) {
+		tk := NewToken(raw).(*Token)
+		ok, err := ex.Manager(access).Verify(tk)
+		if err != nil {
+			t.Fatalf("unexpected verify: %v", err)
+		}
+		return tk, ok
+	}
+
+	w := exchange("user", "scope", "profile")
+	resp := decode(t, w)
+	if w.Code != http.StatusOK || resp["scope"] != "profile" || resp["expires_in"] != float64(300) ||
+		resp["issued_token_type"] != TokenTypeAccessToken {
+		t.Fatalf("unexpected exchange response: %d %v", w.Code, resp)
+	}
+	child := resp["access_token"].(string)
+	tk, ok := verify(child)
+	if !ok || tk.Subject != "alice" || tk.ClientID != "svc" ||
+		tk.Act == nil || tk.Act.Sub != "svc" || tk.Act.Act != nil {
+		t.Fatalf("unexpected exchanged token: %+v", tk)
+	}
+	// the parent is kept by manager with the lifetime of exchanged token
+	sess, err := access.Session(child)
+	if err != nil || sess.Meta.Parent != "user" ||
+		sess.TTL <= 4*time.Minute+59*time.Second || sess.TTL > 5*time.Minute {
+		t.Fatalf("unexpected session of exchanged token: %+v %v", sess, err)
+	}
+	e, err := access.Lookup(child)
+	if err != nil || strings.Contains(string(e.Data), `"user"`) {
+		t.Fatalf("parent is stored in payload: %s %v", e.Data, err)
+	}
+
+	// delegation chain of the exchanged token acted by the batch job
+	w = exchange(child, "actor_token", "batch", "actor_token_type", TokenTypeAccessToken)
+	resp = decode(t, w)
+	if w.Code != http.StatusOK || resp["scope"] != "profile" {
+		t.Fatalf("unexpected exchange response: %d %v", w.Code, resp)
+	}
+	grandchild := resp["access_token"].(string)
+	tk, ok = verify(grandchild)
+	if !ok || tk.Subject != "alice" || tk.Act.Sub != "batch-job" ||
+		tk.Act.Act == nil || tk.Act.Act.Sub != "svc" {
+		t.Fatalf("unexpected delegated token: %+v %+v", tk, tk.Act)
+	}
+	intro, err := NewIntrospection(IntrospectionConfig{Mgr: access, Clock: clk}).Introspect(grandchild)
+	if err != nil || !intro.Active || intro.Act == nil || intro.Act.Act.Sub != "svc" ||
+		intro.Exp != tk.Expires {
+		t.Fatalf("unexpected introspection: %+v %v", intro, err)
+	}
+
+	cases := []struct {
+		w    *httptest.ResponseRecorder
+		code string
+	}{
+		{exchange(child, "scope", "email"), "invalid_scope"},
+		{exchange("user", "scope", "profile admin"), "invalid_scope"},
+		{exchange("unknown"), "invalid_grant"},
+		{exchange("user", "subject_token_type", "urn:ietf:params:oauth:token-type:jwt"), "invalid_request"},
+		{exchange("user", "actor_token", "unknown", "actor_token_type", TokenTypeAccessToken), "invalid_grant"},
+		{post(h, url.Values{
+			"grant_type":         {GrantTokenExchange},
+			"client_id":          {"spa"},
+			"subject_token":      {"user"},
+			"subject_token_type": {TokenTypeAccessToken},
+		}, nil), "unauthorized_client"},
+	}
+	for i, c := range cases {
+		if c.w.Code != http.StatusBadRequest || decode(t, c.w)["error"] != c.code {
+			t.Fatalf("unexpected response of case %d: %d %s", i, c.w.Code, c.w.Body.String())
+		}
+	}
+
+	// exchanged tokens do not outlive their parent
+	clk.Add(58 * time.Minute)
+	if _, ok = verify(child); ok {
+		t.Fatal("exchanged token outlives its lifetime")
+	}
+	intro, err = NewIntrospection(IntrospectionConfig{Mgr: access, Clock: clk}).Introspect(child)
+	if err != nil || intro.Active {
+		t.Fatalf("unexpected introspection of expired exchanged token: %+v %v", intro, err)
+	}
+	w = exchange("user")
+	resp = decode(t, w)
+	if w.Code != http.StatusOK || resp["expires_in"].(float64) > 120 || resp["scope"] != "profile email" {
+		t.Fatalf("unexpected exchange response: %d %v", w.Code, resp)
+	}
+	child = resp["access_token"].(string)
+	w = exchange(child)
+	grandchild = decode(t, w)["access_token"].(string)
+	if _, ok = verify(grandchild); !ok {
+		t.Fatal("unexpected invalid delegated token")
+	}
+
+	// revoking the parent revokes every descendant
+	access.Revoke("alice", "user")
+	for _, raw := range []string{child, grandchild} {
+		if _, ok = verify(raw); ok {
+			t.Fatalf("token %s is valid after its parent is revoked", raw)
+		}
+		if _, err = access.Session(raw); err != token.ErrNotfound {
+			t.Fatalf("token %s is kept after its parent is revoked: %v", raw, err)
+		}
+	}
+	w = exchange(child)
+	if w.Code != http.StatusBadRequest || decode(t, w)["error"] != "invalid_grant" {
+		t.Fatalf("unexpected exchange of revoked chain: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenExchangeRedis(t *testing.T) {
+	clk := tokentest.NewClock(time.Now())
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	srv.SetClock(clk)
+	access := redis.NewManager(redis.RedisConf{
+		Addrs: []string{srv.Addr()},
+	}, time.Hour, token.WithClock(clk))
+	h := NewTokenEndpoint(TokenConfig{
+		Clients:  NewMemoryRegistry(testClients...),
+		Access:   access,
+		Exchange: NewExchange(ExchangeConfig{Subjects: access, Clock: clk}),
+	})
+	err = access.Save(&Token{TK: "user", Subject: "alice", ClientID: "web", Scope: "profile"})
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	w := post(h, url.Values{
+		"grant_type":         {GrantTokenExchange},
+		"subject_token":      {"user"},
+		"subject_token_type": {TokenTypeAccessToken},
+	}, func(r *http.Request) { r.SetBasicAuth("svc", url.QueryEscape("s3cret:+&")) })
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected exchange response: %d %s", w.Code, w.Body.String())
+	}
+	child := decode(t, w)["access_token"].(string)
+	// Verify of manager does not extend the lifetime of exchanged token
+	for _, d := range []time.Duration{time.Minute, 5 * time.Minute} {
+		ok, err := access.Verify(NewToken(child))
+		if err != nil || !ok {
+			t.Fatalf("unexpected verify of exchanged token: %v %v", ok, err)
+		}
+		clk.Add(d)
+	}
+	ok, err := access.Verify(NewToken(child))
+	if err != nil || ok {
+		t.Fatalf("exchanged token outlives its lifetime: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,131 @@
+package oauth
+
+import (
+	"net/http"
+
+	"github.com/lwch/token"
+)
+
+// ErrUnauthorizedClient client is not allowed to do the request
+var ErrUnauthorizedClient = &Error{
+	Status:      http.StatusBadRequest,
+	Code:        "unauthorized_client",
+	Description: "the client is not authorized for this request",
+}
+
+// token type hints, see RFC 7009 section 2.1
+const (
+	HintAccessToken  = "access_token"
+	HintRefreshToken = "refresh_token"
+)
+
+// RevocationStore manager of tokens which reads raw entries and reports the
+// actor of revoke, implemented by every backend
+type RevocationStore interface {
+	TokenStore
+	RevokeBy(actor, uid, tk string)
+}
+
+// RevocationConfig revocation endpoint config, tokens are read without
+// Verify of manager so revocation requests never extend their ttl
+type RevocationConfig struct {
+	// Access manager of access tokens
+	Access RevocationStore
+	// Refresh manager of refresh tokens, it is optional
+	Refresh RevocationStore
+	// Auth authenticate clients
+	Auth Authenticator
+	// New create an empty token by the raw string for verify, default is
+	// NewToken
+	New func(tk string) token.Token
+	// Client returns the client token was issued to, tokens of other clients
+	// are refused and empty client skips the check, default returns
+	// client_id of *Token
+	Client func(tk token.Token) string
+}
+
+// Revocation revocation endpoint, see RFC 7009
+type Revocation struct {
+	cfg RevocationConfig
+}
+
+// NewRevocation new revocation endpoint
+func NewRevocation(cfg RevocationConfig) *Revocation {
+	if cfg.New == nil {
+		cfg.New = NewToken
+	}
+	if cfg.Client == nil {
+		cfg.Client = tokenClient
+	}
+	return &Revocation{cfg: cfg}
+}
+
+func tokenClient(tk token.Token) string {
+	if t, ok := tk.(*Token); ok {
+		return t.ClientID
+	}
+	return ""
+}
+
+func (h *Revocation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !parseForm(w, r) {
+		return
+	}
+	client, err := h.cfg.Auth.Authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	raw := r.PostForm.Get("token")
+	if len(raw) == 0 {
+		writeError(w, invalidRequest("missing token"))
+		return
+	}
+	err = h.Revoke(client, raw, r.PostForm.Get("token_type_hint"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Revoke revoke raw token of client, the managers are searched in order of
+// hint and unknown hints are ignored. Unknown tokens are not an error and
+// client is reported to observers as the actor.
+func (h *Revocation) Revoke(client, raw, hint string) error {
+	mgrs := []RevocationStore{h.cfg.Access, h.cfg.Refresh}
+	if hint == HintRefreshToken {
+		mgrs[0], mgrs[1] = mgrs[1], mgrs[0]
+	}
+	for _, mgr := range mgrs {
+		if mgr == nil {
+			continue
+		}
+		found, err := h.revoke(mgr, client, raw)
+		if found || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Revocation) revoke(mgr RevocationStore, client, raw string) (bool, error) {
+	e, err := mgr.Lookup(raw)
+	if err == token.ErrNotfound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	tk := h.cfg.New(raw)
+	ok, err := tk.Verify(e.Data)
+	if err != nil || !ok {
+		return false, err
+	}
+	if owner := h.cfg.Client(tk); len(owner) > 0 && owner != client {
+		return true, ErrUnauthorizedClient
+	}
+	mgr.RevokeBy(client, e.UID, raw)
+	return true, nil
+}
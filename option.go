@@ -0,0 +1,57 @@
+package token
+
+// Options options shared by all managers
+type Options struct {
+	Clock     Clock
+	Observers []Observer
+	// MaxSessions max tokens per uid, zero means unlimited
+	MaxSessions   int
+	SessionPolicy SessionPolicy
+	// NoJanitor do not purge expired tokens in background
+	NoJanitor bool
+}
+
+// Option manager option
+type Option func(*Options)
+
+// NewOptions returns default options with opts applied
+func NewOptions(opts ...Option) Options {
+	ret := Options{
+		Clock: SystemClock,
+	}
+	for _, opt := range opts {
+		opt(&ret)
+	}
+	return ret
+}
+
+// WithClock use clock instead of system clock
+func WithClock(c Clock) Option {
+	return func(o *Options) {
+		o.Clock = c
+	}
+}
+
+// WithObserver add observer of token lifecycle events
+func WithObserver(o Observer) Option {
+	return func(opt *Options) {
+		opt.Observers = append(opt.Observers, o)
+	}
+}
+
+// WithSessionLimit limit tokens per uid to max, policy decides what happens
+// on Save when the limit is reached
+func WithSessionLimit(max int, policy SessionPolicy) Option {
+	return func(opt *Options) {
+		opt.MaxSessions = max
+		opt.SessionPolicy = policy
+	}
+}
+
+// WithoutJanitor do not start the janitor which purges expired tokens in
+// background, it is used by one-shot tools which call Purge themselves
+func WithoutJanitor() Option {
+	return func(opt *Options) {
+		opt.NoJanitor = true
+	}
+}
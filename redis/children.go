@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// childrenPrefix prefix of set of children of token
+const childrenPrefix = "#children:"
+
+// linkScript add child to set of parent when the parent exists, returns 0
+// when the parent is missing
+//
+// KEYS: parent token, children of parent
+// ARGV: child token, ttl ms or 0 for no expiry
+var linkScript = redis.NewScript(`-- token:link
+if redis.call('exists', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('sadd', KEYS[2], ARGV[1])
+if tonumber(ARGV[2]) > 0 then
+	redis.call('pexpire', KEYS[2], ARGV[2])
+end
+return 1`)
+
+func (m *Mgr) childrenKey(tk string) string {
+	return m.key(childrenPrefix + tk)
+}
+
+// link run linkScript, the set lives as long as the last linked child so it
+// outlives the parent. The parent and its set must be in the same slot in
+// cluster mode, see RedisConf.HashTag.
+func (m *Mgr) link(parent, child string) error {
+	n, err := linkScript.Run(context.Background(), m.client(), []string{
+		m.key(parent),
+		m.childrenKey(parent),
+	}, child, m.ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotfound
+	}
+	return nil
+}
+
+// revokeChildren revoke every descendant of tk, the token key of tk must be
+// deleted before so no child can be linked after the set is read
+func (m *Mgr) revokeChildren(actor, tk string) {
+	var members *redis.StringSliceCmd
+	_, err := m.client().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		members = pipe.SMembers(context.Background(), m.childrenKey(tk))
+		pipe.Del(context.Background(), m.childrenKey(tk))
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, child := range members.Val() {
+		uid, err := m.client().HGet(context.Background(), m.key(indexKey), child).Result()
+		if err != nil {
+			// revoked or consumed already
+			continue
+		}
+		m.RevokeBy(actor, uid, child)
+	}
+}
+
+// Children returns tokens saved with tk as parent which are not revoked or
+// expired, ordered by token
+func (m *Mgr) Children(tk string) ([]string, error) {
+	members, err := m.client().SMembers(context.Background(), m.childrenKey(tk)).Result()
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]*redis.IntCmd, len(members))
+	_, err = m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for i, child := range members {
+			exists[i] = pipe.Exists(context.Background(), m.key(child))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	var stale []interface{}
+	for i, child := range members {
+		if exists[i].Val() == 0 {
+			stale = append(stale, child)
+			continue
+		}
+		ret = append(ret, child)
+	}
+	if len(stale) > 0 {
+		m.client().SRem(context.Background(), m.childrenKey(tk), stale...)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// unsave remove token which is rejected after it is written
+func (m *Mgr) unsave(uid, tk string) {
+	m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), m.key(tk))
+		pipe.HDel(context.Background(), m.key(indexKey), tk)
+		pipe.ZRem(context.Background(), m.sessionsKey(uid), tk)
+		pipe.Del(context.Background(), m.metaKey(tk))
+		return nil
+	})
+}
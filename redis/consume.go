@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lwch/token"
+	"github.com/lwch/token/internal/telemetry"
+)
+
+// consumeScript get and delete token when the purpose matches, returns nil
+// when the token is missing, {0} on purpose mismatch and {1, data} when the
+// token is consumed. The sessions and uid keys are those of the uid read
+// from index before, they are left alone when the token belongs to another
+// uid by then.
+//
+// KEYS: token, index, meta, sessions of uid, uid
+// ARGV: purpose, token, uid
+var consumeScript = redis.NewScript(`-- token:consume
+local data = redis.call('get', KEYS[1])
+if not data then
+	return false
+end
+local purpose = redis.call('hget', KEYS[3], 'purpose') or ''
+if purpose ~= ARGV[1] then
+	return {0}
+end
+local uid = redis.call('hget', KEYS[2], ARGV[2])
+redis.call('del', KEYS[1], KEYS[3])
+redis.call('hdel', KEYS[2], ARGV[2])
+if uid == ARGV[3] then
+	redis.call('zrem', KEYS[4], ARGV[2])
+	if redis.call('get', KEYS[5]) == ARGV[2] then
+		redis.call('del', KEYS[5])
+	end
+end
+return {1, data}`)
+
+// VerifyAndConsume verify token and delete it with its children, the token
+// is deleted even when Token.Verify rejects its payload
+func (m *Mgr) VerifyAndConsume(tk token.Token, purpose string) (bool, error) {
+	op := m.tel.Start(telemetry.OpConsume)
+	ok, gone, err := m.consume(tk, purpose)
+	op.End(ok, err)
+	m.emit(token.Event{
+		Op:    token.OpConsume,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    ok,
+		Err:   err,
+	})
+	if gone {
+		m.revokeChildren(tk.GetUID(), tk.GetTK())
+	}
+	return ok, err
+}
+
+// consume run consumeScript, every key is passed to the script so the uid
+// of token is read from index first, they must be in the same slot in
+// cluster mode, see RedisConf.HashTag. The second result reports whether
+// the token is deleted by this call.
+func (m *Mgr) consume(tk token.Token, purpose string) (bool, bool, error) {
+	uid, err := m.client().HGet(context.Background(), m.key(indexKey), tk.GetTK()).Result()
+	if err == redis.Nil {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	ret, err := consumeScript.Run(context.Background(), m.client(), []string{
+		m.key(tk.GetTK()),
+		m.key(indexKey),
+		m.metaKey(tk.GetTK()),
+		m.sessionsKey(uid),
+		m.key(uid),
+	}, purpose, tk.GetTK(), uid).Result()
+	if err == redis.Nil {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	reply, _ := ret.([]interface{})
+	if len(reply) != 2 {
+		return false, false, token.ErrPurpose
+	}
+	data, _ := reply[1].(string)
+	ok, err := tk.Verify([]byte(data))
+	return ok, true, err
+}
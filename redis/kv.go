@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lwch/token"
+)
+
+// kvKey prefix of keys used by KV
+const kvKey = "#kv:"
+
+type kv struct {
+	m *Mgr
+}
+
+// KV returns key value storage in the same redis, keys are prefixed by the
+// manager prefix
+func (m *Mgr) KV() token.KV {
+	return kv{m: m}
+}
+
+func (s kv) key(key string) string {
+	return s.m.key(kvKey + key)
+}
+
+func (s kv) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.m.client().SetNX(context.Background(), s.key(key), value, ttl).Result()
+}
+
+func (s kv) Set(key string, value []byte, ttl time.Duration) error {
+	return s.m.client().Set(context.Background(), s.key(key), value, ttl).Err()
+}
+
+func (s kv) Load(key string) ([]byte, time.Duration, error) {
+	var data *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := s.m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		data = pipe.Get(context.Background(), s.key(key))
+		ttl = pipe.PTTL(context.Background(), s.key(key))
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, 0, ErrNotfound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	d := ttl.Val()
+	if d < 0 {
+		d = 0
+	}
+	return []byte(data.Val()), d, nil
+}
+
+func (s kv) Incr(key string, ttl time.Duration) (int64, error) {
+	var n *redis.IntCmd
+	_, err := s.m.client().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.SetNX(context.Background(), s.key(key), 0, ttl)
+		n = pipe.Incr(context.Background(), s.key(key))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n.Val(), nil
+}
+
+func (s kv) Del(key string) error {
+	return s.m.client().Del(context.Background(), s.key(key)).Err()
+}
@@ -0,0 +1,289 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lwch/token"
+)
+
+// scanCount hint of items per HSCAN round
+const scanCount = 100
+
+// scan walk all token => uid pairs in index
+func (m *Mgr) scan(fn func(tk, uid string) error) error {
+	var cursor uint64
+	for {
+		kvs, next, err := m.client().HScan(context.Background(),
+			m.key(indexKey), cursor, "", scanCount).Result()
+		if err != nil {
+			return err
+		}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			err = fn(kvs[i], kvs[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// scanLive walk all token => uid pairs in index with whether the token key
+// exists, keys are checked by pipelines of scanCount commands
+func (m *Mgr) scanLive(fn func(tk, uid string, live bool)) error {
+	var batch []string
+	check := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		exists := make([]*redis.IntCmd, len(batch)/2)
+		_, err := m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			for i := range exists {
+				exists[i] = pipe.Exists(context.Background(), m.key(batch[2*i]))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, n := range exists {
+			fn(batch[2*i], batch[2*i+1], n.Val() > 0)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err := m.scan(func(tk, uid string) error {
+		batch = append(batch, tk, uid)
+		if len(batch) < 2*scanCount {
+			return nil
+		}
+		return check()
+	})
+	if err != nil {
+		return err
+	}
+	return check()
+}
+
+func (m *Mgr) entry(uid, tk string) (token.Entry, error) {
+	var data *redis.StringCmd
+	var ttl *redis.DurationCmd
+	var fields *redis.StringStringMapCmd
+	_, err := m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		data = pipe.Get(context.Background(), m.key(tk))
+		ttl = pipe.PTTL(context.Background(), m.key(tk))
+		fields = pipe.HGetAll(context.Background(), m.metaKey(tk))
+		return nil
+	})
+	if err == redis.Nil {
+		return token.Entry{}, ErrNotfound
+	}
+	if err != nil {
+		return token.Entry{}, err
+	}
+	ret := token.Entry{
+		UID:   uid,
+		Token: tk,
+		Data:  []byte(data.Val()),
+		TTL:   ttl.Val(),
+		Meta:  sessionOf(uid, tk, fields.Val(), 0).Meta,
+	}
+	if ret.TTL < 0 {
+		ret.TTL = 0
+	}
+	return ret, nil
+}
+
+// Walk walk all tokens, tokens saved before the index was introduced are
+// not visible
+func (m *Mgr) Walk(fn func(token.Entry) error) error {
+	return m.scan(func(tk, uid string) error {
+		e, err := m.entry(uid, tk)
+		if err == ErrNotfound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
+
+// Lookup get raw entry by token
+func (m *Mgr) Lookup(tk string) (token.Entry, error) {
+	uid, err := m.client().HGet(context.Background(), m.key(indexKey), tk).Result()
+	if err != nil && err != redis.Nil {
+		return token.Entry{}, err
+	}
+	return m.entry(uid, tk)
+}
+
+// RevokeUID revoke all tokens of uid
+func (m *Mgr) RevokeUID(uid string) error {
+	return m.RevokeUIDBy("", uid)
+}
+
+// RevokeUIDBy revoke all tokens of uid, actor is reported to observers
+func (m *Mgr) RevokeUIDBy(actor, uid string) error {
+	var tks []string
+	err := m.scan(func(tk, owner string) error {
+		if owner == uid {
+			tks = append(tks, tk)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dels := make([]*redis.IntCmd, len(tks))
+	_, err = m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), m.key(uid))
+		pipe.Del(context.Background(), m.sessionsKey(uid))
+		for i, tk := range tks {
+			dels[i] = pipe.Del(context.Background(), m.key(tk))
+			pipe.Del(context.Background(), m.metaKey(tk))
+			pipe.HDel(context.Background(), m.key(indexKey), tk)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, tk := range tks {
+		if dels[i].Val() == 0 {
+			continue
+		}
+		m.emit(token.Event{
+			Op:    token.OpRevoke,
+			Actor: actor,
+			UID:   uid,
+			Token: tk,
+			OK:    true,
+		})
+	}
+	for _, tk := range tks {
+		m.revokeChildren(actor, tk)
+	}
+	return nil
+}
+
+// Purge remove index entries of expired tokens, revoke their children and
+// report them to observers, returns the number of purged tokens. Tokens are checked by
+// pipelines of scanCount commands.
+func (m *Mgr) Purge() (int, error) {
+	expired := make(map[string]string)
+	err := m.scanLive(func(tk, uid string, live bool) {
+		if !live {
+			expired[tk] = uid
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	dels := make(map[string]*redis.IntCmd, len(expired))
+	_, err = m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for tk, uid := range expired {
+			dels[tk] = pipe.HDel(context.Background(), m.key(indexKey), tk)
+			pipe.ZRem(context.Background(), m.sessionsKey(uid), tk)
+			pipe.Del(context.Background(), m.metaKey(tk))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var cnt int
+	for tk, uid := range expired {
+		// other instances may purge the same entry concurrently
+		if dels[tk].Val() == 0 {
+			continue
+		}
+		cnt++
+		m.emit(token.Event{
+			Op:    token.OpExpire,
+			UID:   uid,
+			Token: tk,
+			OK:    true,
+		})
+		m.revokeChildren("", tk)
+	}
+	m.tel.Evicted(cnt)
+	return cnt, nil
+}
+
+// Restore restore raw entry with its metadata and remaining ttl,
+// ErrNotfound is returned when the parent of entry does not exist
+func (m *Mgr) Restore(e token.Entry) error {
+	now := m.nowMs()
+	_, err := m.client().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Set(context.Background(), m.key(e.Token), string(e.Data), e.TTL)
+		pipe.SetNX(context.Background(), m.key(e.UID), e.Token, e.TTL)
+		pipe.HSet(context.Background(), m.key(indexKey), e.Token, e.UID)
+		pipe.ZAdd(context.Background(), m.sessionsKey(e.UID), &redis.Z{
+			Score:  float64(now),
+			Member: e.Token,
+		})
+		pipe.Del(context.Background(), m.metaKey(e.Token))
+		pipe.HSet(context.Background(), m.metaKey(e.Token), metaFields(e.Meta, now)...)
+		if e.TTL > 0 {
+			pipe.PExpire(context.Background(), m.metaKey(e.Token), e.TTL)
+		}
+		return nil
+	})
+	if err != nil || len(e.Meta.Parent) == 0 {
+		return err
+	}
+	err = m.link(e.Meta.Parent, e.Token)
+	if err != nil {
+		m.unsave(e.UID, e.Token)
+	}
+	return err
+}
+
+// Rewrite replace payload of token in place, ttl and metadata are kept
+func (m *Mgr) Rewrite(tk string, data []byte) error {
+	ok, err := m.client().SetXX(context.Background(), m.key(tk), string(data), redis.KeepTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotfound
+	}
+	return nil
+}
+
+// Expire set remaining ttl of token and its metadata, zero ttl means the
+// token never expires. The lifetime is marked in metadata so Verify does
+// not extend it.
+func (m *Mgr) Expire(tk string, ttl time.Duration) error {
+	var n *redis.IntCmd
+	_, err := m.client().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		n = pipe.Exists(context.Background(), m.key(tk))
+		pipe.HSet(context.Background(), m.metaKey(tk), "expire", 1)
+		for _, key := range []string{m.key(tk), m.metaKey(tk)} {
+			if ttl <= 0 {
+				pipe.Persist(context.Background(), key)
+			} else {
+				pipe.PExpire(context.Background(), key, ttl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n.Val() == 0 {
+		// the mark above created metadata of missing token
+		m.client().Del(context.Background(), m.metaKey(tk))
+		return ErrNotfound
+	}
+	return nil
+}
@@ -2,15 +2,17 @@ package redis
 
 import (
 	"context"
-	"errors"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/lwch/token"
+	"github.com/lwch/token/internal/telemetry"
 )
 
 // ErrNotfound not found error
-var ErrNotfound = errors.New("not found")
+var ErrNotfound = token.ErrNotfound
 
 // RedisConf redis config
 type RedisConf struct {
@@ -19,6 +21,13 @@ type RedisConf struct {
 	Password string
 	DB       int
 	Prefix   string
+	// HashTag wrap Prefix in braces as a hash tag in cluster mode, an empty
+	// prefix becomes "{token}". Every key then lives in one slot, which is
+	// required by session limits, VerifyAndConsume and children since their
+	// scripts touch keys of several tokens, at the cost of sharding.
+	// Turning it on moves every key, so tokens saved before are lost unless
+	// they are copied by snapshot.Migrate.
+	HashTag bool
 }
 
 // Mgr token manager
@@ -27,13 +36,30 @@ type Mgr struct {
 	clusterCli *redis.ClusterClient
 	ttl        time.Duration
 	prefix     string
+	clock      token.Clock
+	observers  []token.Observer
+	tel        *telemetry.Instrument
+
+	maxSessions int
+	policy      token.SessionPolicy
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // DefaultTTL default ttl
 const DefaultTTL = time.Hour
 
-// NewManager new token manager
-func NewManager(cfg RedisConf, ttl time.Duration) *Mgr {
+// indexKey hash of token => uid, used to walk all tokens
+const indexKey = "#index"
+
+// NewManager new token manager, zero ttl means tokens never expire. Keys
+// are expired by redis so the clock
+// option only affects timestamps recorded by the manager. A janitor purges
+// the index every minute until Close to drop and report expired tokens
+// unless token.WithoutJanitor is given.
+func NewManager(cfg RedisConf, ttl time.Duration, opts ...token.Option) *Mgr {
+	opt := token.NewOptions(opts...)
 	ret := new(Mgr)
 	if len(cfg.Addrs) > 1 {
 		ret.clusterCli = redis.NewClusterClient(&redis.ClusterOptions{
@@ -55,135 +81,275 @@ func NewManager(cfg RedisConf, ttl time.Duration) *Mgr {
 	}
 	ret.ttl = ttl
 	ret.prefix = cfg.Prefix
+	if cfg.HashTag && ret.clusterCli != nil && !hashTagged(ret.prefix) {
+		ret.prefix = hashTag(ret.prefix)
+	}
+	ret.clock = opt.Clock
+	ret.observers = opt.Observers
+	ret.maxSessions = opt.MaxSessions
+	ret.policy = opt.SessionPolicy
+	ret.tel = telemetry.New("redis", cfg.Prefix)
+	ret.tel.Active(ret.count)
+	ret.done = make(chan struct{})
+	if !opt.NoJanitor {
+		go func() {
+			for {
+				select {
+				case <-ret.done:
+					return
+				case <-ret.clock.After(time.Minute):
+				}
+				ret.Purge()
+			}
+		}()
+	}
 	return ret
 }
 
+// Close stop janitor and reporting of active tokens and close the client,
+// it returns redis.ErrClosed when the manager is closed already
+func (m *Mgr) Close() error {
+	err := redis.ErrClosed
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.tel.Close()
+		err = m.client().Close()
+	})
+	return err
+}
+
+// count returns number of tokens in index which are not expired
+func (m *Mgr) count() (int64, error) {
+	var n int64
+	err := m.scanLive(func(tk, uid string, live bool) {
+		if live {
+			n++
+		}
+	})
+	return n, err
+}
+
+func (m *Mgr) emit(e token.Event) {
+	if len(m.observers) == 0 {
+		return
+	}
+	e.Time = m.clock.Now()
+	token.Notify(m.observers, e)
+}
+
+func (m *Mgr) client() redis.UniversalClient {
+	if m.cli != nil {
+		return m.cli
+	}
+	return m.clusterCli
+}
+
+// expire reset ttl of key, keys never expire with zero ttl
+func (m *Mgr) expire(pipe redis.Pipeliner, key string) error {
+	if m.ttl <= 0 {
+		return nil
+	}
+	return pipe.Expire(context.Background(), key, m.ttl).Err()
+}
+
+// hashTagged returns whether prefix contains a non-empty hash tag
+func hashTagged(prefix string) bool {
+	n := strings.IndexByte(prefix, '{')
+	if n == -1 {
+		return false
+	}
+	return strings.IndexByte(prefix[n+1:], '}') > 0
+}
+
+func hashTag(prefix string) string {
+	if len(prefix) == 0 {
+		prefix = "token"
+	}
+	return "{" + prefix + "}"
+}
+
+func (m *Mgr) key(key string) string {
+	if len(m.prefix) > 0 {
+		return m.prefix + ":" + key
+	}
+	return key
+}
+
 // Save save token
 func (m *Mgr) Save(tk token.Token) error {
+	return m.SaveSession(tk, token.Meta{})
+}
+
+// SaveSession save token with metadata
+func (m *Mgr) SaveSession(tk token.Token, meta token.Meta) error {
+	op := m.tel.Start(telemetry.OpSave)
+	err := m.save(tk, meta)
+	op.End(err == nil, err)
+	m.emit(token.Event{
+		Op:    token.OpSave,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    err == nil,
+		Err:   err,
+	})
+	return err
+}
+
+// save save token and link it to its parent, the token is removed again
+// when the parent does not exist
+func (m *Mgr) save(tk token.Token, meta token.Meta) error {
+	err := m.store(tk, meta)
+	if err != nil || len(meta.Parent) == 0 {
+		return err
+	}
+	err = m.link(meta.Parent, tk.GetTK())
+	if err != nil {
+		m.unsave(tk.GetUID(), tk.GetTK())
+	}
+	return err
+}
+
+func (m *Mgr) store(tk token.Token, meta token.Meta) error {
 	data, err := tk.Serialize()
 	if err != nil {
 		return err
 	}
-	pipe := func(pipe redis.Pipeliner) error {
-		key := tk.GetTK()
-		if len(m.prefix) > 0 {
-			key = m.prefix + ":" + key
+	if m.maxSessions > 0 {
+		return m.saveLimited(tk, data, meta)
+	}
+	now := m.nowMs()
+	_, err = m.client().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		err := pipe.SetNX(context.Background(), m.key(tk.GetTK()), string(data), m.ttl).Err()
+		if err != nil {
+			return err
+		}
+		err = pipe.SetNX(context.Background(), m.key(tk.GetUID()), tk.GetTK(), m.ttl).Err()
+		if err != nil {
+			return err
 		}
-		err = pipe.SetNX(context.Background(), key, string(data), m.ttl).Err()
+		err = pipe.HSet(context.Background(), m.key(indexKey), tk.GetTK(), tk.GetUID()).Err()
 		if err != nil {
 			return err
 		}
-		key = tk.GetUID()
-		if len(m.prefix) > 0 {
-			key = m.prefix + ":" + key
+		err = pipe.ZAdd(context.Background(), m.sessionsKey(tk.GetUID()), &redis.Z{
+			Score:  float64(now),
+			Member: tk.GetTK(),
+		}).Err()
+		if err != nil {
+			return err
 		}
-		return pipe.SetNX(context.Background(), key, tk.GetTK(), m.ttl).Err()
-	}
-	if m.cli != nil {
-		_, err = m.cli.TxPipelined(context.Background(), pipe)
-	} else {
-		_, err = m.clusterCli.TxPipelined(context.Background(), pipe)
-	}
+		err = pipe.Del(context.Background(), m.metaKey(tk.GetTK())).Err()
+		if err != nil {
+			return err
+		}
+		err = pipe.HSet(context.Background(), m.metaKey(tk.GetTK()), metaFields(meta, now)...).Err()
+		if err != nil {
+			return err
+		}
+		return m.expire(pipe, m.metaKey(tk.GetTK()))
+	})
 	return err
 }
 
 // Verify verify token
 func (m *Mgr) Verify(tk token.Token) (bool, error) {
-	var data string
-	var err error
-	key := tk.GetTK()
-	if len(m.prefix) > 0 {
-		key = m.prefix + ":" + key
-	}
-	if m.cli != nil {
-		data, err = m.cli.Get(context.Background(), key).Result()
-	} else {
-		data, err = m.clusterCli.Get(context.Background(), key).Result()
-	}
-	if err == redis.Nil {
+	op := m.tel.Start(telemetry.OpVerify)
+	ok, err := m.verify(tk)
+	op.End(ok, err)
+	m.emit(token.Event{
+		Op:    token.OpVerify,
+		Actor: tk.GetUID(),
+		UID:   tk.GetUID(),
+		Token: tk.GetTK(),
+		OK:    ok,
+		Err:   err,
+	})
+	return ok, err
+}
+
+// verify verify token and extend its ttl, tokens whose lifetime is set by
+// Expire keep their ttl
+func (m *Mgr) verify(tk token.Token) (bool, error) {
+	var data, fixed *redis.StringCmd
+	m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		data = pipe.Get(context.Background(), m.key(tk.GetTK()))
+		fixed = pipe.HGet(context.Background(), m.metaKey(tk.GetTK()), "expire")
+		return nil
+	})
+	if data.Err() == redis.Nil {
 		return false, nil
 	}
-	if err != nil {
-		return false, err
+	if data.Err() != nil {
+		return false, data.Err()
+	}
+	if fixed.Err() != nil && fixed.Err() != redis.Nil {
+		return false, fixed.Err()
 	}
-	ok, err := tk.Verify([]byte(data))
+	ok, err := tk.Verify([]byte(data.Val()))
 	if err != nil {
 		return ok, err
 	}
 	if ok {
-		pipe := func(pipe redis.Pipeliner) error {
-			key := tk.GetTK()
-			if len(m.prefix) > 0 {
-				key = m.prefix + ":" + key
+		slide := len(fixed.Val()) == 0
+		m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			if slide {
+				m.expire(pipe, m.key(tk.GetTK()))
 			}
-			pipe.Expire(context.Background(), key, m.ttl)
-			key = tk.GetUID()
-			if len(m.prefix) > 0 {
-				key = m.prefix + ":" + key
-			}
-			pipe.Expire(context.Background(), key, m.ttl)
+			m.expire(pipe, m.key(tk.GetUID()))
+			m.touch(pipe, tk.GetUID(), tk.GetTK(), slide)
 			return nil
-		}
-		if m.cli != nil {
-			m.cli.Pipelined(context.Background(), pipe)
-		} else {
-			m.clusterCli.Pipelined(context.Background(), pipe)
-		}
+		})
 	}
 	return ok, err
 }
 
 // Revoke revoke token
 func (m *Mgr) Revoke(uid, tk string) {
-	pipe := func(pipe redis.Pipeliner) error {
-		key := uid
-		if len(m.prefix) > 0 {
-			key = m.prefix + ":" + key
-		}
-		pipe.Del(context.Background(), key)
-		key = tk
-		if len(m.prefix) > 0 {
-			key = m.prefix + ":" + key
-		}
-		pipe.Del(context.Background(), key)
+	m.RevokeBy("", uid, tk)
+}
+
+// RevokeBy revoke token, actor is reported to observers
+func (m *Mgr) RevokeBy(actor, uid, tk string) {
+	op := m.tel.Start(telemetry.OpRevoke)
+	var del *redis.IntCmd
+	_, err := m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), m.key(uid))
+		del = pipe.Del(context.Background(), m.key(tk))
+		pipe.HDel(context.Background(), m.key(indexKey), tk)
+		pipe.ZRem(context.Background(), m.sessionsKey(uid), tk)
+		pipe.Del(context.Background(), m.metaKey(tk))
 		return nil
-	}
-	if m.cli != nil {
-		m.cli.Pipelined(context.Background(), pipe)
-	} else {
-		m.clusterCli.Pipelined(context.Background(), pipe)
-	}
+	})
+	m.emit(token.Event{
+		Op:    token.OpRevoke,
+		Actor: actor,
+		UID:   uid,
+		Token: tk,
+		OK:    err == nil && del.Val() > 0,
+		Err:   err,
+	})
+	op.End(err == nil && del.Val() > 0, err)
+	m.revokeChildren(actor, tk)
 }
 
 // Get get token by uid
 func (m *Mgr) Get(uid string, tk token.Token) error {
-	var token string
-	var err error
-	key := uid
-	if len(m.prefix) > 0 {
-		key = m.prefix + ":" + key
-	}
-	if m.cli != nil {
-		token, err = m.cli.Get(context.Background(), key).Result()
-	} else {
-		token, err = m.clusterCli.Get(context.Background(), key).Result()
-	}
+	op := m.tel.Start(telemetry.OpGet)
+	err := m.get(uid, tk)
+	op.End(err == nil, err)
+	return err
+}
+
+func (m *Mgr) get(uid string, tk token.Token) error {
+	token, err := m.client().Get(context.Background(), m.key(uid)).Result()
 	if err == redis.Nil {
 		return ErrNotfound
 	}
 	if err != nil {
 		return err
 	}
-	var data string
-	key = token
-	if len(m.prefix) > 0 {
-		key = m.prefix + ":" + key
-	}
-	if m.cli != nil {
-		data, err = m.cli.Get(context.Background(), key).Result()
-	} else {
-		data, err = m.clusterCli.Get(context.Background(), key).Result()
-	}
+	data, err := m.client().Get(context.Background(), m.key(token)).Result()
 	if err == redis.Nil {
 		return ErrNotfound
 	}
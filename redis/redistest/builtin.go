@@ -0,0 +1,134 @@
+package redistest
+
+import "strconv"
+
+// go implementations of lua scripts of redis.Mgr, they must be kept in sync
+// with the scripts
+func init() {
+	builtin["token:save"] = tokenSave
+	builtin["token:consume"] = tokenConsume
+	builtin["token:link"] = tokenLink
+}
+
+func tokenSave(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	max, err := strconv.Atoi(args[5])
+	if err != nil {
+		return nil, err
+	}
+	tks, err := call("zrange", keys[3], "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	var live []string
+	for _, tk := range tks.([]string) {
+		if tk == args[2] {
+			continue
+		}
+		n, err := call("exists", args[7]+tk)
+		if err != nil {
+			return nil, err
+		}
+		if n.(int) == 1 {
+			live = append(live, tk)
+			continue
+		}
+		call("zrem", keys[3], tk)
+		call("hdel", keys[2], tk)
+	}
+	evicted := []string{}
+	if over := len(live) - max + 1; over > 0 {
+		if args[6] == "reject" {
+			return nil, nil
+		}
+		cur, err := call("get", keys[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, tk := range live[:over] {
+			call("del", args[7]+tk)
+			call("del", args[7]+"#meta:"+tk)
+			call("hdel", keys[2], tk)
+			call("zrem", keys[3], tk)
+			if cur == tk {
+				call("del", keys[1])
+			}
+			evicted = append(evicted, tk)
+		}
+	}
+	cmds := [][]string{
+		{"set", keys[0], args[0], "px", args[1], "nx"},
+		{"set", keys[1], args[2], "px", args[1], "nx"},
+		{"hset", keys[2], args[2], args[3]},
+		{"zadd", keys[3], args[4], args[2]},
+		{"del", keys[4]},
+		append([]string{"hset", keys[4]}, args[8:]...),
+		{"pexpire", keys[4], args[1]},
+	}
+	if ttl, _ := strconv.Atoi(args[1]); ttl <= 0 {
+		cmds[0] = []string{"set", keys[0], args[0], "nx"}
+		cmds[1] = []string{"set", keys[1], args[2], "nx"}
+		cmds = cmds[:6]
+	}
+	for _, cmd := range cmds {
+		_, err := call(cmd...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return evicted, nil
+}
+
+func tokenConsume(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	data, err := call("get", keys[0])
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	purpose, err := call("hget", keys[2], "purpose")
+	if err != nil {
+		return nil, err
+	}
+	if purpose == nil {
+		purpose = ""
+	}
+	if purpose != args[0] {
+		return []interface{}{0}, nil
+	}
+	uid, err := call("hget", keys[1], args[1])
+	if err != nil {
+		return nil, err
+	}
+	call("del", keys[0], keys[2])
+	call("hdel", keys[1], args[1])
+	if uid == args[2] {
+		call("zrem", keys[3], args[1])
+		cur, _ := call("get", keys[4])
+		if cur == args[1] {
+			call("del", keys[4])
+		}
+	}
+	return []interface{}{1, data}, nil
+}
+
+func tokenLink(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	n, err := call("exists", keys[0])
+	if err != nil {
+		return nil, err
+	}
+	if n.(int) == 0 {
+		return 0, nil
+	}
+	_, err = call("sadd", keys[1], args[0])
+	if err != nil {
+		return nil, err
+	}
+	if ttl, _ := strconv.Atoi(args[1]); ttl > 0 {
+		_, err = call("pexpire", keys[1], args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return 1, nil
+}
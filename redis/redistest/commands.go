@@ -0,0 +1,552 @@
+package redistest
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cmdFunc func(s *Server, c *client, args []string) interface{}
+
+var commands map[string]cmdFunc
+
+func init() {
+	commands = map[string]cmdFunc{
+		"ping":      cmdPing,
+		"echo":      cmdEcho,
+		"select":    cmdSelect,
+		"auth":      cmdAuth,
+		"watch":     cmdNoop,
+		"unwatch":   cmdNoop,
+		"flushdb":   cmdFlushDB,
+		"flushall":  cmdFlushAll,
+		"dbsize":    cmdDBSize,
+		"get":       cmdGet,
+		"set":       cmdSet,
+		"setnx":     cmdSetNX,
+		"incr":      cmdIncr,
+		"incrby":    cmdIncr,
+		"decr":      cmdIncr,
+		"decrby":    cmdIncr,
+		"del":       cmdDel,
+		"unlink":    cmdDel,
+		"exists":    cmdExists,
+		"type":      cmdType,
+		"expire":    cmdExpire,
+		"pexpire":   cmdExpire,
+		"persist":   cmdPersist,
+		"ttl":       cmdTTL,
+		"pttl":      cmdTTL,
+		"keys":      cmdKeys,
+		"scan":      cmdScan,
+		"hset":      cmdHSet,
+		"hget":      cmdHGet,
+		"hdel":      cmdHDel,
+		"hlen":      cmdHLen,
+		"hgetall":   cmdHGetAll,
+		"hscan":     cmdHScan,
+		"zadd":      cmdZAdd,
+		"zrem":      cmdZRem,
+		"zcard":     cmdZCard,
+		"zscore":    cmdZScore,
+		"zrange":    cmdZRange,
+		"sadd":      cmdSAdd,
+		"srem":      cmdSRem,
+		"scard":     cmdSCard,
+		"sismember": cmdSIsMember,
+		"smembers":  cmdSMembers,
+		"xadd":      cmdXAdd,
+		"xlen":      cmdXLen,
+		"xrange":    cmdXRange,
+		"publish":   cmdPublish,
+		"script":    cmdScript,
+		"eval":      cmdEval,
+		"evalsha":   cmdEval,
+	}
+}
+
+func cmdPing(s *Server, c *client, args []string) interface{} {
+	if len(args) > 1 {
+		return args[1]
+	}
+	return status("PONG")
+}
+
+func cmdEcho(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("echo")
+	}
+	return args[1]
+}
+
+func cmdSelect(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("select")
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 || n > 15 {
+		return redisError("ERR DB index is out of range")
+	}
+	c.db = n
+	return statusOK
+}
+
+func cmdAuth(s *Server, c *client, args []string) interface{} {
+	if len(args) < 2 || len(args) > 3 {
+		return errArgs("auth")
+	}
+	return statusOK
+}
+
+func cmdNoop(s *Server, c *client, args []string) interface{} {
+	return statusOK
+}
+
+func cmdFlushDB(s *Server, c *client, args []string) interface{} {
+	delete(s.dbs, c.db)
+	return statusOK
+}
+
+func cmdFlushAll(s *Server, c *client, args []string) interface{} {
+	s.dbs = make(map[int]db)
+	return statusOK
+}
+
+func cmdDBSize(s *Server, c *client, args []string) interface{} {
+	return len(s.keys(s.db(c.db), ""))
+}
+
+func getString(s *Server, d db, key string) (*value, interface{}) {
+	v := s.lookup(d, key)
+	if v == nil {
+		return nil, nil
+	}
+	if v.kind != kindString {
+		return nil, errWrongTyp
+	}
+	return v, nil
+}
+
+func cmdGet(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("get")
+	}
+	v, err := getString(s, s.db(c.db), args[1])
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return v.str
+}
+
+func parseInt(str string) (int64, bool) {
+	n, err := strconv.ParseInt(str, 10, 64)
+	return n, err == nil
+}
+
+func cmdSet(s *Server, c *client, args []string) interface{} {
+	if len(args) < 3 {
+		return errArgs("set")
+	}
+	var nx, xx, keep, get bool
+	var expire time.Time
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "keepttl":
+			keep = true
+		case "get":
+			get = true
+		case "ex", "px":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			n, ok := parseInt(args[i])
+			if !ok {
+				return errNotInt
+			}
+			if n <= 0 {
+				return redisError("ERR invalid expire time in set")
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			expire = s.now().Add(time.Duration(n) * unit)
+		default:
+			return errSyntax
+		}
+	}
+	if nx && xx || keep && !expire.IsZero() {
+		return errSyntax
+	}
+	d := s.db(c.db)
+	old := s.lookup(d, args[1])
+	var prev interface{}
+	if get && old != nil {
+		if old.kind != kindString {
+			return errWrongTyp
+		}
+		prev = old.str
+	}
+	if nx && old != nil || xx && old == nil {
+		if get {
+			return prev
+		}
+		return nil
+	}
+	if keep && old != nil {
+		expire = old.expire
+	}
+	d[args[1]] = &value{kind: kindString, str: args[2], expire: expire}
+	if get {
+		return prev
+	}
+	return statusOK
+}
+
+func cmdSetNX(s *Server, c *client, args []string) interface{} {
+	if len(args) != 3 {
+		return errArgs("setnx")
+	}
+	d := s.db(c.db)
+	if s.lookup(d, args[1]) != nil {
+		return 0
+	}
+	d[args[1]] = &value{kind: kindString, str: args[2]}
+	return 1
+}
+
+func cmdIncr(s *Server, c *client, args []string) interface{} {
+	name := strings.ToLower(args[0])
+	by := int64(1)
+	switch name {
+	case "incr", "decr":
+		if len(args) != 2 {
+			return errArgs(name)
+		}
+	default:
+		if len(args) != 3 {
+			return errArgs(name)
+		}
+		var ok bool
+		by, ok = parseInt(args[2])
+		if !ok {
+			return errNotInt
+		}
+	}
+	if strings.HasPrefix(name, "decr") {
+		by = -by
+	}
+	d := s.db(c.db)
+	v, err := getString(s, d, args[1])
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		v = &value{kind: kindString, str: "0"}
+		d[args[1]] = v
+	}
+	n, ok := parseInt(v.str)
+	if !ok {
+		return errNotInt
+	}
+	n += by
+	v.str = strconv.FormatInt(n, 10)
+	return n
+}
+
+func cmdDel(s *Server, c *client, args []string) interface{} {
+	if len(args) < 2 {
+		return errArgs(args[0])
+	}
+	d := s.db(c.db)
+	var n int
+	for _, key := range args[1:] {
+		if s.lookup(d, key) != nil {
+			delete(d, key)
+			n++
+		}
+	}
+	return n
+}
+
+func cmdExists(s *Server, c *client, args []string) interface{} {
+	if len(args) < 2 {
+		return errArgs("exists")
+	}
+	d := s.db(c.db)
+	var n int
+	for _, key := range args[1:] {
+		if s.lookup(d, key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func cmdType(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("type")
+	}
+	v := s.lookup(s.db(c.db), args[1])
+	if v == nil {
+		return status("none")
+	}
+	return status(v.kind.String())
+}
+
+func cmdExpire(s *Server, c *client, args []string) interface{} {
+	if len(args) != 3 {
+		return errArgs(args[0])
+	}
+	n, ok := parseInt(args[2])
+	if !ok {
+		return errNotInt
+	}
+	d := s.db(c.db)
+	v := s.lookup(d, args[1])
+	if v == nil {
+		return 0
+	}
+	unit := time.Second
+	if strings.ToLower(args[0]) == "pexpire" {
+		unit = time.Millisecond
+	}
+	if n <= 0 {
+		delete(d, args[1])
+		return 1
+	}
+	v.expire = s.now().Add(time.Duration(n) * unit)
+	return 1
+}
+
+func cmdPersist(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("persist")
+	}
+	v := s.lookup(s.db(c.db), args[1])
+	if v == nil || v.expire.IsZero() {
+		return 0
+	}
+	v.expire = time.Time{}
+	return 1
+}
+
+func cmdTTL(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs(args[0])
+	}
+	v := s.lookup(s.db(c.db), args[1])
+	if v == nil {
+		return -2
+	}
+	if v.expire.IsZero() {
+		return -1
+	}
+	left := v.expire.Sub(s.now())
+	if strings.ToLower(args[0]) == "pttl" {
+		return int64((left + time.Millisecond - 1) / time.Millisecond)
+	}
+	return int64((left + time.Second - 1) / time.Second)
+}
+
+func cmdKeys(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("keys")
+	}
+	return s.keys(s.db(c.db), args[1])
+}
+
+// parseScan parse cursor, MATCH and TYPE options, COUNT is only a hint and
+// all items are returned at once
+func parseScan(args []string) (string, string, interface{}) {
+	if _, ok := parseInt(args[0]); !ok {
+		return "", "", redisError("ERR invalid cursor")
+	}
+	var pattern, typ string
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return "", "", errSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if _, ok := parseInt(args[i+1]); !ok {
+				return "", "", errNotInt
+			}
+		case "type":
+			typ = strings.ToLower(args[i+1])
+		default:
+			return "", "", errSyntax
+		}
+	}
+	return pattern, typ, nil
+}
+
+func cmdScan(s *Server, c *client, args []string) interface{} {
+	if len(args) < 2 {
+		return errArgs("scan")
+	}
+	pattern, typ, err := parseScan(args[1:])
+	if err != nil {
+		return err
+	}
+	d := s.db(c.db)
+	keys := []string{}
+	if args[1] == "0" {
+		for _, key := range s.keys(d, pattern) {
+			if len(typ) > 0 && d[key].kind.String() != typ {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return []interface{}{"0", keys}
+}
+
+func getHash(s *Server, d db, key string, create bool) (*value, interface{}) {
+	v := s.lookup(d, key)
+	if v == nil {
+		if !create {
+			return nil, nil
+		}
+		v = &value{kind: kindHash, hash: make(map[string]string)}
+		d[key] = v
+	}
+	if v.kind != kindHash {
+		return nil, errWrongTyp
+	}
+	return v, nil
+}
+
+func cmdHSet(s *Server, c *client, args []string) interface{} {
+	if len(args) < 4 || len(args)%2 != 0 {
+		return errArgs(args[0])
+	}
+	v, err := getHash(s, s.db(c.db), args[1], true)
+	if err != nil {
+		return err
+	}
+	var n int
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := v.hash[args[i]]; !ok {
+			n++
+		}
+		v.hash[args[i]] = args[i+1]
+	}
+	return n
+}
+
+func cmdHGet(s *Server, c *client, args []string) interface{} {
+	if len(args) != 3 {
+		return errArgs("hget")
+	}
+	v, err := getHash(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	val, ok := v.hash[args[2]]
+	if !ok {
+		return nil
+	}
+	return val
+}
+
+func cmdHDel(s *Server, c *client, args []string) interface{} {
+	if len(args) < 3 {
+		return errArgs("hdel")
+	}
+	d := s.db(c.db)
+	v, err := getHash(s, d, args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	var n int
+	for _, field := range args[2:] {
+		if _, ok := v.hash[field]; ok {
+			delete(v.hash, field)
+			n++
+		}
+	}
+	if len(v.hash) == 0 {
+		delete(d, args[1])
+	}
+	return n
+}
+
+func cmdHLen(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("hlen")
+	}
+	v, err := getHash(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.hash)
+}
+
+func cmdHGetAll(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("hgetall")
+	}
+	v, err := getHash(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	ret := []string{}
+	if v == nil {
+		return ret
+	}
+	for _, field := range sortedFields(v.hash) {
+		ret = append(ret, field, v.hash[field])
+	}
+	return ret
+}
+
+func cmdHScan(s *Server, c *client, args []string) interface{} {
+	if len(args) < 3 {
+		return errArgs("hscan")
+	}
+	pattern, _, err := parseScan(args[2:])
+	if err != nil {
+		return err
+	}
+	v, err := getHash(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	items := []string{}
+	if v != nil && args[2] == "0" {
+		for _, field := range sortedFields(v.hash) {
+			if len(pattern) > 0 && !match(pattern, field) {
+				continue
+			}
+			items = append(items, field, v.hash[field])
+		}
+	}
+	return []interface{}{"0", items}
+}
+
+func cmdPublish(s *Server, c *client, args []string) interface{} {
+	if len(args) != 3 {
+		return errArgs("publish")
+	}
+	return s.publish(args[1], args[2])
+}
@@ -0,0 +1,166 @@
+package redistest
+
+import (
+	"sort"
+	"time"
+)
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindHash
+	kindStream
+	kindZSet
+	kindSet
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindHash:
+		return "hash"
+	case kindStream:
+		return "stream"
+	case kindZSet:
+		return "zset"
+	case kindSet:
+		return "set"
+	}
+	return "none"
+}
+
+type value struct {
+	kind   kind
+	str    string
+	hash   map[string]string
+	stream []streamEntry
+	zset   map[string]float64
+	set    map[string]struct{}
+	expire time.Time
+}
+
+type db map[string]*value
+
+// lookup returns the value of key, expired keys are removed lazily
+func (s *Server) lookup(d db, key string) *value {
+	v := d[key]
+	if v == nil {
+		return nil
+	}
+	if !v.expire.IsZero() && !s.now().Before(v.expire) {
+		delete(d, key)
+		return nil
+	}
+	return v
+}
+
+// keys returns sorted live keys which match pattern
+func (s *Server) keys(d db, pattern string) []string {
+	var ret []string
+	for key := range d {
+		if s.lookup(d, key) == nil {
+			continue
+		}
+		if len(pattern) > 0 && !match(pattern, key) {
+			continue
+		}
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedFields(hash map[string]string) []string {
+	ret := make([]string, 0, len(hash))
+	for field := range hash {
+		ret = append(ret, field)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// match redis glob style pattern matching, supports * ? [...] and \ escape
+func match(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if match(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			end := 1
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(pattern) {
+				return false
+			}
+			if !matchClass(pattern[1:end], str[0]) {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(str) == 0
+}
+
+func matchClass(class string, ch byte) bool {
+	not := len(class) > 0 && class[0] == '^'
+	if not {
+		class = class[1:]
+	}
+	var matched bool
+	for i := 0; i < len(class); i++ {
+		c := class[i]
+		if c == '\\' && i+1 < len(class) {
+			i++
+			c = class[i]
+		}
+		if i+2 < len(class) && class[i+1] == '-' {
+			if ch >= c && ch <= class[i+2] {
+				matched = true
+			}
+			i += 2
+			continue
+		}
+		if c == ch {
+			matched = true
+		}
+	}
+	return matched != not
+}
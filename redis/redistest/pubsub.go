@@ -0,0 +1,90 @@
+package redistest
+
+func (c *client) subscribe(pattern bool, channels []string) {
+	if len(channels) == 0 {
+		c.reply(errArgs("subscribe"))
+		return
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	kind, own, all := "subscribe", c.subs, c.s.subs
+	if pattern {
+		kind, own, all = "psubscribe", c.psub, c.s.psubs
+	}
+	for _, ch := range channels {
+		own[ch] = struct{}{}
+		if all[ch] == nil {
+			all[ch] = make(map[*client]struct{})
+		}
+		all[ch][c] = struct{}{}
+		c.reply([]interface{}{kind, ch, len(c.subs) + len(c.psub)})
+	}
+}
+
+func (c *client) unsubscribe(pattern bool, channels []string) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	kind, own, all := "unsubscribe", c.subs, c.s.subs
+	if pattern {
+		kind, own, all = "punsubscribe", c.psub, c.s.psubs
+	}
+	if len(channels) == 0 {
+		for ch := range own {
+			channels = append(channels, ch)
+		}
+		if len(channels) == 0 {
+			c.reply([]interface{}{kind, nil, 0})
+			return
+		}
+	}
+	for _, ch := range channels {
+		delete(own, ch)
+		delete(all[ch], c)
+		if len(all[ch]) == 0 {
+			delete(all, ch)
+		}
+		c.reply([]interface{}{kind, ch, len(c.subs) + len(c.psub)})
+	}
+}
+
+// unsubscribeAll must be called with lock held
+func (c *client) unsubscribeAll() {
+	for ch := range c.subs {
+		delete(c.s.subs[ch], c)
+		if len(c.s.subs[ch]) == 0 {
+			delete(c.s.subs, ch)
+		}
+	}
+	for ch := range c.psub {
+		delete(c.s.psubs[ch], c)
+		if len(c.s.psubs[ch]) == 0 {
+			delete(c.s.psubs, ch)
+		}
+	}
+}
+
+// publish deliver message to subscribers, must be called with lock held
+func (s *Server) publish(ch, msg string) int {
+	var n int
+	for c := range s.subs[ch] {
+		c.reply([]interface{}{"message", ch, msg})
+		n++
+	}
+	for pattern, clients := range s.psubs {
+		if !match(pattern, ch) {
+			continue
+		}
+		for c := range clients {
+			c.reply([]interface{}{"pmessage", pattern, ch, msg})
+			n++
+		}
+	}
+	return n
+}
+
+// Publish publish message to channel, returns the number of receivers
+func (s *Server) Publish(ch, msg string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.publish(ch, msg)
+}
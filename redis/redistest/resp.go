@@ -0,0 +1,125 @@
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// status simple string reply
+type status string
+
+// redisError error reply
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// nilArray null array reply
+type nilArray struct{}
+
+var (
+	statusOK     = status("OK")
+	statusQueued = status("QUEUED")
+	errSyntax    = redisError("ERR syntax error")
+	errNotInt    = redisError("ERR value is not an integer or out of range")
+	errWrongTyp  = redisError("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+func errArgs(cmd string) redisError {
+	return redisError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+}
+
+const maxBulk = 512 << 20
+
+// readCommand read one command, both multibulk and inline format are
+// supported
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024*1024 {
+		return nil, errors.New("invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("expected '$'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, errors.New("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writeReply encode reply in RESP2
+func writeReply(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case nilArray:
+		w.WriteString("*-1\r\n")
+	case status:
+		w.WriteString("+" + string(v) + "\r\n")
+	case redisError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case error:
+		w.WriteString("-ERR " + v.Error() + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case bool:
+		if v {
+			w.WriteString(":1\r\n")
+		} else {
+			w.WriteString(":0\r\n")
+		}
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []string:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, s := range v {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, s := range v {
+			writeReply(w, s)
+		}
+	default:
+		panic(fmt.Sprintf("redistest: unsupported reply type %T", v))
+	}
+}
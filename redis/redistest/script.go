@@ -0,0 +1,129 @@
+package redistest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// ScriptFunc go implementation of lua script, call runs one redis command
+// inside the script like redis.call and returns its reply which is one of
+// nil, int, int64, string, []string or []interface{}
+type ScriptFunc func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error)
+
+// builtin implementations of scripts used by redis.Mgr
+var builtin = make(map[string]ScriptFunc)
+
+// Script register go implementation for lua scripts whose first line is the
+// comment "-- name", lua itself is not interpreted
+func (s *Server) Script(name string, fn ScriptFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.funcs[name] = fn
+}
+
+func scriptName(src string) string {
+	line := src
+	if n := strings.IndexByte(src, '\n'); n != -1 {
+		line = src[:n]
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "--") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "--"))
+}
+
+func (s *Server) scriptFunc(name string) ScriptFunc {
+	if fn, ok := s.funcs[name]; ok {
+		return fn
+	}
+	return builtin[name]
+}
+
+func (s *Server) load(src string) (string, error) {
+	if s.scriptFunc(scriptName(src)) == nil {
+		return "", redisError("ERR redistest: no implementation for script " +
+			strconv.Quote(scriptName(src)))
+	}
+	sum := sha1.Sum([]byte(src))
+	sha := hex.EncodeToString(sum[:])
+	s.scripts[sha] = src
+	return sha, nil
+}
+
+func cmdScript(s *Server, c *client, args []string) interface{} {
+	if len(args) < 2 {
+		return errArgs("script")
+	}
+	switch strings.ToLower(args[1]) {
+	case "load":
+		if len(args) != 3 {
+			return errArgs("script|load")
+		}
+		sha, err := s.load(args[2])
+		if err != nil {
+			return err
+		}
+		return sha
+	case "exists":
+		ret := make([]interface{}, 0, len(args)-2)
+		for _, sha := range args[2:] {
+			_, ok := s.scripts[strings.ToLower(sha)]
+			ret = append(ret, ok)
+		}
+		return ret
+	case "flush":
+		s.scripts = make(map[string]string)
+		return statusOK
+	}
+	return redisError("ERR unknown subcommand '" + args[1] + "'")
+}
+
+func cmdEval(s *Server, c *client, args []string) interface{} {
+	if len(args) < 3 {
+		return errArgs(args[0])
+	}
+	var src string
+	if strings.ToLower(args[0]) == "evalsha" {
+		var ok bool
+		src, ok = s.scripts[strings.ToLower(args[1])]
+		if !ok {
+			return redisError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	} else {
+		src = args[1]
+		_, err := s.load(src)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 0 {
+		return errNotInt
+	}
+	if n > len(args)-3 {
+		return redisError("ERR Number of keys can't be greater than number of args")
+	}
+	keys := args[3 : 3+n]
+	argv := args[3+n:]
+	call := func(args ...string) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, redisError("ERR Please specify at least one argument for redis.call()")
+		}
+		ret := s.exec(c, args)
+		if err, ok := ret.(redisError); ok {
+			return nil, err
+		}
+		return ret, nil
+	}
+	ret, err := s.scriptFunc(scriptName(src))(call, keys, argv)
+	if err != nil {
+		if e, ok := err.(redisError); ok {
+			return e
+		}
+		return redisError("ERR " + err.Error())
+	}
+	return ret
+}
@@ -0,0 +1,280 @@
+package redistest
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// Server in-process RESP2 server which implements the subset of redis used by
+// redis.Mgr, keys expire by the simulated time of server
+type Server struct {
+	mu      sync.Mutex
+	l       net.Listener
+	dbs     map[int]db
+	clock   token.Clock
+	offset  time.Duration
+	scripts map[string]string
+	funcs   map[string]ScriptFunc
+	subs    map[string]map[*client]struct{}
+	psubs   map[string]map[*client]struct{}
+	clients map[*client]struct{}
+	wg      sync.WaitGroup
+}
+
+// NewServer start server on a random local port
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		l:       l,
+		clock:   token.SystemClock,
+		dbs:     make(map[int]db),
+		scripts: make(map[string]string),
+		funcs:   make(map[string]ScriptFunc),
+		subs:    make(map[string]map[*client]struct{}),
+		psubs:   make(map[string]map[*client]struct{}),
+		clients: make(map[*client]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr listen address
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close stop server and close all connections
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.mu.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Now current simulated time
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now()
+}
+
+func (s *Server) now() time.Time {
+	return s.clock.Now().Add(s.offset)
+}
+
+// SetClock use clock as time source, so that the keys expire together with
+// the tokens of managers sharing the same clock
+func (s *Server) SetClock(c token.Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+}
+
+// FastForward move simulated time forward, keys which have reached their
+// expiration are gone afterwards
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += d
+}
+
+// FlushAll remove all keys of all databases
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dbs = make(map[int]db)
+}
+
+func (s *Server) db(n int) db {
+	d := s.dbs[n]
+	if d == nil {
+		d = make(db)
+		s.dbs[n] = d
+	}
+	return d
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{
+			s:    s,
+			conn: conn,
+			w:    bufio.NewWriter(conn),
+			subs: make(map[string]struct{}),
+			psub: make(map[string]struct{}),
+		}
+		s.mu.Lock()
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+		}()
+	}
+}
+
+// client state of one connection
+type client struct {
+	s     *Server
+	conn  net.Conn
+	wmu   sync.Mutex
+	w     *bufio.Writer
+	db    int
+	multi bool
+	dirty bool
+	queue [][]string
+	subs  map[string]struct{}
+	psub  map[string]struct{}
+}
+
+func (c *client) reply(v interface{}) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	writeReply(c.w, v)
+	c.w.Flush()
+}
+
+func (c *client) subscribed() bool {
+	return len(c.subs)+len(c.psub) > 0
+}
+
+func (c *client) serve() {
+	defer c.close()
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToLower(args[0])
+		if name == "quit" {
+			c.reply(statusOK)
+			return
+		}
+		c.handle(name, args)
+	}
+}
+
+func (c *client) close() {
+	c.s.mu.Lock()
+	c.unsubscribeAll()
+	delete(c.s.clients, c)
+	c.s.mu.Unlock()
+	c.conn.Close()
+}
+
+func (c *client) handle(name string, args []string) {
+	if c.subscribed() {
+		switch name {
+		case "subscribe", "unsubscribe", "psubscribe", "punsubscribe":
+		case "ping":
+			msg := ""
+			if len(args) > 1 {
+				msg = args[1]
+			}
+			c.reply([]interface{}{"pong", msg})
+			return
+		default:
+			c.reply(redisError("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+			return
+		}
+	}
+	switch name {
+	case "multi":
+		if c.multi {
+			c.reply(redisError("ERR MULTI calls can not be nested"))
+			return
+		}
+		c.multi = true
+		c.dirty = false
+		c.queue = nil
+		c.reply(statusOK)
+		return
+	case "exec":
+		if !c.multi {
+			c.reply(redisError("ERR EXEC without MULTI"))
+			return
+		}
+		c.multi = false
+		queue := c.queue
+		c.queue = nil
+		if c.dirty {
+			c.reply(redisError("EXECABORT Transaction discarded because of previous errors."))
+			return
+		}
+		c.s.mu.Lock()
+		ret := make([]interface{}, 0, len(queue))
+		for _, args := range queue {
+			ret = append(ret, c.s.exec(c, args))
+		}
+		c.s.mu.Unlock()
+		c.reply(ret)
+		return
+	case "discard":
+		if !c.multi {
+			c.reply(redisError("ERR DISCARD without MULTI"))
+			return
+		}
+		c.multi = false
+		c.queue = nil
+		c.reply(statusOK)
+		return
+	case "subscribe", "psubscribe":
+		if c.multi {
+			break
+		}
+		c.subscribe(name == "psubscribe", args[1:])
+		return
+	case "unsubscribe", "punsubscribe":
+		if c.multi {
+			break
+		}
+		c.unsubscribe(name == "punsubscribe", args[1:])
+		return
+	}
+	if c.multi {
+		if _, ok := commands[name]; !ok {
+			c.dirty = true
+			c.reply(redisError("ERR unknown command '" + args[0] + "'"))
+			return
+		}
+		c.queue = append(c.queue, args)
+		c.reply(statusQueued)
+		return
+	}
+	c.s.mu.Lock()
+	ret := c.s.exec(c, args)
+	c.s.mu.Unlock()
+	c.reply(ret)
+}
+
+// exec run one command, must be called with lock held
+func (s *Server) exec(c *client, args []string) interface{} {
+	fn, ok := commands[strings.ToLower(args[0])]
+	if !ok {
+		return redisError("ERR unknown command '" + args[0] + "'")
+	}
+	return fn(s, c, args)
+}
@@ -0,0 +1,97 @@
+package redistest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestServer(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start server: %v", err)
+	}
+	defer srv.Close()
+	cli := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer cli.Close()
+	ctx := context.Background()
+
+	ok, err := cli.SetNX(ctx, "a", "1", time.Minute).Result()
+	if err != nil || !ok {
+		t.Fatalf("unexpected setnx: %v", err)
+	}
+	ok, err = cli.SetNX(ctx, "a", "2", time.Minute).Result()
+	if err != nil || ok {
+		t.Fatalf("unexpected setnx of existing key: %v", err)
+	}
+	_, err = cli.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "b", "2", 0)
+		pipe.Expire(ctx, "b", 10*time.Second)
+		pipe.HSet(ctx, "h", "f", "v")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected multi/exec: %v", err)
+	}
+	ttl, err := cli.PTTL(ctx, "b").Result()
+	if err != nil || ttl <= 9*time.Second || ttl > 10*time.Second {
+		t.Fatalf("unexpected pttl: %s %v", ttl, err)
+	}
+	srv.FastForward(30 * time.Second)
+	err = cli.Get(ctx, "b").Err()
+	if err != redis.Nil {
+		t.Fatalf("unexpected get of expired key: %v", err)
+	}
+	val, err := cli.Get(ctx, "a").Result()
+	if err != nil || val != "1" {
+		t.Fatalf("unexpected get: %s %v", val, err)
+	}
+
+	srv.Script("getdel", func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+		val, err := call("get", keys[0])
+		if err != nil {
+			return nil, err
+		}
+		_, err = call("del", keys[0])
+		return val, err
+	})
+	script := redis.NewScript("-- getdel\nlocal v = redis.call('get', KEYS[1])\nredis.call('del', KEYS[1])\nreturn v")
+	val, err = script.Run(ctx, cli, []string{"a"}).Text()
+	if err != nil || val != "1" {
+		t.Fatalf("unexpected script result: %s %v", val, err)
+	}
+	err = script.Run(ctx, cli, []string{"a"}).Err()
+	if err != redis.Nil {
+		t.Fatalf("unexpected script result of missing key: %v", err)
+	}
+
+	n, err := cli.SAdd(ctx, "s", "b", "a", "b").Result()
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected sadd: %d %v", n, err)
+	}
+	members, err := cli.SMembers(ctx, "s").Result()
+	if err != nil || len(members) != 2 || members[0] != "a" || members[1] != "b" {
+		t.Fatalf("unexpected smembers: %v %v", members, err)
+	}
+	n, err = cli.SRem(ctx, "s", "a", "b").Result()
+	if err != nil || n != 2 || cli.Exists(ctx, "s").Val() != 0 {
+		t.Fatalf("unexpected srem: %d %v", n, err)
+	}
+
+	sub := cli.Subscribe(ctx, "ch")
+	defer sub.Close()
+	_, err = sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("unexpected subscribe: %v", err)
+	}
+	n, err = cli.Publish(ctx, "ch", "hello").Result()
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected publish: %d %v", n, err)
+	}
+	msg, err := sub.ReceiveMessage(ctx)
+	if err != nil || msg.Payload != "hello" {
+		t.Fatalf("unexpected message: %v", err)
+	}
+}
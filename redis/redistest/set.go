@@ -0,0 +1,112 @@
+package redistest
+
+import "sort"
+
+func getSet(s *Server, d db, key string, create bool) (*value, interface{}) {
+	v := s.lookup(d, key)
+	if v == nil {
+		if !create {
+			return nil, nil
+		}
+		v = &value{kind: kindSet, set: make(map[string]struct{})}
+		d[key] = v
+	}
+	if v.kind != kindSet {
+		return nil, errWrongTyp
+	}
+	return v, nil
+}
+
+func cmdSAdd(s *Server, c *client, args []string) interface{} {
+	if len(args) < 3 {
+		return errArgs("sadd")
+	}
+	v, err := getSet(s, s.db(c.db), args[1], true)
+	if err != nil {
+		return err
+	}
+	var n int
+	for _, member := range args[2:] {
+		if _, ok := v.set[member]; !ok {
+			v.set[member] = struct{}{}
+			n++
+		}
+	}
+	return n
+}
+
+func cmdSRem(s *Server, c *client, args []string) interface{} {
+	if len(args) < 3 {
+		return errArgs("srem")
+	}
+	d := s.db(c.db)
+	v, err := getSet(s, d, args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	var n int
+	for _, member := range args[2:] {
+		if _, ok := v.set[member]; ok {
+			delete(v.set, member)
+			n++
+		}
+	}
+	if len(v.set) == 0 {
+		delete(d, args[1])
+	}
+	return n
+}
+
+func cmdSCard(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("scard")
+	}
+	v, err := getSet(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.set)
+}
+
+func cmdSIsMember(s *Server, c *client, args []string) interface{} {
+	if len(args) != 3 {
+		return errArgs("sismember")
+	}
+	v, err := getSet(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	if _, ok := v.set[args[2]]; ok {
+		return 1
+	}
+	return 0
+}
+
+// cmdSMembers SMEMBERS key, members are sorted to make replies stable
+func cmdSMembers(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("smembers")
+	}
+	v, err := getSet(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	ret := []string{}
+	if v == nil {
+		return ret
+	}
+	for member := range v.set {
+		ret = append(ret, member)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,200 @@
+package redistest
+
+import (
+	"strconv"
+	"strings"
+)
+
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string
+}
+
+var errStreamID = redisError("ERR Invalid stream ID specified as stream command argument")
+
+// parseStreamID parses "ms-seq" or "ms", seq defaults to def
+func parseStreamID(str string, def uint64) (streamID, error) {
+	var id streamID
+	ms, seq := str, ""
+	if n := strings.IndexByte(str, '-'); n != -1 {
+		ms, seq = str[:n], str[n+1:]
+	}
+	var err error
+	id.ms, err = strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return id, errStreamID
+	}
+	id.seq = def
+	if len(seq) > 0 {
+		id.seq, err = strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return id, errStreamID
+		}
+	}
+	return id, nil
+}
+
+func getStream(s *Server, d db, key string, create bool) (*value, interface{}) {
+	v := s.lookup(d, key)
+	if v == nil {
+		if !create {
+			return nil, nil
+		}
+		v = &value{kind: kindStream}
+		d[key] = v
+	}
+	if v.kind != kindStream {
+		return nil, errWrongTyp
+	}
+	return v, nil
+}
+
+// cmdXAdd XADD key [NOMKSTREAM] [MAXLEN [=|~] n] *|id field value ...,
+// approximate trimming is exact here
+func cmdXAdd(s *Server, c *client, args []string) interface{} {
+	if len(args) < 5 {
+		return errArgs("xadd")
+	}
+	key := args[1]
+	args = args[2:]
+	var nomk bool
+	maxLen := -1
+	for len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "nomkstream":
+			nomk = true
+			args = args[1:]
+			continue
+		case "maxlen":
+			args = args[1:]
+			if len(args) > 0 && (args[0] == "~" || args[0] == "=") {
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				return errSyntax
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return errNotInt
+			}
+			maxLen = n
+			args = args[1:]
+			continue
+		}
+		break
+	}
+	if len(args) < 3 || len(args)%2 != 1 {
+		return errArgs("xadd")
+	}
+	d := s.db(c.db)
+	v, err := getStream(s, d, key, !nomk)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	var last streamID
+	if len(v.stream) > 0 {
+		last = v.stream[len(v.stream)-1].id
+	}
+	var id streamID
+	if args[0] == "*" {
+		id.ms = uint64(s.now().UnixNano() / 1e6)
+		if id.ms <= last.ms {
+			id = streamID{ms: last.ms, seq: last.seq + 1}
+		}
+	} else {
+		var e error
+		id, e = parseStreamID(args[0], 0)
+		if e != nil {
+			return e
+		}
+		if !last.less(id) {
+			return redisError("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	}
+	v.stream = append(v.stream, streamEntry{
+		id:     id,
+		fields: append([]string(nil), args[1:]...),
+	})
+	if maxLen >= 0 && len(v.stream) > maxLen {
+		v.stream = append([]streamEntry(nil), v.stream[len(v.stream)-maxLen:]...)
+	}
+	return id.String()
+}
+
+func cmdXLen(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("xlen")
+	}
+	v, err := getStream(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.stream)
+}
+
+// cmdXRange XRANGE key start end [COUNT n]
+func cmdXRange(s *Server, c *client, args []string) interface{} {
+	if len(args) != 4 && len(args) != 6 {
+		return errArgs("xrange")
+	}
+	start, end := streamID{}, streamID{ms: ^uint64(0), seq: ^uint64(0)}
+	var err error
+	if args[2] != "-" {
+		start, err = parseStreamID(args[2], 0)
+		if err != nil {
+			return err
+		}
+	}
+	if args[3] != "+" {
+		end, err = parseStreamID(args[3], ^uint64(0))
+		if err != nil {
+			return err
+		}
+	}
+	count := -1
+	if len(args) == 6 {
+		if strings.ToLower(args[4]) != "count" {
+			return errSyntax
+		}
+		count, err = strconv.Atoi(args[5])
+		if err != nil {
+			return errNotInt
+		}
+	}
+	v, e := getStream(s, s.db(c.db), args[1], false)
+	if e != nil {
+		return e
+	}
+	ret := []interface{}{}
+	if v == nil {
+		return ret
+	}
+	for _, entry := range v.stream {
+		if count >= 0 && len(ret) >= count {
+			break
+		}
+		if entry.id.less(start) || end.less(entry.id) {
+			continue
+		}
+		ret = append(ret, []interface{}{entry.id.String(), entry.fields})
+	}
+	return ret
+}
@@ -0,0 +1,217 @@
+package redistest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortedMembers returns members ordered by score then member like redis
+func sortedMembers(zset map[string]float64) []string {
+	ret := make([]string, 0, len(zset))
+	for member := range zset {
+		ret = append(ret, member)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := zset[ret[i]], zset[ret[j]]
+		if a != b {
+			return a < b
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+func getZSet(s *Server, d db, key string, create bool) (*value, interface{}) {
+	v := s.lookup(d, key)
+	if v == nil {
+		if !create {
+			return nil, nil
+		}
+		v = &value{kind: kindZSet, zset: make(map[string]float64)}
+		d[key] = v
+	}
+	if v.kind != kindZSet {
+		return nil, errWrongTyp
+	}
+	return v, nil
+}
+
+// cmdZAdd ZADD key [NX|XX] [CH] score member ...
+func cmdZAdd(s *Server, c *client, args []string) interface{} {
+	if len(args) < 4 {
+		return errArgs("zadd")
+	}
+	key := args[1]
+	args = args[2:]
+	var nx, xx, ch bool
+flags:
+	for len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ch":
+			ch = true
+		default:
+			break flags
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return errSyntax
+	}
+	if nx && xx {
+		return redisError("ERR XX and NX options at the same time are not compatible")
+	}
+	scores := make([]float64, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return redisError("ERR value is not a valid float")
+		}
+		scores = append(scores, score)
+	}
+	d := s.db(c.db)
+	v, err := getZSet(s, d, key, !xx)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	var added, changed int
+	for i := 0; i < len(args); i += 2 {
+		member := args[i+1]
+		old, ok := v.zset[member]
+		if (ok && nx) || (!ok && xx) {
+			continue
+		}
+		if !ok {
+			added++
+		} else if old != scores[i/2] {
+			changed++
+		}
+		v.zset[member] = scores[i/2]
+	}
+	if len(v.zset) == 0 {
+		delete(d, key)
+	}
+	if ch {
+		return added + changed
+	}
+	return added
+}
+
+func cmdZRem(s *Server, c *client, args []string) interface{} {
+	if len(args) < 3 {
+		return errArgs("zrem")
+	}
+	d := s.db(c.db)
+	v, err := getZSet(s, d, args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	var n int
+	for _, member := range args[2:] {
+		if _, ok := v.zset[member]; ok {
+			delete(v.zset, member)
+			n++
+		}
+	}
+	if len(v.zset) == 0 {
+		delete(d, args[1])
+	}
+	return n
+}
+
+func cmdZCard(s *Server, c *client, args []string) interface{} {
+	if len(args) != 2 {
+		return errArgs("zcard")
+	}
+	v, err := getZSet(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return 0
+	}
+	return len(v.zset)
+}
+
+func cmdZScore(s *Server, c *client, args []string) interface{} {
+	if len(args) != 3 {
+		return errArgs("zscore")
+	}
+	v, err := getZSet(s, s.db(c.db), args[1], false)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	score, ok := v.zset[args[2]]
+	if !ok {
+		return nil
+	}
+	return formatScore(score)
+}
+
+// cmdZRange ZRANGE key start stop [WITHSCORES]
+func cmdZRange(s *Server, c *client, args []string) interface{} {
+	if len(args) != 4 && len(args) != 5 {
+		return errArgs("zrange")
+	}
+	var withScores bool
+	if len(args) == 5 {
+		if strings.ToLower(args[4]) != "withscores" {
+			return errSyntax
+		}
+		withScores = true
+	}
+	start, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInt
+	}
+	stop, err := strconv.Atoi(args[3])
+	if err != nil {
+		return errNotInt
+	}
+	v, e := getZSet(s, s.db(c.db), args[1], false)
+	if e != nil {
+		return e
+	}
+	ret := []string{}
+	if v == nil {
+		return ret
+	}
+	members := sortedMembers(v.zset)
+	n := len(members)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	for i := start; i <= stop; i++ {
+		ret = append(ret, members[i])
+		if withScores {
+			ret = append(ret, formatScore(v.zset[members[i]]))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,242 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lwch/token"
+)
+
+// sessionsPrefix prefix of sorted set of tokens of uid, scored by creation
+// time or by last verify time for lru policy. It has no ttl since tokens of
+// uid may have different lifetimes, members are removed on revoke and
+// expired members by Purge.
+const sessionsPrefix = "#sessions:"
+
+// metaPrefix prefix of hash of session metadata of token
+const metaPrefix = "#meta:"
+
+// saveScript save token and enforce session limit atomically, evicted
+// tokens are returned and nil is returned when the new token is rejected.
+// Keys of other tokens of uid are built from the key prefix since they are
+// only known inside the script, so in cluster mode the prefix must be a hash
+// tag, see RedisConf.HashTag.
+//
+// KEYS: token, uid, index, sessions, meta
+// ARGV: data, ttl ms or 0 for no expiry, token, uid, now ms, max sessions,
+// policy, key prefix, metadata field value pairs...
+var saveScript = redis.NewScript(`-- token:save
+local max = tonumber(ARGV[6])
+local ttl = tonumber(ARGV[2])
+local evicted = {}
+local live = {}
+for _, tk in ipairs(redis.call('zrange', KEYS[4], 0, -1)) do
+	if tk ~= ARGV[3] then
+		if redis.call('exists', ARGV[8] .. tk) == 1 then
+			table.insert(live, tk)
+		else
+			redis.call('zrem', KEYS[4], tk)
+			redis.call('hdel', KEYS[3], tk)
+		end
+	end
+end
+local over = #live - max + 1
+if over > 0 then
+	if ARGV[7] == 'reject' then
+		return false
+	end
+	local cur = redis.call('get', KEYS[2])
+	for i = 1, over do
+		redis.call('del', ARGV[8] .. live[i])
+		redis.call('del', ARGV[8] .. '#meta:' .. live[i])
+		redis.call('hdel', KEYS[3], live[i])
+		redis.call('zrem', KEYS[4], live[i])
+		if cur == live[i] then
+			redis.call('del', KEYS[2])
+		end
+		table.insert(evicted, live[i])
+	end
+end
+if ttl > 0 then
+	redis.call('set', KEYS[1], ARGV[1], 'px', ttl, 'nx')
+	redis.call('set', KEYS[2], ARGV[3], 'px', ttl, 'nx')
+else
+	redis.call('set', KEYS[1], ARGV[1], 'nx')
+	redis.call('set', KEYS[2], ARGV[3], 'nx')
+end
+redis.call('hset', KEYS[3], ARGV[3], ARGV[4])
+redis.call('zadd', KEYS[4], ARGV[5], ARGV[3])
+redis.call('del', KEYS[5])
+redis.call('hset', KEYS[5], unpack(ARGV, 9))
+if ttl > 0 then
+	redis.call('pexpire', KEYS[5], ttl)
+end
+return evicted`)
+
+func (m *Mgr) sessionsKey(uid string) string {
+	return m.key(sessionsPrefix + uid)
+}
+
+func (m *Mgr) metaKey(tk string) string {
+	return m.key(metaPrefix + tk)
+}
+
+// metaFields returns fields of metadata hash, seen is not set until Verify
+func metaFields(meta token.Meta, created int64) []interface{} {
+	return []interface{}{
+		"ip", meta.IP,
+		"user_agent", meta.UserAgent,
+		"device", meta.Device,
+		"binding", meta.Binding,
+		"purpose", meta.Purpose,
+		"parent", meta.Parent,
+		"created", created,
+	}
+}
+
+func (m *Mgr) nowMs() int64 {
+	return m.clock.Now().UnixNano() / 1e6
+}
+
+// saveLimited save token by saveScript, the keys of one uid must be in the
+// same slot in cluster mode, see RedisConf.HashTag
+func (m *Mgr) saveLimited(tk token.Token, data []byte, meta token.Meta) error {
+	now := m.nowMs()
+	args := append([]interface{}{
+		string(data),
+		m.ttl.Milliseconds(),
+		tk.GetTK(),
+		tk.GetUID(),
+		now,
+		m.maxSessions,
+		m.policy.String(),
+		m.key(""),
+	}, metaFields(meta, now)...)
+	ret, err := saveScript.Run(context.Background(), m.client(), []string{
+		m.key(tk.GetTK()),
+		m.key(tk.GetUID()),
+		m.key(indexKey),
+		m.sessionsKey(tk.GetUID()),
+		m.metaKey(tk.GetTK()),
+	}, args...).Result()
+	if err == redis.Nil {
+		return token.ErrSessionLimit
+	}
+	if err != nil {
+		return err
+	}
+	evicted, _ := ret.([]interface{})
+	for _, t := range evicted {
+		t, _ := t.(string)
+		m.emit(token.Event{
+			Op:    token.OpEvict,
+			Actor: tk.GetUID(),
+			UID:   tk.GetUID(),
+			Token: t,
+			OK:    true,
+		})
+		m.revokeChildren(tk.GetUID(), t)
+	}
+	return nil
+}
+
+// touch record last verify time, update score of token for lru policy and
+// extend ttl of metadata when slide is set
+func (m *Mgr) touch(pipe redis.Pipeliner, uid, tk string, slide bool) {
+	now := m.nowMs()
+	if m.policy == token.EvictLRU {
+		pipe.ZAddXX(context.Background(), m.sessionsKey(uid), &redis.Z{
+			Score:  float64(now),
+			Member: tk,
+		})
+	}
+	pipe.HSet(context.Background(), m.metaKey(tk), "seen", now)
+	if slide {
+		m.expire(pipe, m.metaKey(tk))
+	}
+}
+
+func parseMs(str string) time.Time {
+	ms, _ := strconv.ParseInt(str, 10, 64)
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*1e6)
+}
+
+// sessionOf build session from metadata hash and ttl of token key
+func sessionOf(uid, tk string, fields map[string]string, ttl time.Duration) token.Session {
+	ret := token.Session{
+		UID:   uid,
+		Token: tk,
+		Meta: token.Meta{
+			IP:        fields["ip"],
+			UserAgent: fields["user_agent"],
+			Device:    fields["device"],
+			Binding:   fields["binding"],
+			Purpose:   fields["purpose"],
+			Parent:    fields["parent"],
+		},
+		Created:  parseMs(fields["created"]),
+		LastSeen: parseMs(fields["seen"]),
+		TTL:      ttl,
+	}
+	if ret.LastSeen.IsZero() {
+		ret.LastSeen = ret.Created
+	}
+	if ret.TTL < 0 {
+		ret.TTL = 0
+	}
+	return ret
+}
+
+// Session get session by token
+func (m *Mgr) Session(tk string) (token.Session, error) {
+	var uid *redis.StringCmd
+	var fields *redis.StringStringMapCmd
+	var ttl *redis.DurationCmd
+	_, err := m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		uid = pipe.HGet(context.Background(), m.key(indexKey), tk)
+		fields = pipe.HGetAll(context.Background(), m.metaKey(tk))
+		ttl = pipe.PTTL(context.Background(), m.key(tk))
+		return nil
+	})
+	if err == redis.Nil || ttl.Val() == -2 {
+		return token.Session{}, ErrNotfound
+	}
+	if err != nil {
+		return token.Session{}, err
+	}
+	return sessionOf(uid.Val(), tk, fields.Val(), ttl.Val()), nil
+}
+
+// Sessions list sessions of uid which are not expired, ordered by creation
+// or by last verify time for lru policy
+func (m *Mgr) Sessions(uid string) ([]token.Session, error) {
+	tks, err := m.client().ZRange(context.Background(), m.sessionsKey(uid), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]*redis.StringStringMapCmd, len(tks))
+	ttls := make([]*redis.DurationCmd, len(tks))
+	_, err = m.client().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for i, tk := range tks {
+			fields[i] = pipe.HGetAll(context.Background(), m.metaKey(tk))
+			ttls[i] = pipe.PTTL(context.Background(), m.key(tk))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]token.Session, 0, len(tks))
+	for i, tk := range tks {
+		if ttls[i].Val() == -2 {
+			continue
+		}
+		ret = append(ret, sessionOf(uid, tk, fields[i].Val(), ttls[i].Val()))
+	}
+	return ret, nil
+}
@@ -0,0 +1,44 @@
+package token
+
+import "time"
+
+// Meta session metadata kept by managers beside the token payload, so Token
+// implementations do not need to serialize it
+type Meta struct {
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Device    string `json:"device,omitempty"`
+	// Binding fingerprint of client context the token is bound to, see
+	// package binding
+	Binding string `json:"binding,omitempty"`
+	// Purpose purpose of one-time-use token such as "reset", see
+	// OneTimeManager
+	Purpose string `json:"purpose,omitempty"`
+	// Parent token this one is derived from, see HierarchyManager
+	Parent string `json:"parent,omitempty"`
+}
+
+// Session token with its metadata
+type Session struct {
+	UID     string
+	Token   string
+	Meta    Meta
+	Created time.Time
+	// LastSeen time of last successful Verify, it equals to Created when the
+	// token is never verified
+	LastSeen time.Time
+	// TTL remaining ttl, 0 means no expiry
+	TTL time.Duration
+}
+
+// SessionManager manager which keeps session metadata, implemented by every
+// backend
+type SessionManager interface {
+	Manager
+	// SaveSession save token with metadata
+	SaveSession(tk Token, meta Meta) error
+	// Session get session by token
+	Session(tk string) (Session, error)
+	// Sessions list sessions of uid which are not expired
+	Sessions(uid string) ([]Session, error)
+}
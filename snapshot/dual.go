@@ -0,0 +1,49 @@
+package snapshot
+
+import "github.com/lwch/token"
+
+// Dual manager used while migrating between stores, new tokens are saved
+// into dst and lookups fall back to src. The usual rollout is to deploy
+// Dual, run Migrate to copy the existing tokens and then switch to dst.
+type Dual struct {
+	dst token.Manager
+	src token.Manager
+}
+
+// NewDual new dual manager
+func NewDual(dst, src token.Manager) *Dual {
+	return &Dual{dst: dst, src: src}
+}
+
+// Save save token into dst
+func (d *Dual) Save(tk token.Token) error {
+	return d.dst.Save(tk)
+}
+
+// Verify verify token in dst and then in src
+func (d *Dual) Verify(tk token.Token) (bool, error) {
+	ok, err := d.dst.Verify(tk)
+	if ok || err != nil {
+		return ok, err
+	}
+	return d.src.Verify(tk)
+}
+
+// Revoke revoke token in both stores, src is the first so that Migrate
+// running meanwhile does not copy the token back into dst
+func (d *Dual) Revoke(uid, tk string) {
+	d.src.Revoke(uid, tk)
+	d.dst.Revoke(uid, tk)
+}
+
+// Get get token by uid from dst and then from src
+func (d *Dual) Get(uid string, tk token.Token) error {
+	err := d.dst.Get(uid, tk)
+	if err == nil {
+		return nil
+	}
+	if d.src.Get(uid, tk) == nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lwch/token"
+)
+
+// Version current snapshot format version
+const Version = 1
+
+// ErrVersion unsupported snapshot version
+var ErrVersion = errors.New("snapshot: unsupported version")
+
+// Source store which can walk its entries, implemented by every backend
+type Source interface {
+	Walk(func(token.Entry) error) error
+}
+
+// Target store which can restore raw entries, implemented by every backend
+type Target interface {
+	Restore(token.Entry) error
+}
+
+// Store store which can be migrated, implemented by every backend
+type Store interface {
+	Source
+	Target
+	Lookup(tk string) (token.Entry, error)
+	Revoke(uid, tk string)
+}
+
+// header first line of snapshot
+type header struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// record one line for each token, payload is base64 encoded
+type record struct {
+	UID     string `json:"uid"`
+	Token   string `json:"token"`
+	Payload []byte `json:"payload"`
+	// TTL remaining ttl in milliseconds when the snapshot was created,
+	// zero means no expiration
+	TTL  int64       `json:"ttl_ms,omitempty"`
+	Meta *token.Meta `json:"meta,omitempty"`
+}
+
+// Export write json-lines snapshot of src into w, returns the number of
+// exported tokens
+func Export(w io.Writer, src Source) (int, error) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(header{
+		Version: Version,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var cnt int
+	err = src.Walk(func(e token.Entry) error {
+		rec := record{
+			UID:     e.UID,
+			Token:   e.Token,
+			Payload: e.Data,
+			TTL:     e.TTL.Milliseconds(),
+		}
+		if e.Meta != (token.Meta{}) {
+			rec.Meta = &e.Meta
+		}
+		err := enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+		cnt++
+		return nil
+	})
+	return cnt, err
+}
+
+// Import restore snapshot from r into dst, the time elapsed since the
+// snapshot was created is subtracted from the ttl and expired tokens are
+// skipped, so are children whose parent is not imported. Returns the number
+// of imported tokens.
+func Import(r io.Reader, dst Target) (int, error) {
+	dec := json.NewDecoder(r)
+	var hdr header
+	err := dec.Decode(&hdr)
+	if err == io.EOF {
+		return 0, errors.New("snapshot: missing header")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("snapshot: invalid header: %v", err)
+	}
+	if hdr.Version != Version {
+		return 0, ErrVersion
+	}
+	elapsed := time.Since(hdr.Created)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	rs := restorer{dst: dst}
+	for n := 1; ; n++ {
+		var rec record
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			return rs.cnt, rs.flush()
+		}
+		if err != nil {
+			return rs.cnt, fmt.Errorf("snapshot: invalid record %d: %v", n, err)
+		}
+		e := token.Entry{
+			UID:   rec.UID,
+			Token: rec.Token,
+			Data:  rec.Payload,
+		}
+		if rec.Meta != nil {
+			e.Meta = *rec.Meta
+		}
+		if rec.TTL > 0 {
+			e.TTL = time.Duration(rec.TTL)*time.Millisecond - elapsed
+			if e.TTL <= 0 {
+				continue
+			}
+		}
+		err = rs.restore(e)
+		if err != nil {
+			return rs.cnt, err
+		}
+	}
+}
+
+// Migrate copy all tokens from src into dst, the source keeps serving
+// while copying. Every token is looked up in src again after it is copied
+// and revoked from dst when it is gone, so tokens revoked from src and then
+// from dst like Dual.Revoke are not brought back. Returns the number of
+// migrated tokens.
+func Migrate(dst, src Store) (int, error) {
+	r := restorer{dst: dst, check: func(e token.Entry) (bool, error) {
+		_, err := src.Lookup(e.Token)
+		if err == token.ErrNotfound {
+			dst.Revoke(e.UID, e.Token)
+			return false, nil
+		}
+		return err == nil, err
+	}}
+	err := src.Walk(r.restore)
+	if err == nil {
+		err = r.flush()
+	}
+	return r.cnt, err
+}
+
+// restorer restore entries into dst, entries are not ordered so children
+// whose parent is not restored yet are kept until flush
+type restorer struct {
+	dst Target
+	// check called after each restore, returns false when entry was dropped
+	check   func(token.Entry) (bool, error)
+	cnt     int
+	pending []token.Entry
+}
+
+func (r *restorer) restore(e token.Entry) error {
+	err := r.dst.Restore(e)
+	if err == token.ErrNotfound && len(e.Meta.Parent) > 0 {
+		r.pending = append(r.pending, e)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.check != nil {
+		ok, err := r.check(e)
+		if !ok {
+			return err
+		}
+	}
+	r.cnt++
+	return nil
+}
+
+// flush restore pending children until no parent shows up, children of
+// parents which are gone are dropped since they are revoked with them
+func (r *restorer) flush() error {
+	for len(r.pending) > 0 {
+		pending := r.pending
+		r.pending = nil
+		for _, e := range pending {
+			err := r.restore(e)
+			if err != nil {
+				return err
+			}
+		}
+		if len(r.pending) == len(pending) {
+			return nil
+		}
+	}
+	return nil
+}
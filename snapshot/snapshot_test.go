@@ -0,0 +1,292 @@
+package snapshot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwch/token"
+	"github.com/lwch/token/file"
+	"github.com/lwch/token/redis"
+	"github.com/lwch/token/redis/redistest"
+	"github.com/lwch/token/tokentest"
+)
+
+func entries(t *testing.T, src Source) map[string]token.Entry {
+	ret := make(map[string]token.Entry)
+	err := src.Walk(func(e token.Entry) error {
+		ret[e.Token] = e
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected walk: %v", err)
+	}
+	return ret
+}
+
+func TestSnapshot(t *testing.T) {
+	src := file.NewManager(t.TempDir(), time.Hour)
+	for _, e := range []token.Entry{
+		{UID: "1", Token: "aaa", Data: []byte(`{"name":"hello"}`), TTL: time.Hour},
+		{UID: "2", Token: "bbb", Data: []byte{0, 1, 2}, TTL: 10 * time.Minute},
+	} {
+		err := src.Restore(e)
+		if err != nil {
+			t.Fatalf("unexpected restore: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(&buf, src)
+	if err != nil {
+		t.Fatalf("unexpected export: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected export count: %d", n)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Fatalf("unexpected snapshot lines: %d", lines)
+	}
+
+	dst := file.NewManager(t.TempDir(), time.Hour)
+	n, err = Import(&buf, dst)
+	if err != nil {
+		t.Fatalf("unexpected import: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected import count: %d", n)
+	}
+	got := entries(t, dst)
+	if got["aaa"].UID != "1" || string(got["aaa"].Data) != `{"name":"hello"}` {
+		t.Fatalf("unexpected imported entry: %+v", got["aaa"])
+	}
+	if ttl := got["bbb"].TTL; ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Fatalf("unexpected imported ttl: %s", ttl)
+	}
+
+	_, err = Import(strings.NewReader(`{"version":2}`), dst)
+	if err != ErrVersion {
+		t.Fatalf("unexpected import of unknown version: %v", err)
+	}
+
+	mig := file.NewManager(t.TempDir(), time.Hour)
+	n, err = Migrate(mig, src)
+	if err != nil {
+		t.Fatalf("unexpected migrate: %v", err)
+	}
+	if n != 2 || len(entries(t, mig)) != 2 {
+		t.Fatalf("unexpected migrate count: %d", n)
+	}
+}
+
+func TestSnapshotMeta(t *testing.T) {
+	src := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer src.Close()
+	parent := tokentest.NewToken("1", "parent")
+	child := tokentest.NewToken("1", "child")
+	metas := map[string]token.Meta{
+		parent.Token: {Purpose: "refresh", Binding: "jkt"},
+		child.Token:  {Purpose: "access", Parent: parent.Token},
+	}
+	restore := func(tk *tokentest.Token) error {
+		return src.Restore(token.Entry{UID: tk.Uid, Token: tk.Token,
+			Data: []byte(`{}`), TTL: time.Hour, Meta: metas[tk.Token]})
+	}
+	err := restore(child)
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected restore of orphan: %v", err)
+	}
+	for _, tk := range []*tokentest.Token{parent, child} {
+		err = restore(tk)
+		if err != nil {
+			t.Fatalf("unexpected restore: %v", err)
+		}
+	}
+
+	check := func(name string, mgr *file.Mgr, n int) {
+		if n != 2 {
+			t.Fatalf("unexpected %s count: %d", name, n)
+		}
+		for tk, meta := range metas {
+			e, err := mgr.Lookup(tk)
+			if err != nil || e.Meta != meta {
+				t.Fatalf("unexpected %s entry: %+v, %v", name, e, err)
+			}
+		}
+		mgr.Revoke(parent.Uid, parent.Token)
+		if _, err := mgr.Lookup(child.Token); err != token.ErrNotfound {
+			t.Fatalf("unexpected lookup of %s child after revoke: %v", name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err = Export(&buf, src)
+	if err != nil {
+		t.Fatalf("unexpected export: %v", err)
+	}
+	dst := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer dst.Close()
+	n, err := Import(&buf, dst)
+	if err != nil {
+		t.Fatalf("unexpected import: %v", err)
+	}
+	check("imported", dst, n)
+
+	mig := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer mig.Close()
+	n, err = Migrate(mig, src)
+	if err != nil {
+		t.Fatalf("unexpected migrate: %v", err)
+	}
+	check("migrated", mig, n)
+}
+
+func TestSnapshotRedis(t *testing.T) {
+	src := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer src.Close()
+	for _, e := range []token.Entry{
+		{UID: "1", Token: "aaa", Data: []byte(`{"name":"hello"}`)},
+		{UID: "2", Token: "bbb", Data: []byte{0, 1, 2}, TTL: 10 * time.Minute},
+	} {
+		err := src.Restore(e)
+		if err != nil {
+			t.Fatalf("unexpected restore: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	_, err := Export(&buf, src)
+	if err != nil {
+		t.Fatalf("unexpected export: %v", err)
+	}
+
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected start redis server: %v", err)
+	}
+	defer srv.Close()
+	dst := redis.NewManager(redis.RedisConf{
+		Addrs:  []string{srv.Addr()},
+		Prefix: "snapshot",
+	}, time.Hour, token.WithoutJanitor())
+	defer dst.Close()
+	n, err := Import(&buf, dst)
+	if err != nil {
+		t.Fatalf("unexpected import: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected import count: %d", n)
+	}
+	got := entries(t, dst)
+	if got["aaa"].UID != "1" || string(got["aaa"].Data) != `{"name":"hello"}` {
+		t.Fatalf("unexpected imported entry: %+v", got["aaa"])
+	}
+	if got["aaa"].TTL != 0 {
+		t.Fatalf("unexpected imported ttl of token never expires: %s", got["aaa"].TTL)
+	}
+	if ttl := got["bbb"].TTL; ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Fatalf("unexpected imported ttl: %s", ttl)
+	}
+	if string(got["bbb"].Data) != string([]byte{0, 1, 2}) {
+		t.Fatalf("unexpected imported payload: %v", got["bbb"].Data)
+	}
+}
+
+func TestDual(t *testing.T) {
+	src := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer src.Close()
+	dst := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer dst.Close()
+	old := tokentest.NewToken("1", "old")
+	err := src.Save(old)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	dual := NewDual(dst, src)
+
+	// read through to src
+	ok, err := dual.Verify(&tokentest.Token{Token: old.Token})
+	if err != nil || !ok {
+		t.Fatalf("unexpected verify of token in src: %v, %v", ok, err)
+	}
+	var got tokentest.Token
+	err = dual.Get(old.Uid, &got)
+	if err != nil || got.Token != old.Token {
+		t.Fatalf("unexpected get of token in src: %+v, %v", got, err)
+	}
+
+	// new tokens are saved into dst only
+	tk := tokentest.NewToken("2", "new")
+	err = dual.Save(tk)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	if _, err := dst.Lookup(tk.Token); err != nil {
+		t.Fatalf("unexpected lookup in dst: %v", err)
+	}
+	if _, err := src.Lookup(tk.Token); err != token.ErrNotfound {
+		t.Fatalf("unexpected lookup in src: %v", err)
+	}
+	ok, err = dual.Verify(&tokentest.Token{Token: tk.Token})
+	if err != nil || !ok {
+		t.Fatalf("unexpected verify of token in dst: %v, %v", ok, err)
+	}
+
+	// revoke applies to both stores
+	_, err = Migrate(dst, src)
+	if err != nil {
+		t.Fatalf("unexpected migrate: %v", err)
+	}
+	dual.Revoke(old.Uid, old.Token)
+	for _, mgr := range []*file.Mgr{src, dst} {
+		if _, err := mgr.Lookup(old.Token); err != token.ErrNotfound {
+			t.Fatalf("unexpected lookup after revoke: %v", err)
+		}
+	}
+	ok, err = dual.Verify(&tokentest.Token{Token: old.Token})
+	if err != nil || ok {
+		t.Fatalf("unexpected verify after revoke: %v, %v", ok, err)
+	}
+	err = dual.Get(old.Uid, &got)
+	if err != token.ErrNotfound {
+		t.Fatalf("unexpected get after revoke: %v", err)
+	}
+}
+
+// revoking walks src and revokes each token by dual right after it is read,
+// before Migrate copies it
+type revoking struct {
+	*file.Mgr
+	dual *Dual
+}
+
+func (r revoking) Walk(fn func(token.Entry) error) error {
+	return r.Mgr.Walk(func(e token.Entry) error {
+		r.dual.Revoke(e.UID, e.Token)
+		return fn(e)
+	})
+}
+
+func TestDualMigrateRevoke(t *testing.T) {
+	src := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer src.Close()
+	dst := file.NewManager(t.TempDir(), time.Hour, token.WithoutJanitor())
+	defer dst.Close()
+	tk := tokentest.NewToken("1", "revoked")
+	err := src.Save(tk)
+	if err != nil {
+		t.Fatalf("unexpected save token: %v", err)
+	}
+	dual := NewDual(dst, src)
+	n, err := Migrate(dst, revoking{Mgr: src, dual: dual})
+	if err != nil || n != 0 {
+		t.Fatalf("unexpected migrate: %d, %v", n, err)
+	}
+	if _, err := dst.Lookup(tk.Token); err != token.ErrNotfound {
+		t.Fatalf("unexpected lookup of revoked token in dst: %v", err)
+	}
+	ok, err := dual.Verify(&tokentest.Token{Token: tk.Token})
+	if err != nil || ok {
+		t.Fatalf("unexpected verify of revoked token: %v, %v", ok, err)
+	}
+}
@@ -1,5 +1,7 @@
 package token
 
+import "time"
+
 // Token token struct
 type Token interface {
 	GetTK() string
@@ -10,3 +12,22 @@ type Token interface {
 	UnSerialize(string, []byte) error
 	Verify([]byte) (bool, error)
 }
+
+// Manager token manager, implemented by every backend
+type Manager interface {
+	Save(Token) error
+	Verify(Token) (bool, error)
+	Revoke(uid, tk string)
+	Get(uid string, tk Token) error
+}
+
+// Entry raw token entry in store
+type Entry struct {
+	UID   string
+	Token string
+	Data  []byte
+	// TTL remaining time to live, zero means no expiration
+	TTL time.Duration
+	// Meta metadata of session
+	Meta Meta
+}
@@ -0,0 +1,85 @@
+package tokentest
+
+import (
+	"sync"
+	"time"
+)
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// Clock fake clock for tests, time only moves by Add and Set
+type Clock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []waiter
+}
+
+// NewClock new fake clock starts at now
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns current fake time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns channel which fires when the clock reaches now + d
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), ch: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Add move the clock forward and fire the reached timers
+func (c *Clock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set set the clock to t and fire the reached timers
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(t)
+}
+
+func (c *Clock) set(t time.Time) {
+	c.now = t
+	left := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(t) {
+			left = append(left, w)
+			continue
+		}
+		w.ch <- t
+	}
+	c.waiters = left
+	c.cond.Broadcast()
+}
+
+// BlockUntil wait until n goroutines are waiting on After, it is used to
+// make sure that a janitor has finished its round
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
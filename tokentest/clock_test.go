@@ -0,0 +1,31 @@
+package tokentest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewClock(start)
+	ch := clk.After(time.Minute)
+	clk.BlockUntil(1)
+	clk.Add(30 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("unexpected timer fired early")
+	default:
+	}
+	clk.Add(30 * time.Second)
+	select {
+	case now := <-ch:
+		if !now.Equal(start.Add(time.Minute)) {
+			t.Fatalf("unexpected fired time: %s", now)
+		}
+	default:
+		t.Fatal("timer is not fired")
+	}
+	if !clk.Now().Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected now: %s", clk.Now())
+	}
+}
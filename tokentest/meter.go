@@ -0,0 +1,177 @@
+package tokentest
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/number"
+)
+
+// Measurement value recorded or observed on Meter
+type Measurement struct {
+	Name   string
+	Value  float64
+	Labels map[attribute.Key]attribute.Value
+}
+
+// Meter in-memory metric.MeterProvider records every measurement, install it
+// by global.SetMeterProvider, observers run on Collect
+type Meter struct {
+	mu           sync.Mutex
+	measurements []Measurement
+	async        []*asyncInstrument
+}
+
+// NewMeter new meter
+func NewMeter() *Meter {
+	return new(Meter)
+}
+
+// Meter returns meter of instrumentation backed by m
+func (m *Meter) Meter(name string, opts ...metric.MeterOption) metric.Meter {
+	return metric.WrapMeterImpl(m, name, opts...)
+}
+
+// RecordBatch record measurements
+func (m *Meter) RecordBatch(ctx context.Context, labels []attribute.KeyValue, ms ...metric.Measurement) {
+	for _, meas := range ms {
+		desc := meas.SyncImpl().Descriptor()
+		m.record(desc, meas.Number(), labels)
+	}
+}
+
+// NewSyncInstrument new synchronous instrument
+func (m *Meter) NewSyncInstrument(desc metric.Descriptor) (metric.SyncImpl, error) {
+	return &syncInstrument{m: m, desc: desc}, nil
+}
+
+// NewAsyncInstrument new asynchronous instrument
+func (m *Meter) NewAsyncInstrument(desc metric.Descriptor, runner metric.AsyncRunner) (metric.AsyncImpl, error) {
+	inst := &asyncInstrument{desc: desc, runner: runner}
+	m.mu.Lock()
+	m.async = append(m.async, inst)
+	m.mu.Unlock()
+	return inst, nil
+}
+
+// Collect run all observers
+func (m *Meter) Collect() {
+	m.mu.Lock()
+	async := append([]*asyncInstrument(nil), m.async...)
+	m.mu.Unlock()
+	for _, inst := range async {
+		capture := func(labels []attribute.KeyValue, obs ...metric.Observation) {
+			for _, o := range obs {
+				m.record(o.AsyncImpl().Descriptor(), o.Number(), labels)
+			}
+		}
+		switch runner := inst.runner.(type) {
+		case metric.AsyncSingleRunner:
+			runner.Run(context.Background(), inst, capture)
+		case metric.AsyncBatchRunner:
+			runner.Run(context.Background(), capture)
+		}
+	}
+}
+
+// Measurements returns measurements in order
+func (m *Meter) Measurements() []Measurement {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Measurement(nil), m.measurements...)
+}
+
+// Sum returns sum of measurements of name which have all labels
+func (m *Meter) Sum(name string, labels ...attribute.KeyValue) float64 {
+	var sum float64
+	for _, meas := range m.Find(name, labels...) {
+		sum += meas.Value
+	}
+	return sum
+}
+
+// Find returns measurements of name which have all labels
+func (m *Meter) Find(name string, labels ...attribute.KeyValue) []Measurement {
+	var ret []Measurement
+next:
+	for _, meas := range m.Measurements() {
+		if meas.Name != name {
+			continue
+		}
+		for _, l := range labels {
+			if meas.Labels[l.Key] != l.Value {
+				continue next
+			}
+		}
+		ret = append(ret, meas)
+	}
+	return ret
+}
+
+// Reset drop recorded measurements
+func (m *Meter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.measurements = nil
+}
+
+func (m *Meter) record(desc metric.Descriptor, n number.Number, labels []attribute.KeyValue) {
+	meas := Measurement{
+		Name:   desc.Name(),
+		Value:  n.CoerceToFloat64(desc.NumberKind()),
+		Labels: make(map[attribute.Key]attribute.Value, len(labels)),
+	}
+	for _, l := range labels {
+		meas.Labels[l.Key] = l.Value
+	}
+	m.mu.Lock()
+	m.measurements = append(m.measurements, meas)
+	m.mu.Unlock()
+}
+
+type syncInstrument struct {
+	m    *Meter
+	desc metric.Descriptor
+}
+
+func (inst *syncInstrument) Implementation() interface{} {
+	return inst
+}
+
+func (inst *syncInstrument) Descriptor() metric.Descriptor {
+	return inst.desc
+}
+
+func (inst *syncInstrument) Bind(labels []attribute.KeyValue) metric.BoundSyncImpl {
+	return bound{inst: inst, labels: labels}
+}
+
+func (inst *syncInstrument) RecordOne(ctx context.Context, n number.Number, labels []attribute.KeyValue) {
+	inst.m.record(inst.desc, n, labels)
+}
+
+type bound struct {
+	inst   *syncInstrument
+	labels []attribute.KeyValue
+}
+
+func (b bound) RecordOne(ctx context.Context, n number.Number) {
+	b.inst.RecordOne(ctx, n, b.labels)
+}
+
+func (b bound) Unbind() {}
+
+type asyncInstrument struct {
+	desc   metric.Descriptor
+	runner metric.AsyncRunner
+}
+
+func (inst *asyncInstrument) Implementation() interface{} {
+	return inst
+}
+
+func (inst *asyncInstrument) Descriptor() metric.Descriptor {
+	return inst.desc
+}
@@ -0,0 +1,64 @@
+package tokentest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Token token for tests, the payload is json of it
+type Token struct {
+	Token string
+	Uid   string
+	Name  string
+}
+
+// NewToken new token of uid with random token
+func NewToken(uid, name string) *Token {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return &Token{
+		Token: hex.EncodeToString(buf[:]),
+		Uid:   uid,
+		Name:  name,
+	}
+}
+
+// GetTK get token
+func (tk *Token) GetTK() string {
+	return tk.Token
+}
+
+// GetUID get uid
+func (tk *Token) GetUID() string {
+	return tk.Uid
+}
+
+// GetName get name
+func (tk *Token) GetName() string {
+	return tk.Name
+}
+
+// Serialize serialize token
+func (tk *Token) Serialize() ([]byte, error) {
+	return json.Marshal(tk)
+}
+
+// UnSerialize unserialize token
+func (tk *Token) UnSerialize(token string, data []byte) error {
+	return json.Unmarshal(data, tk)
+}
+
+// Verify load token when data is the payload of it
+func (tk *Token) Verify(data []byte) (bool, error) {
+	var dst Token
+	err := json.Unmarshal(data, &dst)
+	if err != nil {
+		return false, err
+	}
+	if tk.Token == dst.Token {
+		*tk = dst
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,125 @@
+package tokentest
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span span finished on Tracer
+type Span struct {
+	Name       string
+	Attributes map[attribute.Key]attribute.Value
+	Errors     []error
+	Status     codes.Code
+}
+
+// Tracer in-memory trace.TracerProvider records finished spans, install it
+// by otel.SetTracerProvider
+type Tracer struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// NewTracer new tracer
+func NewTracer() *Tracer {
+	return new(Tracer)
+}
+
+// Tracer returns t for every instrumentation
+func (t *Tracer) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return t
+}
+
+// Start start span
+func (t *Tracer) Start(ctx context.Context, name string, opts ...trace.SpanOption) (context.Context, trace.Span) {
+	s := &span{t: t, s: Span{
+		Name:       name,
+		Attributes: make(map[attribute.Key]attribute.Value),
+	}}
+	s.SetAttributes(trace.NewSpanConfig(opts...).Attributes...)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+// Spans returns finished spans in order
+func (t *Tracer) Spans() []Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Span(nil), t.spans...)
+}
+
+// Reset drop finished spans
+func (t *Tracer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = nil
+}
+
+type span struct {
+	mu    sync.Mutex
+	t     *Tracer
+	s     Span
+	ended bool
+}
+
+func (s *span) Tracer() trace.Tracer {
+	return s.t
+}
+
+func (s *span) End(options ...trace.SpanOption) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	done := s.s
+	s.mu.Unlock()
+	s.t.mu.Lock()
+	s.t.spans = append(s.t.spans, done)
+	s.t.mu.Unlock()
+}
+
+func (s *span) AddEvent(name string, options ...trace.EventOption) {}
+
+func (s *span) IsRecording() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.ended
+}
+
+func (s *span) RecordError(err error, options ...trace.EventOption) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.Errors = append(s.s.Errors, err)
+}
+
+func (s *span) SpanContext() trace.SpanContext {
+	return trace.SpanContext{}
+}
+
+func (s *span) SetStatus(code codes.Code, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.Status = code
+}
+
+func (s *span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.Name = name
+}
+
+func (s *span) SetAttributes(kv ...attribute.KeyValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range kv {
+		s.s.Attributes[a.Key] = a.Value
+	}
+}